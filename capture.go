@@ -0,0 +1,133 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Capture of the frames of a session
+
+package spdy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SetFrameCapture makes the session record all the frames it sends and
+// receives, as per the FrameCapture. It is to be called before serving
+func (s *Session) SetFrameCapture(c *FrameCapture) {
+	if c == nil || (c.Binary == nil && c.Text == nil) {
+		s.capture = nil
+		return
+	}
+	s.capture = &frameCapture{config: *c}
+	if c.Text != nil {
+		for i := range s.capture.framers {
+			s.capture.framers[i] = NewFramer(new(bytes.Buffer))
+		}
+	}
+}
+
+// record writes a frame as on the wire, sent or received, to the capture.
+// Errors writing are logged once, and the capture stops
+func (c *frameCapture) record(s *Session, wire []byte, sent bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed {
+		return
+	}
+	now := time.Now()
+	err := c.write(now, wire, sent)
+	if err != nil {
+		c.failed = true
+		s.logger().Error("cannot capture frames", "err", err)
+	}
+}
+
+func (c *frameCapture) write(now time.Time, wire []byte, sent bool) (err error) {
+	if c.config.Binary != nil {
+		var head [CAPTURE_HEAD_SIZE]byte
+		binary.BigEndian.PutUint64(head[:8], uint64(now.UnixNano()))
+		if sent {
+			head[8] = 1
+		}
+		_, err = c.config.Binary.Write(append(head[:], wire...))
+		if err != nil {
+			return
+		}
+	}
+	if c.config.Text != nil {
+		direction := 0
+		if sent {
+			direction = 1
+		}
+		f, derr := decodeCaptured(c.framers[direction], wire)
+		_, err = io.WriteString(c.config.Text, captureText(now, sent, f, derr))
+	}
+	return
+}
+
+// decodeCaptured decodes a frame with the Framer of its direction, which
+// keeps the header compression context
+func decodeCaptured(fr *Framer, wire []byte) (Frame, error) {
+	fr.rw.(*bytes.Buffer).Write(wire)
+	return fr.ReadFrame()
+}
+
+// captureText returns the text log entry of a frame
+func captureText(t time.Time, sent bool, f Frame, err error) string {
+	direction := "received"
+	if sent {
+		direction = "sent"
+	}
+	text := ""
+	if err != nil {
+		text = fmt.Sprintf("undecodable frame: %s", err)
+	} else {
+		text = strings.TrimSpace(f.String())
+	}
+	return fmt.Sprintf("%s %s %s\n", t.Format(time.RFC3339Nano), direction, text)
+}
+
+// NewCaptureReader returns a reader of the frames in the binary format
+// of a FrameCapture
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{
+		r:       r,
+		framers: [2]*Framer{NewFramer(new(bytes.Buffer)), NewFramer(new(bytes.Buffer))},
+	}
+}
+
+// Next returns the next frame captured, or io.EOF at the end of the
+// capture
+func (cr *CaptureReader) Next() (cf *CapturedFrame, err error) {
+	var head [CAPTURE_HEAD_SIZE + 8]byte
+	_, err = io.ReadFull(cr.r, head[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return
+	}
+	// the length of the frame is in its last 3 bytes of its head
+	length := int(head[CAPTURE_HEAD_SIZE+5])<<16 | int(head[CAPTURE_HEAD_SIZE+6])<<8 | int(head[CAPTURE_HEAD_SIZE+7])
+	wire := make([]byte, 8+length)
+	copy(wire, head[CAPTURE_HEAD_SIZE:])
+	_, err = io.ReadFull(cr.r, wire[8:])
+	if err != nil {
+		return
+	}
+	cf = &CapturedFrame{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(head[:8]))),
+		Sent: head[8] == 1,
+		Wire: wire,
+	}
+	direction := 0
+	if cf.Sent {
+		direction = 1
+	}
+	cf.Frame, err = decodeCaptured(cr.framers[direction], wire)
+	return
+}
@@ -8,9 +8,11 @@ package spdy
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -65,20 +67,37 @@ func (rw *ResponseRecorder) WriteHeader(code int) {
 
 //returns a client that reads and writes on c
 func NewClientConn(c net.Conn) (*Client, error) {
+	return NewClientConnConfig(c, nil)
+}
+
+//returns a client that reads and writes on c, with the settings of
+//config for its session, if any
+func NewClientConnConfig(c net.Conn, config *ClientConfig) (*Client, error) {
 	session := NewClientSession(c)
+	if config != nil {
+		if config.MaxFrameBytes > 0 {
+			session.SetMaxFrameBytes(config.MaxFrameBytes)
+		}
+		session.SetReplyTimeout(config.ResponseHeaderTimeout)
+	}
 	go session.Serve()
 	return &Client{cn: c, ss: session}, nil
 }
 
-//returns a client with tcp connection created using net.Dial
+//returns a client with tcp connection created using net.Dial, speaking
+//plaintext SPDY without TLS, as served by ListenAndServe
 func NewClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return Dial("tcp", addr)
+}
+
+//returns a client with a connection to addr on the named network,
+//created using net.Dial, like "tcp" or "unix" for unix domain sockets
+func Dial(network, addr string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return &Client{}, err
 	}
-	session := NewClientSession(conn)
-	go session.Serve()
-	return &Client{cn: conn, ss: session}, nil
+	return NewClientConnConfig(conn, nil)
 }
 
 //to get a response from the client
@@ -97,9 +116,34 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 		ContentLength: int64(rr.Body.Len()),
 		Header:        rr.Header(),
 	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			if resp.Trailer == nil {
+				resp.Trailer = make(http.Header)
+			}
+			resp.Trailer[name[len(http.TrailerPrefix):]] = values
+			delete(resp.Header, name)
+		}
+	}
 	return resp, nil
 }
 
+//opens a CONNECT tunnel to authority (host:port) through the server
+func (c *Client) Connect(authority string) (net.Conn, error) {
+	if c.ss == nil {
+		return nil, errors.New("No connection estabilished to server")
+	}
+	return c.ss.Connect(context.Background(), authority)
+}
+
+//opens a stream with the given headers for the OnStream of the server
+func (c *Client) OpenStream(header http.Header) (net.Conn, error) {
+	if c.ss == nil {
+		return nil, errors.New("No connection estabilished to server")
+	}
+	return c.ss.OpenStream(context.Background(), header)
+}
+
 func (c *Client) Close() error {
 	if c.cn == nil {
 		err := errors.New("No connection to close")
@@ -116,3 +160,11 @@ func (c *Client) Ping(d time.Duration) (pinged bool, err error) {
 	ping := c.ss.Ping(d)
 	return ping, nil
 }
+
+//opens a WebSocket to the "ws" or "wss" URL over a stream of the client
+func (c *Client) DialWebSocket(rawurl string, header http.Header) (*WebSocket, error) {
+	if c.ss == nil {
+		return nil, errors.New("No connection estabilished to server")
+	}
+	return c.ss.DialWebSocket(context.Background(), rawurl, header)
+}
@@ -0,0 +1,176 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Command spdybench loads a SPDY server with requests, over a number of
+// sessions with a number of concurrent streams each, and reports the
+// throughput, the latency percentiles and the time the streams were
+// stalled by flow control, to evaluate the tuning of servers:
+//
+//	spdybench [flags] URL
+//
+// The flags are:
+//
+//	-c sessions
+//		the sessions to open, 1 by default
+//	-m streams
+//		the concurrent streams of each session, 10 by default
+//	-t duration
+//		how long to run, 10s by default
+//	-n requests
+//		the requests to make in total, instead of running for -t
+//	-k
+//		do not verify the certificate of the server
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amahi/spdy"
+)
+
+// the measures of a run, merged from all the workers
+type results struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	bytes     int64
+	stalls    int           // requests stalled by flow control
+	stalled   time.Duration // time they were stalled, in total
+	lastError error
+}
+
+func main() {
+	sessions := flag.Int("c", 1, "sessions to open")
+	streams := flag.Int("m", 10, "concurrent streams of each session")
+	duration := flag.Duration("t", 10*time.Second, "how long to run")
+	requests := flag.Int64("n", 0, "requests to make in total, instead of running for -t")
+	insecure := flag.Bool("k", false, "do not verify the certificate of the server")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: spdybench [flags] URL")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *sessions < 1 || *streams < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	url := flag.Arg(0)
+
+	// a Transport per session, as each pools a single one for the host
+	transports := make([]*spdy.Transport, *sessions)
+	for i := range transports {
+		transports[i] = &spdy.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure}}
+		// open the session before timing
+		err := request(transports[i], url, new(results))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "spdybench:", err)
+			os.Exit(1)
+		}
+	}
+
+	res := new(results)
+	left := *requests
+	deadline := time.Now().Add(*duration)
+	more := func() bool {
+		if *requests > 0 {
+			return atomic.AddInt64(&left, -1) >= 0
+		}
+		return time.Now().Before(deadline)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, t := range transports {
+		for i := 0; i < *streams; i++ {
+			wg.Add(1)
+			go func(t *spdy.Transport) {
+				defer wg.Done()
+				for more() {
+					request(t, url, res)
+				}
+			}(t)
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+	res.report(os.Stdout, elapsed)
+}
+
+// request makes a request, adding its measures to the results
+func request(t *spdy.Transport, url string, res *results) error {
+	var stalled time.Duration
+	trace := &spdy.ClientTrace{
+		WindowStalled: func(d time.Duration) { stalled += d },
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(spdy.WithClientTrace(req.Context(), trace))
+	start := time.Now()
+	r, err := t.RoundTrip(req)
+	var n int64
+	if err == nil {
+		n, err = io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		if err == nil && r.StatusCode >= 400 {
+			err = fmt.Errorf("status %s", r.Status)
+		}
+	}
+	latency := time.Since(start)
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if err != nil {
+		res.errors++
+		res.lastError = err
+		return err
+	}
+	res.latencies = append(res.latencies, latency)
+	res.bytes += n
+	if stalled > 0 {
+		res.stalls++
+		res.stalled += stalled
+	}
+	return nil
+}
+
+// report writes the summary of the results of a run
+func (res *results) report(w io.Writer, elapsed time.Duration) {
+	done := len(res.latencies)
+	fmt.Fprintf(w, "requests: %d done, %d failed in %s\n", done, res.errors, elapsed.Round(time.Millisecond))
+	if res.lastError != nil {
+		fmt.Fprintf(w, "last error: %s\n", res.lastError)
+	}
+	if done == 0 {
+		return
+	}
+	seconds := elapsed.Seconds()
+	fmt.Fprintf(w, "throughput: %.1f requests/s, %.2f MB/s\n", float64(done)/seconds, float64(res.bytes)/seconds/1e6)
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	fmt.Fprintf(w, "latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		res.percentile(50), res.percentile(90), res.percentile(99), res.latencies[done-1].Round(time.Microsecond))
+	fmt.Fprintf(w, "flow control: %d requests stalled, %s in total\n", res.stalls, res.stalled.Round(time.Microsecond))
+}
+
+// percentile returns a percentile of the sorted latencies
+func (res *results) percentile(p int) time.Duration {
+	i := (len(res.latencies)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return res.latencies[i].Round(time.Microsecond)
+}
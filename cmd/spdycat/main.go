@@ -0,0 +1,222 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Command spdycat makes a request to a SPDY server and prints the body of
+// the response to the standard output, and the protocol negotiated, the
+// response headers, the resources pushed with it and the timing of the
+// request to the standard error:
+//
+//	spdycat [flags] URL
+//
+// The flags are:
+//
+//	-X method
+//		the method of the request, GET by default, or POST with -d
+//	-d data
+//		the body of the request, or @file to read it from a file
+//	-H "Name: value"
+//		a header of the request, which may be repeated
+//	-k
+//		do not verify the certificate of the server
+//	-v
+//		print every frame of the session to the standard error
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amahi/spdy"
+)
+
+// a list of headers, from the repeated -H flags
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+// a writer that can be read while the session writes to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func main() {
+	method := flag.String("X", "", "method of the request")
+	data := flag.String("d", "", "body of the request, or @file")
+	insecure := flag.Bool("k", false, "do not verify the certificate of the server")
+	verbose := flag.Bool("v", false, "print the frames of the session")
+	var headers headerFlags
+	flag.Var(&headers, "H", "header of the request, as \"Name: value\"")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: spdycat [flags] URL")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := run(flag.Arg(0), *method, *data, headers, *insecure, *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "spdycat:", err)
+		os.Exit(1)
+	}
+}
+
+func run(url, method, data string, headers []string, insecure, verbose bool) (err error) {
+	var body io.Reader
+	if data != "" {
+		if method == "" {
+			method = "POST"
+		}
+		if strings.HasPrefix(data, "@") {
+			f, err := os.Open(data[1:])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			body = f
+		} else {
+			body = strings.NewReader(data)
+		}
+	}
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return
+	}
+	for _, h := range headers {
+		i := strings.Index(h, ":")
+		if i < 0 {
+			return fmt.Errorf("bad header %q", h)
+		}
+		req.Header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+
+	// the frames received are kept to find the pushed resources
+	frames := new(lockedBuffer)
+	transport := &spdy.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		FrameCapture: func(ss *spdy.Session) *spdy.FrameCapture {
+			capture := &spdy.FrameCapture{Binary: frames}
+			if verbose {
+				capture.Text = os.Stderr
+			}
+			return capture
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	var session *spdy.Session
+	var connected, wrote, firstByte time.Time
+	trace := &spdy.ClientTrace{
+		GotConn: func(info spdy.GotConnInfo) {
+			session = info.Session
+			connected = time.Now()
+		},
+		WroteHeaders:         func() { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req = req.WithContext(spdy.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if session != nil {
+		fmt.Fprintln(os.Stderr, "version:", session.Stats().Version)
+	}
+	fmt.Fprintln(os.Stderr, "status:", res.Status)
+	printHeader(res.Header)
+	n, err := io.Copy(os.Stdout, res.Body)
+	if err != nil {
+		return
+	}
+	done := time.Now()
+	printTrailer(res.Trailer)
+
+	pushed, err := pushedPaths(frames.bytes())
+	if err != nil {
+		return
+	}
+	for _, p := range pushed {
+		fmt.Fprintln(os.Stderr, "pushed:", p)
+	}
+	fmt.Fprintf(os.Stderr, "timing: connected %s, headers written %s, first byte %s, done %s, %d bytes\n",
+		since(start, connected), since(start, wrote), since(start, firstByte), since(start, done), n)
+	return
+}
+
+func printHeader(h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, v)
+		}
+	}
+}
+
+func printTrailer(h http.Header) {
+	if len(h) > 0 {
+		fmt.Fprintln(os.Stderr, "trailer:")
+		printHeader(h)
+	}
+}
+
+// pushedPaths returns the URLs of the streams the server pushed, from a
+// binary capture of the session
+func pushedPaths(capture []byte) (paths []string, err error) {
+	r := spdy.NewCaptureReader(bytes.NewReader(capture))
+	for {
+		cf, err := r.Next()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if syn, ok := cf.Frame.(*spdy.SynStreamFrame); ok && !cf.Sent && syn.AssociatedStreamID != 0 {
+			paths = append(paths, syn.Header.Get(spdy.HEADER_SCHEME)+"://"+syn.Header.Get(spdy.HEADER_HOST)+syn.Header.Get(spdy.HEADER_PATH))
+		}
+	}
+}
+
+// since returns the time from the start to an event, or "-" if it did
+// not happen
+func since(start, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Sub(start).Round(time.Microsecond).String()
+}
@@ -0,0 +1,270 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Command spdyd serves a directory tree over TLS, with SPDY negotiated
+// with ALPN next to HTTP/2 and HTTP/1.1. The stylesheets, scripts, images
+// and fonts of the HTML pages are pushed along with them to SPDY clients,
+// and every request is logged to the standard output:
+//
+//	spdyd [flags] [dir]
+//
+// The current directory is served if none is given. The flags are:
+//
+//	-addr host:port
+//		the address to listen on, :4040 by default
+//	-cert file
+//		the certificate of the server, with the chain of its CA if any
+//	-key file
+//		the private key of the certificate
+//	-push
+//		push the assets of the HTML pages, true by default
+//	-log
+//		log the requests in the Common Log Format, true by default
+//
+// The server shuts down gracefully on SIGINT or SIGTERM, waiting up to 10
+// seconds for the requests in progress.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amahi/spdy"
+)
+
+// how long the requests in progress have to finish on shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// the files of the pages larger than this are not looked into for assets
+const MAX_PAGE_BYTES = 1 << 20
+
+// the references of pages to other files, as the src or href attributes
+// of their link, script and img elements
+var assetRef = regexp.MustCompile(`(?is)<(?:link|script|img)\b[^>]*?\b(?:href|src)\s*=\s*["']([^"'#?]+)`)
+
+// the kinds of the assets pushed, by extension, for the "as" of their
+// Link headers
+var assetKinds = map[string]string{
+	".css":   "style",
+	".js":    "script",
+	".mjs":   "script",
+	".png":   "image",
+	".jpg":   "image",
+	".jpeg":  "image",
+	".gif":   "image",
+	".svg":   "image",
+	".webp":  "image",
+	".ico":   "image",
+	".woff":  "font",
+	".woff2": "font",
+}
+
+func main() {
+	addr := flag.String("addr", ":4040", "address to listen on")
+	cert := flag.String("cert", "", "certificate of the server")
+	key := flag.String("key", "", "private key of the certificate")
+	push := flag.Bool("push", true, "push the assets of the HTML pages")
+	accessLog := flag.Bool("log", true, "log the requests")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: spdyd -cert file -key file [flags] [dir]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 || *cert == "" || *key == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	root := "."
+	if flag.NArg() == 1 {
+		root = flag.Arg(0)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "spdyd: not a directory:", root)
+		os.Exit(1)
+	}
+
+	var handler http.Handler = http.FileServer(http.Dir(root))
+	if *push {
+		handler = &pusher{root: root, next: handler, pages: make(map[string]*page)}
+	}
+	if *accessLog {
+		handler = logged(handler)
+	}
+	server := &spdy.Server{Addr: *addr, Handler: handler, PushPreloads: *push}
+
+	done := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+	err := server.ListenAndServeTLS(*cert, *key)
+	if err == http.ErrServerClosed {
+		err = <-done
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "spdyd:", err)
+		os.Exit(1)
+	}
+}
+
+// a handler setting the Link headers with rel=preload of the assets of
+// the HTML pages, for the server to push them
+type pusher struct {
+	root  string
+	next  http.Handler
+	mu    sync.Mutex
+	pages map[string]*page // by file name
+}
+
+// the assets of a page, as of the last time its file changed
+type page struct {
+	modTime time.Time
+	size    int64
+	assets  []string // as Link header values
+}
+
+func (p *pusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		for _, link := range p.assets(r.URL.Path) {
+			w.Header().Add("Link", link)
+		}
+	}
+	p.next.ServeHTTP(w, r)
+}
+
+// assets returns the Link header values of the assets of the page at the
+// path of a request, if it is one
+func (p *pusher) assets(urlPath string) []string {
+	urlPath = path.Clean("/" + urlPath)
+	dir := path.Dir(urlPath)
+	name := filepath.Join(p.root, filepath.FromSlash(urlPath))
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		// as http.FileServer serves the index of directories
+		dir = urlPath
+		name = filepath.Join(name, "index.html")
+		fi, err = os.Stat(name)
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if err != nil || (ext != ".html" && ext != ".htm") || fi.Size() > MAX_PAGE_BYTES {
+		return nil
+	}
+
+	p.mu.Lock()
+	pg, ok := p.pages[name]
+	p.mu.Unlock()
+	if ok && pg.modTime.Equal(fi.ModTime()) && pg.size == fi.Size() {
+		return pg.assets
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	pg = &page{modTime: fi.ModTime(), size: fi.Size(), assets: p.parse(dir, data)}
+	p.mu.Lock()
+	p.pages[name] = pg
+	p.mu.Unlock()
+	return pg.assets
+}
+
+// parse returns the Link header values of the assets referenced by a page
+// in the directory dir, for the ones that are files of the tree
+func (p *pusher) parse(dir string, data []byte) (links []string) {
+	seen := make(map[string]bool)
+	for _, m := range assetRef.FindAllSubmatch(data, -1) {
+		ref := strings.TrimSpace(string(m[1]))
+		if ref == "" || strings.HasPrefix(ref, "//") || strings.Contains(ref, ":") {
+			// of another origin, or a data: URL
+			continue
+		}
+		if !strings.HasPrefix(ref, "/") {
+			ref = path.Join(dir, ref)
+		}
+		ref = path.Clean(ref)
+		kind, ok := assetKinds[strings.ToLower(path.Ext(ref))]
+		if !ok || seen[ref] {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(p.root, filepath.FromSlash(ref)))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		seen[ref] = true
+		links = append(links, "<"+ref+">; rel=preload; as="+kind)
+	}
+	return
+}
+
+// a ResponseWriter keeping the status and size of the response, for the
+// access log
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggedResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggedResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logged returns a handler logging the requests of the next one to the
+// standard output, in the Common Log Format followed by the protocol and
+// the time taken
+func logged(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggedResponse{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		proto := r.Proto
+		if r.TLS != nil && r.TLS.NegotiatedProtocol != "" {
+			proto = r.TLS.NegotiatedProtocol
+		}
+		host := r.RemoteAddr
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Printf("%s - - [%s] %q %d %d %s %s\n", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, lw.status, lw.bytes, proto, time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Command spdydump prints the frames of SPDY sessions captured offline,
+// with their header blocks inflated, one frame per entry:
+//
+//	spdydump [flags] file...
+//
+// Each file is either a binary capture of a session, as written by a
+// FrameCapture or a Recorder, or the raw bytes of one direction of a TCP
+// connection, e.g. as exported decrypted from a packet capture. The two
+// directions of a connection go in files of their own, as each has its
+// own header compression context. The format is told from the first
+// bytes of the file, unless set. The flags are:
+//
+//	-format auto|capture|raw
+//		the format of the files, auto by default
+//	-data n
+//		print up to n bytes of the DATA frames, quoted, 0 by default
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amahi/spdy"
+)
+
+func main() {
+	format := flag.String("format", "auto", "format of the files: auto, capture or raw")
+	data := flag.Int("data", 0, "bytes of the DATA frames to print")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: spdydump [flags] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (*format != "auto" && *format != "capture" && *format != "raw") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	failed := false
+	for _, name := range flag.Args() {
+		if flag.NArg() > 1 {
+			fmt.Printf("== %s\n", name)
+		}
+		err := dump(name, *format, *data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "spdydump: %s: %s\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// dump prints the frames of a file
+func dump(name, format string, data int) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if format == "auto" {
+		format = "capture"
+		// raw streams start with a control frame of SPDY/3, captures
+		// with a time
+		if head, _ := r.Peek(2); len(head) == 2 && head[0] == 0x80 && head[1] == 3 {
+			format = "raw"
+		}
+	}
+	if format == "raw" {
+		return dumpRaw(r, data)
+	}
+	return dumpCapture(r, data)
+}
+
+// dumpCapture prints the frames of a binary capture, with their time and
+// direction
+func dumpCapture(r io.Reader, data int) error {
+	cr := spdy.NewCaptureReader(r)
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && cf == nil {
+			return err
+		}
+		direction := "received"
+		if cf.Sent {
+			direction = "sent"
+		}
+		text := ""
+		if err != nil {
+			// the next frames may still decode
+			text = fmt.Sprintf("undecodable frame: %s", err)
+		} else {
+			text = frameText(cf.Frame, data)
+		}
+		fmt.Printf("%s %s %s\n", cf.Time.Format(time.RFC3339Nano), direction, text)
+	}
+}
+
+// dumpRaw prints the frames of one direction of a connection, numbered
+func dumpRaw(r io.Reader, data int) error {
+	framer := spdy.NewFramer(struct {
+		io.Reader
+		io.Writer
+	}{r, ioutil.Discard})
+	for n := 1; ; n++ {
+		f, err := framer.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// there is no telling where the next frame starts
+			return fmt.Errorf("frame %d: %s", n, err)
+		}
+		fmt.Printf("%d %s\n", n, frameText(f, data))
+	}
+}
+
+// frameText returns a frame as text, with up to data bytes of its payload
+// if it is a DATA frame
+func frameText(f spdy.Frame, data int) string {
+	text := strings.TrimSpace(f.String())
+	if d, ok := f.(*spdy.DataFrame); ok && data > 0 && len(d.Data) > 0 {
+		payload := d.Data
+		if len(payload) > data {
+			payload = payload[:data]
+		}
+		text += fmt.Sprintf("\n\tPayload: %q", payload)
+		if len(payload) < len(d.Data) {
+			text += "..."
+		}
+	}
+	return text
+}
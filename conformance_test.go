@@ -0,0 +1,372 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// conformance of sessions to the SPDY/3.1 spec, as scripted exchanges
+
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a scripted exchange with a server session: the frames sent to it in
+// order, as Frames written with a Framer or as raw bytes, and the
+// RST_STREAM or GOAWAY expected back. If none is expected, the session is
+// to carry on as if nothing happened
+type conformanceCase struct {
+	name    string
+	handler http.HandlerFunc // ServerTestHandler if nil
+	setup   func(*Session)   // to configure the session, if set
+	script  []interface{}
+	expect  Frame
+}
+
+// a control frame as on the wire, with any length of data
+func rawControl(kind uint16, flags byte, data []byte) []byte {
+	frame := []byte{0x80, 3, byte(kind >> 8), byte(kind), flags, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}
+	return append(frame, data...)
+}
+
+// a DATA frame of a stream with the given bytes of zeros
+func zeroData(id uint32, size int, flags FrameFlags) *DataFrame {
+	return &DataFrame{StreamID: id, Flags: flags, Data: make([]byte, size)}
+}
+
+// a SYN_STREAM with the name/value pairs given as they are, not in
+// lowercase as a Framer writes them, as the first header block of a session
+func rawSynStream(id uint32, flags byte, pairs ...string) []byte {
+	block := new(bytes.Buffer)
+	zw, _ := zlib.NewWriterLevelDict(block, zlib.BestCompression, headerDictionary)
+	binary.Write(zw, binary.BigEndian, uint32(len(pairs)/2))
+	for _, s := range pairs {
+		binary.Write(zw, binary.BigEndian, uint32(len(s)))
+		zw.Write([]byte(s))
+	}
+	zw.Flush()
+	data := []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id), 0, 0, 0, 0, 0, 0}
+	return rawControl(FRAME_SYN_STREAM, flags, append(data, block.Bytes()...))
+}
+
+// a request header without one of its fields, or with one more
+func editedRequestHeader(del string, add ...string) http.Header {
+	header := testRequestHeader("/banana")
+	header.Del(del)
+	if len(add) == 2 {
+		header.Set(add[0], add[1])
+	}
+	return header
+}
+
+// a handler that never reads the body of the request, nor replies
+func stalledHandler(w http.ResponseWriter, r *http.Request) {
+	<-r.Context().Done()
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		name:   "request",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")}},
+	},
+	{
+		name:   "unknown control frame",
+		script: []interface{}{rawControl(0xff, 0, []byte{1, 2, 3})},
+	},
+	{
+		name:   "unknown flags",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN | 0x80, Header: testRequestHeader("/banana")}},
+	},
+	{
+		name: "uppercase header name",
+		script: []interface{}{rawSynStream(1, byte(FLAG_FIN), ":method", "GET", ":path", "/banana", ":version", "HTTP/1.1",
+			":host", "localhost", ":scheme", "http", "Accept", "*/*")},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name: "zero-length header name",
+		script: []interface{}{rawSynStream(1, byte(FLAG_FIN), ":method", "GET", ":path", "/banana", ":version", "HTTP/1.1",
+			":host", "localhost", ":scheme", "http", "", "*/*")},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name: "NUL in a header name",
+		script: []interface{}{rawSynStream(1, byte(FLAG_FIN), ":method", "GET", ":path", "/banana", ":version", "HTTP/1.1",
+			":host", "localhost", ":scheme", "http", "accept\x00x", "*/*")},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name: "duplicate header name",
+		script: []interface{}{rawSynStream(1, byte(FLAG_FIN), ":method", "GET", ":path", "/banana", ":version", "HTTP/1.1",
+			":host", "localhost", ":scheme", "http", "accept", "*/*", "accept", "text/html")},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:   "header block not inflated",
+		script: []interface{}{rawControl(FRAME_SYN_STREAM, byte(FLAG_FIN), []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 'b', 'a', 'n', 'a', 'n', 'a'})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "no :path",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: editedRequestHeader(HEADER_PATH)}},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:   "no :scheme",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: editedRequestHeader(HEADER_SCHEME)}},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:   "connection header",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: editedRequestHeader("", "Connection", "keep-alive")}},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:   "host header",
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: editedRequestHeader("", "Host", "localhost")}},
+	},
+	{
+		name:   "frame too large",
+		setup:  func(ss *Session) { ss.maxFrameBytes = 100 },
+		script: []interface{}{zeroData(1, 101, 0)},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated SYN_STREAM",
+		script: []interface{}{rawControl(FRAME_SYN_STREAM, 0, []byte{0, 0, 0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated RST_STREAM",
+		script: []interface{}{rawControl(FRAME_RST_STREAM, 0, []byte{0, 0, 0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated PING",
+		script: []interface{}{rawControl(FRAME_PING, 0, []byte{0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated WINDOW_UPDATE",
+		script: []interface{}{rawControl(FRAME_WINDOW_UPDATE, 0, []byte{0, 0, 0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated GOAWAY",
+		script: []interface{}{rawControl(FRAME_GOAWAY, 0, []byte{0, 0, 0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "truncated SETTINGS",
+		script: []interface{}{rawControl(FRAME_SETTINGS, 0, []byte{0, 1})},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "stream ID 0",
+		script: []interface{}{&SynStreamFrame{StreamID: 0, Flags: FLAG_FIN, Header: testRequestHeader("/banana")}},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:   "even stream ID from the client",
+		script: []interface{}{&SynStreamFrame{StreamID: 2, Flags: FLAG_FIN, Header: testRequestHeader("/banana")}},
+		expect: &GoAwayFrame{Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name: "decreasing stream ID",
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 3, Flags: FLAG_FIN, Header: testRequestHeader("/banana")},
+			&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")},
+		},
+		expect: &GoAwayFrame{LastGoodStreamID: 3, Status: GOAWAY_PROTOCOL_ERROR},
+	},
+	{
+		name:    "stream opened twice",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:   "DATA for an unknown stream",
+		script: []interface{}{zeroData(5, 10, 0)},
+		expect: &RstStreamFrame{StreamID: 5, Status: RST_INVALID_STREAM},
+	},
+	{
+		name:    "DATA after FIN",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")},
+			zeroData(1, 10, 0),
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_STREAM_ALREADY_CLOSED},
+	},
+	{
+		name:    "HEADERS after FIN",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")},
+			&HeadersFrame{StreamID: 1, Header: http.Header{"X-Trailer": {"1"}}},
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_STREAM_ALREADY_CLOSED},
+	},
+	{
+		name:    "SYN_REPLY from the client",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+			&SynReplyFrame{StreamID: 1, Header: http.Header{":status": {"200 OK"}, ":version": {"HTTP/1.1"}}},
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:    "window overflow",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+			zeroData(1, int(INITIAL_FLOW_CONTOL_WINDOW/2), 0),
+			zeroData(1, int(INITIAL_FLOW_CONTOL_WINDOW/2), 0),
+			zeroData(1, 1, 0),
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_FLOW_CONTROL_ERROR},
+	},
+	{
+		name:    "WINDOW_UPDATE of 0",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+			&WindowUpdateFrame{StreamID: 1, DeltaWindowSize: 0},
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_PROTOCOL_ERROR},
+	},
+	{
+		name:    "send window over 2^31-1",
+		handler: stalledHandler,
+		script: []interface{}{
+			&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/banana")},
+			&WindowUpdateFrame{StreamID: 1, DeltaWindowSize: 0x7fffffff},
+		},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_FLOW_CONTROL_ERROR},
+	},
+	{
+		name: "handler aborted",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("half a reply"))
+			panic(http.ErrAbortHandler)
+		},
+		script: []interface{}{&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")}},
+		expect: &RstStreamFrame{StreamID: 1, Status: RST_INTERNAL_ERROR},
+	},
+}
+
+// describe returns the frames that tell of errors as text, for the
+// checks and messages of the harness
+func describe(f Frame) string {
+	switch f := f.(type) {
+	case *RstStreamFrame:
+		return fmt.Sprintf("RST_STREAM #%d status %d", f.StreamID, f.Status)
+	case *GoAwayFrame:
+		return fmt.Sprintf("GOAWAY status %d", f.Status)
+	}
+	return ""
+}
+
+// runConformance runs the script of a case against a new server session,
+// returning an error if the session does not answer as expected
+func runConformance(c conformanceCase) error {
+	handler := c.handler
+	if handler == nil {
+		handler = ServerTestHandler
+	}
+	cn, sn := net.Pipe()
+	defer cn.Close()
+	ss := NewServerSession(sn, &http.Server{Handler: handler})
+	if c.setup != nil {
+		c.setup(ss)
+	}
+	go ss.Serve()
+
+	framer := NewFramer(cn)
+	received := make(chan Frame, 100)
+	go func() {
+		defer close(received)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			received <- f
+		}
+	}()
+	written := make(chan error, 1)
+	go func() {
+		for _, step := range c.script {
+			var err error
+			switch step := step.(type) {
+			case Frame:
+				err = framer.WriteFrame(step)
+			case []byte:
+				_, err = cn.Write(step)
+			}
+			if err != nil {
+				written <- err
+				return
+			}
+		}
+		// a PING is answered after the frames before it are processed
+		written <- framer.WriteFrame(&PingFrame{ID: 1})
+	}()
+
+	want := ""
+	if c.expect != nil {
+		want = describe(c.expect)
+		if g, ok := c.expect.(*GoAwayFrame); ok {
+			// the last good stream is not checked
+			want = describe(&GoAwayFrame{Status: g.Status})
+		}
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case f, ok := <-received:
+			if !ok {
+				return fmt.Errorf("session closed, expected %q", want)
+			}
+			if g, ok := f.(*GoAwayFrame); ok {
+				f = &GoAwayFrame{Status: g.Status}
+			}
+			got := describe(f)
+			if got != "" {
+				if got != want {
+					return fmt.Errorf("got %q, expected %q", got, want)
+				}
+				return nil
+			}
+			if p, ok := f.(*PingFrame); ok && p.ID == 1 && want == "" {
+				return nil
+			}
+		case err := <-written:
+			if err != nil && want == "" {
+				return fmt.Errorf("cannot write script: %s", err)
+			}
+			written = nil
+		case <-deadline:
+			return fmt.Errorf("timed out, expected %q", want)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceCases {
+		if err := runConformance(c); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+	}
+}
@@ -7,24 +7,210 @@
 package spdy
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	logging "log"
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// regular app logging - enabled by default
-var log = logging.New(os.Stderr, "[SPDY] ", logging.LstdFlags|logging.Lshortfile)
+// regular app logging - enabled by default. The source of the messages
+// is added by logHandler
+var log = logging.New(os.Stderr, "[SPDY] ", logging.LstdFlags)
 
 // app logging for the purposes of debugging - disabled by default
 var debug = logging.New(ioutil.Discard, "[SPDY DEBUG] ", logging.LstdFlags)
 
 // EnableDebug turns on the output of debugging messages to Stdout
 func EnableDebug() {
-	debug = logging.New(os.Stdout, "[SPDY DEBUG] ", logging.LstdFlags)
+	debug.SetOutput(os.Stdout)
 }
 
-// SetLog sets the output of logging to a given io.Writer
+// SetLog sets the output of logging to a given io.Writer. The loggers are
+// kept, as the sessions may be logging meanwhile
 func SetLog(w io.Writer) {
-	log = logging.New(w, "[SPDY] ", logging.LstdFlags|logging.Lshortfile)
+	log.SetOutput(w)
+}
+
+// logHandler is a slog.Handler writing the messages of the library to a
+// log.Logger, for the Servers, Transports and Sessions without a Logger.
+// The messages are like "file.go:12: WARN: message key=value", at the
+// info level and above
+type logHandler struct {
+	logger *logging.Logger // the log of the package if nil
+	attrs  string
+}
+
+// defaultLogger returns a logger writing to the given log.Logger, or to
+// the log of the package if nil
+func defaultLogger(l *logging.Logger) *slog.Logger {
+	return slog.New(&logHandler{logger: l})
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		fmt.Fprintf(&b, "%s:%d: ", filepath.Base(frame.File), frame.Line)
+	}
+	b.WriteString(r.Level.String())
+	b.WriteString(": ")
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s", a)
+		return true
+	})
+	l := h.logger
+	if l == nil {
+		l = log
+	}
+	return l.Output(2, b.String())
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	for _, a := range attrs {
+		nh.attrs += " " + a.String()
+	}
+	return &nh
+}
+
+// groups are not used by the library
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// the sessions being served
+var liveSessions sessionRegistry
+
+func (r *sessionRegistry) add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[*Session]time.Time)
+	}
+	r.sessions[s] = time.Now()
+}
+
+func (r *sessionRegistry) remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+// the sessions by the time they started
+func (r *sessionRegistry) list() (list []debugSession) {
+	r.mu.Lock()
+	for s, started := range r.sessions {
+		list = append(list, debugSession{Session: s, Started: started})
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return
+}
+
+// a session as shown by DebugHandler
+type debugSession struct {
+	*Session
+	Started time.Time
+}
+
+func (d debugSession) Role() string {
+	if d.server != nil {
+		return "server"
+	}
+	return "client"
+}
+
+func (d debugSession) Remote() string { return d.conn.RemoteAddr().String() }
+
+func (d debugSession) State() SessionState {
+	return SessionState(atomic.LoadInt32(&d.state))
+}
+
+func (d debugSession) Age() time.Duration { return time.Since(d.Started).Round(time.Millisecond) }
+
+func (d debugSession) Streams() (list []debugStream) {
+	for _, str := range d.liveStreams() {
+		list = append(list, debugStream{str})
+	}
+	return
+}
+
+// a stream as shown by DebugHandler
+type debugStream struct {
+	*Stream
+}
+
+func (d debugStream) ID() streamID { return d.id }
+
+func (d debugStream) Age() time.Duration { return time.Since(d.started).Round(time.Millisecond) }
+
+func (d debugStream) State() string {
+	switch {
+	case d.finished.Load():
+		return "finished"
+	case d.closed.Load():
+		return "closed"
+	}
+	return "open"
+}
+
+func (d debugStream) SendWindow() int32 { return atomic.LoadInt32(&d.sendWindow) }
+
+func (d debugStream) Buffered() int64 { return d.session.budget.buffered(d.Stream) }
+
+var debugTemplate = template.Must(template.New("spdy").Parse(`<!DOCTYPE html>
+<html>
+<head><title>SPDY sessions</title></head>
+<body>
+<h1>SPDY sessions</h1>
+{{range .}}{{$stats := .Stats}}
+<h2>{{.Role}} session with {{.Remote}}, {{.State}} for {{.Age}}</h2>
+<p>{{$stats.Version}}: {{$stats.ActiveStreams}} streams active of {{$stats.TotalStreams}},
+{{$stats.BytesSent}} bytes sent, {{$stats.BytesReceived}} bytes received,
+initial windows of {{$stats.SendWindow}} bytes to send and {{$stats.ReceiveWindow}} bytes to receive,
+last ping {{$stats.LastPingRTT}},
+headers compressed to {{printf "%.2f" $stats.HeaderCompressionRatio}} of {{$stats.HeaderBytes}} bytes</p>
+<table>
+<tr><th>stream</th><th>state</th><th>age</th><th>send window</th><th>bytes buffered</th></tr>
+{{range .Streams}}<tr><td>{{.ID}}</td><td>{{.State}}</td><td>{{.Age}}</td><td>{{.SendWindow}}</td><td>{{.Buffered}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No sessions.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// DebugHandler returns a handler rendering the sessions being served,
+// with their streams, states, windows and counters, to be mounted at
+// e.g. /debug/spdy of a debugging server
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := new(bytes.Buffer)
+		err := debugTemplate.Execute(page, liveSessions.list())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page.Bytes())
+	})
 }
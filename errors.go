@@ -0,0 +1,176 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// This file contains the errors of streams and sessions, carrying the
+// status codes of SPDY
+
+package spdy
+
+import (
+	"fmt"
+)
+
+// StreamError is the error of a request or a write on a stream that was
+// reset, by either end, or that cannot carry more data. It matches
+// ErrStreamUnprocessed with errors.Is when the stream is safe to retry
+type StreamError struct {
+	StreamID uint32
+	// the RST_* status code of the reset, or 0 if the stream was not reset
+	Status uint32
+	// the stream was reset by the other end, rather than by this one
+	Remote bool
+	// the other end did not process the stream, so its request can be
+	// made again
+	Retry  bool
+	Reason string
+}
+
+func (e *StreamError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("spdy: stream #%d: %s", e.StreamID, e.Reason)
+	}
+	msg := fmt.Sprintf("spdy: stream #%d reset with %s", e.StreamID, rstStatusName(e.Status))
+	if e.Remote {
+		msg += " by the other end"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Is tells if the error is the ErrStreamUnprocessed of a stream safe to
+// retry
+func (e *StreamError) Is(target error) bool {
+	return target == ErrStreamUnprocessed && e.Retry
+}
+
+// SessionError is the error of the streams of a session that ended, and of
+// the calls on it, with the GOAWAY status code of the end that went away,
+// if any. It matches ErrSessionClosed with errors.Is
+type SessionError struct {
+	// a GOAWAY was sent or received, with one of the GOAWAY_* status codes
+	GoAway bool
+	Status uint32
+	// the GOAWAY was sent by the other end, rather than by this one
+	Remote bool
+	// the last stream started by the other end that was processed
+	LastGoodStreamID uint32
+	// the stream of the error was above the LastGoodStreamID of the
+	// GOAWAY of the other end, so its request can be made again on
+	// another session
+	Retry  bool
+	Reason string
+}
+
+func (e *SessionError) Error() string {
+	if !e.GoAway {
+		return "spdy: session: " + e.Reason
+	}
+	if e.Remote {
+		return fmt.Sprintf("spdy: session gone away by the other end with %s: %s", goawayStatusName(e.Status), e.Reason)
+	}
+	return fmt.Sprintf("spdy: session gone away with %s: %s", goawayStatusName(e.Status), e.Reason)
+}
+
+// Is tells if the error is ErrSessionClosed, or ErrStreamUnprocessed for
+// a stream safe to retry
+func (e *SessionError) Is(target error) bool {
+	return target == ErrSessionClosed || (target == ErrStreamUnprocessed && e.Retry)
+}
+
+// sessionError returns the error of the session for the given reason,
+// with the GOAWAY sent or received first, if any
+func (s *Session) sessionError(reason string) *SessionError {
+	e := &SessionError{Reason: reason}
+	if g, ok := s.goaway.Load().(*SessionError); ok {
+		*e = *g
+		e.Reason = reason
+	}
+	return e
+}
+
+// wentAway records the first GOAWAY of the session, sent or received, for
+// its errors
+func (s *Session) wentAway(status uint32, lastGood streamID, remote bool) {
+	s.goaway.CompareAndSwap(nil, &SessionError{GoAway: true, Status: status, Remote: remote, LastGoodStreamID: uint32(lastGood)})
+}
+
+// setCloseErr records why the stream was closed early, replacing the
+// error recorded before, if any
+func (s *Stream) setCloseErr(err error) {
+	s.errMu.Lock()
+	s.closeErr = err
+	s.errMu.Unlock()
+}
+
+// initCloseErr records why the stream was closed early, unless an error
+// was recorded already
+func (s *Stream) initCloseErr(err error) {
+	s.errMu.Lock()
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+	s.errMu.Unlock()
+}
+
+// closeError returns why the stream was closed early, if known
+func (s *Stream) closeError() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.closeErr
+}
+
+// writeError returns the error of a write on a stream that cannot carry
+// more data, which is the error of its reset, if any
+func (s *Stream) writeError(reason string) error {
+	closeErr := s.closeError()
+	if se, ok := closeErr.(*StreamError); ok && se.Status != 0 {
+		return se
+	}
+	if se, ok := closeErr.(*SessionError); ok {
+		return se
+	}
+	return &StreamError{StreamID: uint32(s.id), Reason: reason}
+}
+
+// the name of a RST_STREAM status code, for errors and logs
+func rstStatusName(status uint32) string {
+	switch status {
+	case RST_PROTOCOL_ERROR:
+		return "PROTOCOL_ERROR"
+	case RST_INVALID_STREAM:
+		return "INVALID_STREAM"
+	case RST_REFUSED_STREAM:
+		return "REFUSED_STREAM"
+	case RST_UNSUPPORTED_VERSION:
+		return "UNSUPPORTED_VERSION"
+	case RST_CANCEL:
+		return "CANCEL"
+	case RST_INTERNAL_ERROR:
+		return "INTERNAL_ERROR"
+	case RST_FLOW_CONTROL_ERROR:
+		return "FLOW_CONTROL_ERROR"
+	case RST_STREAM_IN_USE:
+		return "STREAM_IN_USE"
+	case RST_STREAM_ALREADY_CLOSED:
+		return "STREAM_ALREADY_CLOSED"
+	case RST_FRAME_TOO_LARGE:
+		return "FRAME_TOO_LARGE"
+	}
+	return fmt.Sprintf("status %d", status)
+}
+
+// the name of a GOAWAY status code, for errors and logs
+func goawayStatusName(status uint32) string {
+	switch status {
+	case GOAWAY_OK:
+		return "OK"
+	case GOAWAY_PROTOCOL_ERROR:
+		return "PROTOCOL_ERROR"
+	case GOAWAY_INTERNAL_ERROR:
+		return "INTERNAL_ERROR"
+	}
+	return fmt.Sprintf("status %d", status)
+}
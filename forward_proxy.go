@@ -0,0 +1,82 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Forward proxy from SPDY to origin servers
+
+package spdy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// ServeHTTP forwards the request of a stream to its origin server, or
+// tunnels it for a CONNECT
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		p.tunnel(w, r)
+		return
+	}
+	target := r.URL
+	if !target.IsAbs() {
+		scheme := r.Header.Get(HEADER_SCHEME)
+		if scheme == "" {
+			scheme = "http"
+		}
+		target = &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	}
+	if target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		http.Error(w, "spdy: no origin server for the request", http.StatusBadRequest)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			stripSpdyHeaders(pr.Out.Header)
+			pr.Out.URL = target
+			pr.Out.Host = target.Host
+		},
+		Transport:     p.Transport,
+		FlushInterval: -1,
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// tunnel connects to the authority of a CONNECT request and copies the
+// data both ways between the stream and the connection, until both are
+// half-closed
+func (p *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	dial := p.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	target, err := dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, "spdy: cannot connect to "+r.Host, http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	done := make(chan bool)
+	go func() {
+		io.Copy(target, conn)
+		if tc, ok := target.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		} else {
+			target.Close()
+		}
+		done <- true
+	}()
+	io.Copy(conn, target)
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	<-done
+	target.Close()
+	conn.Close()
+}
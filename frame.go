@@ -10,15 +10,17 @@ package spdy
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
 // ========================================
 // Control Frames
 // ========================================
-func (f controlFrame) Flags() frameFlags { return f.flags }
+func (f controlFrame) Flags() FrameFlags { return f.flags }
 func (f controlFrame) Data() []byte      { return f.data }
 
 func (f controlFrame) String() string {
@@ -28,7 +30,7 @@ func (f controlFrame) String() string {
 
 func (f controlFrame) isFIN() bool { return f.flags&FLAG_FIN == FLAG_FIN }
 
-func (f frameFlags) String() string {
+func (f FrameFlags) String() string {
 	if f == FLAG_NONE {
 		return "-"
 	}
@@ -38,7 +40,7 @@ func (f frameFlags) String() string {
 	return fmt.Sprintf("0x%02x", int(f))
 }
 
-func (f controlFrameKind) String() string {
+func (f ControlFrameKind) String() string {
 	switch f {
 	case FRAME_SYN_STREAM:
 		return "SYN_STREAM"
@@ -48,6 +50,8 @@ func (f controlFrameKind) String() string {
 		return "RST_STREAM"
 	case FRAME_SETTINGS:
 		return "SETTINGS"
+	case FRAME_NOOP:
+		return "NOOP"
 	case FRAME_PING:
 		return "PING"
 	case FRAME_GOAWAY:
@@ -66,7 +70,7 @@ func (f controlFrame) Write(w io.Writer) (n int64, err error) {
 	debug.Printf("Writing control frame %s, flags: %s, payload: %d", f.kind, f.flags, len(f.data))
 	nn, err := writeFrame(w, []interface{}{uint16(0x8000) | uint16(0x0003), f.kind, f.flags}, f.data)
 	if nn != total {
-		log.Println("WARNING in controlFrame.Write, wrote", nn, "vs. frame size", total)
+		defaultLogger(nil).Warn("control frame written in part", "written", nn, "size", total)
 	}
 	return int64(nn), err
 }
@@ -77,7 +81,7 @@ func (f *controlFrame) streamID() (id streamID) {
 	data := bytes.NewBuffer(f.data[0:4])
 	err := binary.Read(data, binary.BigEndian, &id)
 	if err != nil {
-		log.Println("ERROR: Cannot read stream ID from a control frame that is supposed to have a stream ID:", err)
+		defaultLogger(nil).Error("cannot read the stream ID of a control frame", "err", err)
 		id = 0
 		return
 	}
@@ -89,7 +93,7 @@ func (f *controlFrame) streamID() (id streamID) {
 // ========================================
 // Data Frames
 // ========================================
-func (f dataFrame) Flags() frameFlags { return f.flags }
+func (f dataFrame) Flags() FrameFlags { return f.flags }
 func (f dataFrame) Data() []byte      { return f.data }
 func (f dataFrame) isFIN() bool       { return f.flags&FLAG_FIN == FLAG_FIN }
 
@@ -98,11 +102,18 @@ func (f dataFrame) Write(w io.Writer) (n int64, err error) {
 	debug.Printf("Writing data frame, flags: %s, size: %d", f.flags, len(f.data))
 	nn, err := writeFrame(w, []interface{}{f.stream & 0x7fffffff, f.flags}, f.data)
 	if nn != total {
-		log.Println("WARNING in dataFrame.Write, wrote", nn, "vs. frame size", total)
+		defaultLogger(nil).Warn("data frame written in part", "written", nn, "size", total)
 	}
 	return int64(nn), err
 }
 
+// writeHead writes the frame without its payload, to be written after it
+func (f dataFrame) writeHead(w io.Writer) (err error) {
+	debug.Printf("Writing data frame, flags: %s, size: %d", f.flags, len(f.data))
+	_, err = writeFrameHead(w, []interface{}{f.stream & 0x7fffffff, f.flags}, len(f.data))
+	return
+}
+
 func (f dataFrame) String() string {
 	l := len(f.data)
 	s := fmt.Sprintf("\n\tFrame: DATA of size %d, for stream #%d", l, f.stream)
@@ -121,6 +132,25 @@ func (f dataFrame) String() string {
 
 func writeFrame(w io.Writer, head []interface{}, data []byte) (n int, err error) {
 	var nn int
+	n, err = writeFrameHead(w, head, len(data))
+	if err != nil {
+		return
+	}
+	// Data
+	if len(data) > 0 {
+		nn, err = w.Write(data)
+		if err != nil {
+			defaultLogger(nil).Error("cannot write the payload of a frame", "err", err)
+			return
+		}
+		n += nn
+	}
+	return
+}
+
+// writeFrameHead writes the first 8 bytes of a frame, which has a payload
+// of the given length
+func writeFrameHead(w io.Writer, head []interface{}, length int) (n int, err error) {
 	// Header (40 bits)
 	err = writeBinary(w, head...)
 	if err != nil {
@@ -129,25 +159,14 @@ func writeFrame(w io.Writer, head []interface{}, data []byte) (n int, err error)
 	n += 5 // frame head, in bytes, without the length field
 
 	// Length (24 bits)
-	length := len(data)
-	nn, err = w.Write([]byte{
+	nn, err := w.Write([]byte{
 		byte(length & 0x00ff0000 >> 16),
 		byte(length & 0x0000ff00 >> 8),
 		byte(length & 0x000000ff),
 	})
 	n += nn
 	if err != nil {
-		log.Println("Write of length failed:", err)
-		return
-	}
-	// Data
-	if length > 0 {
-		nn, err = w.Write(data)
-		if err != nil {
-			log.Println("Write of data failed:", err)
-			return
-		}
-		n += nn
+		defaultLogger(nil).Error("cannot write the length of a frame", "err", err)
 	}
 	return
 }
@@ -166,8 +185,13 @@ func writeBinary(r io.Writer, args ...interface{}) (err error) {
 // Generic frame-reading utilities
 // ========================================
 
-// readFrame reads an entire frame into memory
-func readFrame(r io.Reader) (f frame, err error) {
+// errFrameTooLarge is returned when a frame declares a length larger than
+// the maximum allowed
+var errFrameTooLarge = errors.New("frame too large")
+
+// readFrame reads an entire frame into memory. Frames with a payload
+// larger than max bytes are rejected before buffering them.
+func readFrame(r io.Reader, max int) (f frame, err error) {
 	headBuffer := new(bytes.Buffer)
 	_, err = io.CopyN(headBuffer, r, 5)
 	if err != nil {
@@ -180,7 +204,7 @@ func readFrame(r io.Reader) (f frame, err error) {
 		if err != nil {
 			return
 		}
-		df.data, err = readData(r)
+		df.data, df.pooled, err = readPooledData(r, max)
 		f = df
 	} else {
 		// Control
@@ -191,7 +215,19 @@ func readFrame(r io.Reader) (f frame, err error) {
 		if err != nil {
 			return
 		}
-		cf.data, err = readData(r)
+		var length uint32
+		length, err = readLength(r, max)
+		if err == errFrameTooLarge {
+			switch cf.kind {
+			case FRAME_SYN_STREAM, FRAME_SYN_REPLY, FRAME_HEADERS:
+				// the payload is left to be read, for its header block
+				f = largeHeaderFrame{controlFrame: cf, length: int(length)}
+			}
+		}
+		if err != nil {
+			return
+		}
+		cf.data, err = readPayload(r, length)
 		f = cf
 	}
 	return
@@ -207,17 +243,52 @@ func readBinary(r io.Reader, args ...interface{}) (err error) {
 	return
 }
 
-func readData(r io.Reader) (data []byte, err error) {
+// readLength reads the length field of a frame, up to max
+func readLength(r io.Reader, max int) (length uint32, err error) {
 	lengthField := make([]byte, 3)
 	_, err = io.ReadFull(r, lengthField)
 	if err != nil {
 		return
 	}
-	var length uint32
 	length |= uint32(lengthField[0]) << 16
 	length |= uint32(lengthField[1]) << 8
 	length |= uint32(lengthField[2])
 
+	if int(length) > max {
+		err = errFrameTooLarge
+	}
+	return
+}
+
+// readPooledData reads the payload of a DATA frame into a buffer of the
+// pool, unless it is too large for one
+func readPooledData(r io.Reader, max int) (data []byte, pooled bool, err error) {
+	length, err := readLength(r, max)
+	if err != nil {
+		return
+	}
+	if length == 0 || length > DATA_BUFFER_SIZE {
+		data, err = readPayload(r, length)
+		return
+	}
+	data = getDataBuffer()[:length]
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		putDataBuffer(data)
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func readData(r io.Reader, max int) (data []byte, err error) {
+	length, err := readLength(r, max)
+	if err != nil {
+		return
+	}
+	return readPayload(r, length)
+}
+
+func readPayload(r io.Reader, length uint32) (data []byte, err error) {
 	if length > 0 {
 		data = make([]byte, int(length))
 		_, err = io.ReadFull(r, data)
@@ -231,31 +302,65 @@ func readData(r io.Reader) (data []byte, err error) {
 	return
 }
 
+// ========================================
+// Buffer pool for the payload of DATA frames
+// ========================================
+
+// size of the buffers of the pool, the largest DATA payload they hold
+const DATA_BUFFER_SIZE = 16 * 1024
+
+var dataBuffers = sync.Pool{
+	New: func() interface{} { return new([DATA_BUFFER_SIZE]byte) },
+}
+
+// getDataBuffer returns a buffer of DATA_BUFFER_SIZE bytes from the pool
+func getDataBuffer() []byte {
+	return dataBuffers.Get().(*[DATA_BUFFER_SIZE]byte)[:]
+}
+
+// putDataBuffer gives a buffer back to the pool, once nothing refers to it
+func putDataBuffer(buf []byte) {
+	if cap(buf) != DATA_BUFFER_SIZE {
+		return
+	}
+	dataBuffers.Put((*[DATA_BUFFER_SIZE]byte)(buf[:DATA_BUFFER_SIZE]))
+}
+
 // ========================================
 // SYN_STREAM frame
 // ========================================
 
-func (frame frameSynStream) Flags() frameFlags {
+func (frame frameSynStream) Flags() FrameFlags {
 	return frame.flags
 }
 
 func (frame frameSynStream) Data() []byte {
+	data, _ := frame.block()
+	return data
+}
+
+// block returns the data of the frame, with its header block compressed
+func (frame frameSynStream) block() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	// stream-id
 	binary.Write(buf, binary.BigEndian, frame.stream&0x7fffffff)
 	// associated-to-stream-id FIXME in the long term
 	binary.Write(buf, binary.BigEndian, frame.associated_stream&0x7fffffff)
 	// Priority & unused/reserved
-	var misc uint16 = uint16((frame.priority & 0x7) << 13)
+	var misc uint16 = uint16(frame.priority&0x7) << 13
 	binary.Write(buf, binary.BigEndian, misc)
 	// debug.Println("Before header:", buf.Bytes())
-	frame.session.headerWriter.writeHeader(buf, frame.header)
+	err := frame.session.headerWriter.writeHeader(buf, frame.header)
 	// debug.Println("Compressed header:", buf.Bytes())
-	return buf.Bytes()
+	return buf.Bytes(), err
 }
 
 func (frame frameSynStream) Write(w io.Writer) (n int64, err error) {
-	f := controlFrame{kind: FRAME_SYN_STREAM, flags: frame.flags, data: frame.Data()}
+	data, err := frame.block()
+	if err != nil {
+		return
+	}
+	f := controlFrame{kind: FRAME_SYN_STREAM, flags: frame.flags, data: data}
 	return f.Write(w)
 }
 
@@ -274,19 +379,29 @@ func (frame frameSynStream) String() string {
 // SYN_REPLY frame
 // ========================================
 
-func (frame frameSynReply) Flags() frameFlags {
+func (frame frameSynReply) Flags() FrameFlags {
 	return frame.flags
 }
 
 func (frame frameSynReply) Data() []byte {
+	data, _ := frame.block()
+	return data
+}
+
+// block returns the data of the frame, with its header block compressed
+func (frame frameSynReply) block() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, frame.stream&0x7fffffff)
-	frame.session.headerWriter.writeHeader(buf, frame.headers)
-	return buf.Bytes()
+	err := frame.session.headerWriter.writeHeader(buf, frame.headers)
+	return buf.Bytes(), err
 }
 
 func (frame frameSynReply) Write(w io.Writer) (n int64, err error) {
-	cf := controlFrame{kind: FRAME_SYN_REPLY, data: frame.Data()}
+	data, err := frame.block()
+	if err != nil {
+		return
+	}
+	cf := controlFrame{kind: FRAME_SYN_REPLY, data: data}
 	return cf.Write(w)
 }
 
@@ -301,11 +416,75 @@ func (frame frameSynReply) String() string {
 	return s
 }
 
+// ========================================
+// HEADERS frame
+// ========================================
+
+func (frame frameHeaders) Flags() FrameFlags {
+	return frame.flags
+}
+
+func (frame frameHeaders) Data() []byte {
+	data, _ := frame.block()
+	return data
+}
+
+// block returns the data of the frame, with its header block compressed
+func (frame frameHeaders) block() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, frame.stream&0x7fffffff)
+	err := frame.session.headerWriter.writeHeader(buf, frame.headers)
+	return buf.Bytes(), err
+}
+
+func (frame frameHeaders) Write(w io.Writer) (n int64, err error) {
+	data, err := frame.block()
+	if err != nil {
+		return
+	}
+	cf := controlFrame{kind: FRAME_HEADERS, flags: frame.flags, data: data}
+	return cf.Write(w)
+}
+
+// print details of the frame to a string
+func (frame frameHeaders) String() string {
+	s := fmt.Sprintf("\n\tFrame: HEADERS, Stream #%d", frame.stream)
+	s += fmt.Sprintf(", Flags: %s", frame.flags)
+	s += fmt.Sprintf("\n\tHeaders:\n")
+	for i := range frame.headers {
+		s += fmt.Sprintf("\t\t%s: %s\n", i, strings.Join(frame.headers[i], ", "))
+	}
+	return s
+}
+
+// ========================================
+// flush marker
+// ========================================
+
+func (m flushMarker) Flags() FrameFlags {
+	return FLAG_NONE
+}
+
+func (m flushMarker) Data() []byte {
+	return nil
+}
+
+// Write writes nothing, it only signals that the frames before it
+// have been written
+func (m flushMarker) Write(w io.Writer) (n int64, err error) {
+	close(m.done)
+	return 0, nil
+}
+
+func (m flushMarker) String() string {
+	return "\n\tFlush marker"
+}
+
 // ========================================
 // SETTINGS frame
 // ========================================
 
-func (s settings) Flags() frameFlags {
+func (s settings) Flags() FrameFlags {
 	return s.flags
 }
 
@@ -347,3 +526,31 @@ func windowUpdateFor(id streamID, dws int) frame {
 
 	return controlFrame{kind: FRAME_WINDOW_UPDATE, data: data.Bytes()}
 }
+
+// ========================================
+// GOAWAY frame
+// ========================================
+
+// takes the last good stream ID and a status code and returns a GOAWAY frame
+func goawayFor(id streamID, status uint32) frame {
+
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, id&0x7fffffff)
+	binary.Write(data, binary.BigEndian, status)
+
+	return controlFrame{kind: FRAME_GOAWAY, data: data.Bytes()}
+}
+
+// ========================================
+// RST_STREAM frame
+// ========================================
+
+// takes a stream ID and a status code and returns a RST_STREAM frame
+func rstStreamFor(id streamID, status uint32) frame {
+
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, id&0x7fffffff)
+	binary.Write(data, binary.BigEndian, status)
+
+	return controlFrame{kind: FRAME_RST_STREAM, data: data.Bytes()}
+}
@@ -0,0 +1,545 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Framer and exported frame types, to speak raw SPDY frames
+// without a Session
+
+package spdy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// NewFramer returns a Framer that reads and writes frames on rw.
+// It keeps its own header compression contexts, so it must see all the
+// frames of the connection in each direction.
+func NewFramer(rw io.ReadWriter) *Framer {
+	return &Framer{
+		rw:            rw,
+		headerWriter:  newHeaderWriter(),
+		headerReader:  newHeaderReader(DEFAULT_MAX_HEADER_BYTES),
+		maxFrameBytes: DEFAULT_MAX_FRAME_BYTES,
+	}
+}
+
+// ReadFrame reads the next frame from the connection, decompressing its
+// header block if it has one.
+func (f *Framer) ReadFrame() (Frame, error) {
+	fr, err := readFrame(f.rw, f.maxFrameBytes)
+	if err != nil {
+		return nil, err
+	}
+	switch fr := fr.(type) {
+	case dataFrame:
+		return &DataFrame{StreamID: uint32(fr.stream), Flags: fr.flags, Data: fr.data}, nil
+	case controlFrame:
+		cf := controlFrameFor(fr.kind)
+		err = cf.fromControl(fr)
+		if err != nil {
+			return nil, err
+		}
+		switch c := cf.(type) {
+		case *SynStreamFrame:
+			c.Header, err = f.headerReader.decode(c.HeaderBlock)
+		case *SynReplyFrame:
+			c.Header, err = f.headerReader.decode(c.HeaderBlock)
+		case *HeadersFrame:
+			c.Header, err = f.headerReader.decode(c.HeaderBlock)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return cf, nil
+	}
+	return nil, errors.New("unknown frame read")
+}
+
+// WriteFrame writes a frame to the connection. The HeaderBlock of frames
+// that have one is replaced with their compressed Header.
+func (f *Framer) WriteFrame(fr Frame) (err error) {
+	w, err := fr.wire(f)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(f.rw)
+	return
+}
+
+// a Frame that can be read from a control frame
+type parsedControlFrame interface {
+	Frame
+	fromControl(cf controlFrame) error
+}
+
+// returns an empty exported frame for the given kind of control frame
+func controlFrameFor(kind ControlFrameKind) parsedControlFrame {
+	switch kind {
+	case FRAME_SYN_STREAM:
+		return new(SynStreamFrame)
+	case FRAME_SYN_REPLY:
+		return new(SynReplyFrame)
+	case FRAME_RST_STREAM:
+		return new(RstStreamFrame)
+	case FRAME_SETTINGS:
+		return new(SettingsFrame)
+	case FRAME_PING:
+		return new(PingFrame)
+	case FRAME_GOAWAY:
+		return new(GoAwayFrame)
+	case FRAME_HEADERS:
+		return new(HeadersFrame)
+	case FRAME_WINDOW_UPDATE:
+		return new(WindowUpdateFrame)
+	}
+	return new(ControlFrame)
+}
+
+// returns the wire format of an internal frame
+func marshalFrame(fr frame) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	_, err := fr.Write(buf)
+	return buf.Bytes(), err
+}
+
+// reads a control frame of the given kind from its wire format
+func parseControlFrame(data []byte, kind ControlFrameKind) (cf controlFrame, err error) {
+	fr, err := readFrame(bytes.NewReader(data), MAX_DATA_PAYLOAD)
+	if err != nil {
+		return
+	}
+	cf, ok := fr.(controlFrame)
+	if !ok || cf.kind != kind {
+		err = errors.New(fmt.Sprintf("not a %s frame", kind))
+	}
+	return
+}
+
+// checks the payload size of a control frame
+func checkLength(cf controlFrame, min int, exact bool) error {
+	if len(cf.data) < min || (exact && len(cf.data) != min) {
+		return errors.New(fmt.Sprintf("%s frame with wrong size: %d bytes", cf.kind, len(cf.data)))
+	}
+	return nil
+}
+
+// checks the payload size of a control frame as per its kind, which for
+// frames with header blocks or SETTINGS entries is only a minimum.
+// Unknown kinds are not checked
+func checkSize(cf controlFrame) error {
+	switch cf.kind {
+	case FRAME_SYN_STREAM:
+		return checkLength(cf, 10, false)
+	case FRAME_SYN_REPLY, FRAME_HEADERS, FRAME_SETTINGS:
+		return checkLength(cf, 4, false)
+	case FRAME_RST_STREAM, FRAME_GOAWAY, FRAME_WINDOW_UPDATE:
+		return checkLength(cf, 8, true)
+	case FRAME_PING:
+		return checkLength(cf, 4, true)
+	}
+	return nil
+}
+
+func headerString(h map[string][]string) (s string) {
+	// sorted, for captures to read and compare
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s += fmt.Sprintf("\t\t%s: %s\n", name, strings.Join(h[name], ", "))
+	}
+	return
+}
+
+// ========================================
+// DATA frame
+// ========================================
+
+func (d *DataFrame) toData() dataFrame {
+	return dataFrame{stream: streamID(d.StreamID), flags: d.Flags, data: d.Data}
+}
+
+func (d *DataFrame) wire(f *Framer) (frame, error) { return d.toData(), nil }
+func (d *DataFrame) String() string                { return d.toData().String() }
+func (d *DataFrame) Marshal() ([]byte, error)      { return marshalFrame(d.toData()) }
+
+func (d *DataFrame) Parse(data []byte) error {
+	fr, err := readFrame(bytes.NewReader(data), MAX_DATA_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	df, ok := fr.(dataFrame)
+	if !ok {
+		return errors.New("not a DATA frame")
+	}
+	d.StreamID, d.Flags, d.Data = uint32(df.stream), df.flags, df.data
+	return nil
+}
+
+// ========================================
+// SYN_STREAM frame
+// ========================================
+
+func (s *SynStreamFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, s.StreamID&0x7fffffff)
+	binary.Write(buf, binary.BigEndian, s.AssociatedStreamID&0x7fffffff)
+	buf.Write([]byte{(s.Priority & 0x7) << 5, s.Slot})
+	buf.Write(s.HeaderBlock)
+	return controlFrame{kind: FRAME_SYN_STREAM, flags: s.Flags, data: buf.Bytes()}
+}
+
+func (s *SynStreamFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 10, false)
+	if err != nil {
+		return
+	}
+	s.StreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	s.AssociatedStreamID = binary.BigEndian.Uint32(cf.data[4:8]) & 0x7fffffff
+	s.Priority = cf.data[8] >> 5
+	s.Slot = cf.data[9]
+	s.Flags = cf.flags
+	s.HeaderBlock = cf.data[10:]
+	return
+}
+
+func (s *SynStreamFrame) wire(f *Framer) (frame, error) {
+	var err error
+	s.HeaderBlock, err = f.headerWriter.encode(s.Header)
+	if err != nil {
+		return nil, err
+	}
+	return s.toControl(), nil
+}
+
+func (s *SynStreamFrame) Marshal() ([]byte, error) { return marshalFrame(s.toControl()) }
+
+func (s *SynStreamFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_SYN_STREAM)
+	if err != nil {
+		return err
+	}
+	return s.fromControl(cf)
+}
+
+func (s *SynStreamFrame) String() string {
+	return fmt.Sprintf("SYN_STREAM #%d, associated #%d, priority %d, flags: %s\n%s",
+		s.StreamID, s.AssociatedStreamID, s.Priority, s.Flags, headerString(s.Header))
+}
+
+// ========================================
+// SYN_REPLY frame
+// ========================================
+
+func (s *SynReplyFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, s.StreamID&0x7fffffff)
+	buf.Write(s.HeaderBlock)
+	return controlFrame{kind: FRAME_SYN_REPLY, flags: s.Flags, data: buf.Bytes()}
+}
+
+func (s *SynReplyFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 4, false)
+	if err != nil {
+		return
+	}
+	s.StreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	s.Flags = cf.flags
+	s.HeaderBlock = cf.data[4:]
+	return
+}
+
+func (s *SynReplyFrame) wire(f *Framer) (frame, error) {
+	var err error
+	s.HeaderBlock, err = f.headerWriter.encode(s.Header)
+	if err != nil {
+		return nil, err
+	}
+	return s.toControl(), nil
+}
+
+func (s *SynReplyFrame) Marshal() ([]byte, error) { return marshalFrame(s.toControl()) }
+
+func (s *SynReplyFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_SYN_REPLY)
+	if err != nil {
+		return err
+	}
+	return s.fromControl(cf)
+}
+
+func (s *SynReplyFrame) String() string {
+	return fmt.Sprintf("SYN_REPLY #%d, flags: %s\n%s", s.StreamID, s.Flags, headerString(s.Header))
+}
+
+// ========================================
+// RST_STREAM frame
+// ========================================
+
+func (r *RstStreamFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, r.StreamID&0x7fffffff)
+	binary.Write(buf, binary.BigEndian, r.Status)
+	return controlFrame{kind: FRAME_RST_STREAM, data: buf.Bytes()}
+}
+
+func (r *RstStreamFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 8, true)
+	if err != nil {
+		return
+	}
+	r.StreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	r.Status = binary.BigEndian.Uint32(cf.data[4:8])
+	return
+}
+
+func (r *RstStreamFrame) wire(f *Framer) (frame, error) { return r.toControl(), nil }
+func (r *RstStreamFrame) Marshal() ([]byte, error)      { return marshalFrame(r.toControl()) }
+
+func (r *RstStreamFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_RST_STREAM)
+	if err != nil {
+		return err
+	}
+	return r.fromControl(cf)
+}
+
+func (r *RstStreamFrame) String() string {
+	return fmt.Sprintf("RST_STREAM #%d, status %d", r.StreamID, r.Status)
+}
+
+// ========================================
+// SETTINGS frame
+// ========================================
+
+func (s *SettingsFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(s.Values)))
+	for _, v := range s.Values {
+		binary.Write(buf, binary.BigEndian, uint32(v.Flags)<<24|v.ID&0xffffff)
+		binary.Write(buf, binary.BigEndian, v.Value)
+	}
+	return controlFrame{kind: FRAME_SETTINGS, flags: s.Flags, data: buf.Bytes()}
+}
+
+func (s *SettingsFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 4, false)
+	if err != nil {
+		return
+	}
+	count := binary.BigEndian.Uint32(cf.data[0:4])
+	if uint64(len(cf.data)) != 4+8*uint64(count) {
+		return errors.New(fmt.Sprintf("SETTINGS frame with %d entries has %d bytes", count, len(cf.data)))
+	}
+	s.Flags = cf.flags
+	s.Values = make([]SettingsValue, count)
+	for i := range s.Values {
+		entry := cf.data[4+8*i:]
+		head := binary.BigEndian.Uint32(entry[0:4])
+		s.Values[i] = SettingsValue{
+			Flags: uint8(head >> 24),
+			ID:    head & 0xffffff,
+			Value: binary.BigEndian.Uint32(entry[4:8]),
+		}
+	}
+	return
+}
+
+func (s *SettingsFrame) wire(f *Framer) (frame, error) { return s.toControl(), nil }
+func (s *SettingsFrame) Marshal() ([]byte, error)      { return marshalFrame(s.toControl()) }
+
+func (s *SettingsFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_SETTINGS)
+	if err != nil {
+		return err
+	}
+	return s.fromControl(cf)
+}
+
+func (s *SettingsFrame) String() (r string) {
+	r = fmt.Sprintf("SETTINGS, flags: %s\n", s.Flags)
+	for _, v := range s.Values {
+		r += fmt.Sprintf("\t\t%d: %d\tflags: %d\n", v.ID, v.Value, v.Flags)
+	}
+	return
+}
+
+// ========================================
+// PING frame
+// ========================================
+
+func (p *PingFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, p.ID)
+	return controlFrame{kind: FRAME_PING, data: buf.Bytes()}
+}
+
+func (p *PingFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 4, true)
+	if err != nil {
+		return
+	}
+	p.ID = binary.BigEndian.Uint32(cf.data[0:4])
+	return
+}
+
+func (p *PingFrame) wire(f *Framer) (frame, error) { return p.toControl(), nil }
+func (p *PingFrame) Marshal() ([]byte, error)      { return marshalFrame(p.toControl()) }
+
+func (p *PingFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_PING)
+	if err != nil {
+		return err
+	}
+	return p.fromControl(cf)
+}
+
+func (p *PingFrame) String() string { return fmt.Sprintf("PING #%d", p.ID) }
+
+// ========================================
+// GOAWAY frame
+// ========================================
+
+func (g *GoAwayFrame) toControl() controlFrame {
+	return goawayFor(streamID(g.LastGoodStreamID), g.Status).(controlFrame)
+}
+
+func (g *GoAwayFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 8, true)
+	if err != nil {
+		return
+	}
+	g.LastGoodStreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	g.Status = binary.BigEndian.Uint32(cf.data[4:8])
+	return
+}
+
+func (g *GoAwayFrame) wire(f *Framer) (frame, error) { return g.toControl(), nil }
+func (g *GoAwayFrame) Marshal() ([]byte, error)      { return marshalFrame(g.toControl()) }
+
+func (g *GoAwayFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_GOAWAY)
+	if err != nil {
+		return err
+	}
+	return g.fromControl(cf)
+}
+
+func (g *GoAwayFrame) String() string {
+	return fmt.Sprintf("GOAWAY, last good stream #%d, status %d", g.LastGoodStreamID, g.Status)
+}
+
+// ========================================
+// HEADERS frame
+// ========================================
+
+func (h *HeadersFrame) toControl() controlFrame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, h.StreamID&0x7fffffff)
+	buf.Write(h.HeaderBlock)
+	return controlFrame{kind: FRAME_HEADERS, flags: h.Flags, data: buf.Bytes()}
+}
+
+func (h *HeadersFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 4, false)
+	if err != nil {
+		return
+	}
+	h.StreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	h.Flags = cf.flags
+	h.HeaderBlock = cf.data[4:]
+	return
+}
+
+func (h *HeadersFrame) wire(f *Framer) (frame, error) {
+	var err error
+	h.HeaderBlock, err = f.headerWriter.encode(h.Header)
+	if err != nil {
+		return nil, err
+	}
+	return h.toControl(), nil
+}
+
+func (h *HeadersFrame) Marshal() ([]byte, error) { return marshalFrame(h.toControl()) }
+
+func (h *HeadersFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_HEADERS)
+	if err != nil {
+		return err
+	}
+	return h.fromControl(cf)
+}
+
+func (h *HeadersFrame) String() string {
+	return fmt.Sprintf("HEADERS #%d, flags: %s\n%s", h.StreamID, h.Flags, headerString(h.Header))
+}
+
+// ========================================
+// WINDOW_UPDATE frame
+// ========================================
+
+func (w *WindowUpdateFrame) toControl() controlFrame {
+	return windowUpdateFor(streamID(w.StreamID&0x7fffffff), int(w.DeltaWindowSize&0x7fffffff)).(controlFrame)
+}
+
+func (w *WindowUpdateFrame) fromControl(cf controlFrame) (err error) {
+	err = checkLength(cf, 8, true)
+	if err != nil {
+		return
+	}
+	w.StreamID = binary.BigEndian.Uint32(cf.data[0:4]) & 0x7fffffff
+	w.DeltaWindowSize = binary.BigEndian.Uint32(cf.data[4:8]) & 0x7fffffff
+	return
+}
+
+func (w *WindowUpdateFrame) wire(f *Framer) (frame, error) { return w.toControl(), nil }
+func (w *WindowUpdateFrame) Marshal() ([]byte, error)      { return marshalFrame(w.toControl()) }
+
+func (w *WindowUpdateFrame) Parse(data []byte) error {
+	cf, err := parseControlFrame(data, FRAME_WINDOW_UPDATE)
+	if err != nil {
+		return err
+	}
+	return w.fromControl(cf)
+}
+
+func (w *WindowUpdateFrame) String() string {
+	return fmt.Sprintf("WINDOW_UPDATE #%d, delta %d", w.StreamID, w.DeltaWindowSize)
+}
+
+// ========================================
+// Other control frames
+// ========================================
+
+func (c *ControlFrame) toControl() controlFrame {
+	return controlFrame{kind: c.Kind, flags: c.Flags, data: c.Data}
+}
+
+func (c *ControlFrame) fromControl(cf controlFrame) error {
+	c.Kind, c.Flags, c.Data = cf.kind, cf.flags, cf.data
+	return nil
+}
+
+func (c *ControlFrame) wire(f *Framer) (frame, error) { return c.toControl(), nil }
+func (c *ControlFrame) String() string                { return c.toControl().String() }
+func (c *ControlFrame) Marshal() ([]byte, error)      { return marshalFrame(c.toControl()) }
+
+func (c *ControlFrame) Parse(data []byte) error {
+	fr, err := readFrame(bytes.NewReader(data), MAX_DATA_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	cf, ok := fr.(controlFrame)
+	if !ok {
+		return errors.New("not a control frame")
+	}
+	return c.fromControl(cf)
+}
@@ -0,0 +1,65 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Gateways between SPDY and HTTP/2
+
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewHTTP2Gateway returns a reverse proxy, like NewReverseProxy, that
+// forwards the streams of SPDY sessions to an HTTP/2 upstream, multiplexed
+// over its connections: with TLS for an "https" target, and with prior
+// knowledge for an "http" one. The priority of each stream is sent as the
+// urgency of the Priority header of RFC 9218, unless the request has one,
+// as both go from 0 to 7 with 0 the most urgent. A stream reset by the
+// client resets the upstream stream with CANCEL, and an upstream stream
+// reset gets a 502 before the reply and resets the SPDY stream with
+// INTERNAL_ERROR after it. Flow control holds end to end, as each side is
+// read only as fast as the window of the other lets its data through.
+func NewHTTP2Gateway(target *url.URL) *httputil.ReverseProxy {
+	proxy := NewReverseProxy(target)
+	rewrite := proxy.Rewrite
+	proxy.Rewrite = func(r *httputil.ProxyRequest) {
+		rewrite(r)
+		if str := ContextStream(r.In.Context()); str != nil && r.Out.Header.Get("Priority") == "" {
+			r.Out.Header.Set("Priority", fmt.Sprintf("u=%d", str.priority))
+		}
+	}
+	protocols := new(http.Protocols)
+	if target.Scheme == "https" {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = protocols
+	proxy.Transport = transport
+	return proxy
+}
+
+// NewSPDYGateway returns a reverse proxy, the other way around, to be the
+// Handler of an http.Server for its HTTP/2 clients, or any others, that
+// forwards the requests to a SPDY upstream with a Transport, which can be
+// set up further. The urgency in the Priority header of a request, as per
+// RFC 9218, is the priority of its stream. A request canceled by the
+// client resets its stream with CANCEL, and a stream reset by the upstream
+// gets a 502 before the reply and cuts the reply short after it.
+func NewSPDYGateway(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			stripSpdyHeaders(r.Out.Header)
+			r.SetURL(target)
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport:     &Transport{},
+		FlushInterval: -1,
+	}
+}
@@ -13,21 +13,32 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type hrSource struct {
 	r io.Reader
 	m sync.RWMutex
 	c *sync.Cond
+	// the source is a whole header block, with nothing to wait for once
+	// it is read, as a block cut short cannot be inflated
+	whole bool
 }
 
 func (src *hrSource) Read(p []byte) (n int, err error) {
 	src.m.RLock()
 	for src.r == nil {
+		if src.whole {
+			src.m.RUnlock()
+			return 0, io.ErrUnexpectedEOF
+		}
 		src.c.Wait()
 	}
 	n, err = src.r.Read(p)
@@ -46,21 +57,117 @@ func (src *hrSource) change(r io.Reader) {
 	src.c.Broadcast()
 }
 
+// errHeaderTooLarge is returned when a decompressed header block goes over
+// the maximum size allowed by the headerReader
+var errHeaderTooLarge = errors.New("header block too large")
+
+// malformedHeaderError is returned, with the header block decoded, when
+// the block breaks the rules of SPDY/3 for its names or its pseudo-headers,
+// which is an error of its stream only
+type malformedHeaderError string
+
+func (e malformedHeaderError) Error() string { return "malformed header block: " + string(e) }
+
+// compressionError is returned when a header block cannot be inflated.
+// The compression context shared by the blocks of the session is lost
+// with it, so the session cannot go on
+type compressionError struct {
+	err error
+}
+
+func (e compressionError) Error() string { return "header block not inflated: " + e.err.Error() }
+
+// the headers of HTTP/1 about its connection, which are not valid in SPDY.
+// A host header is not one of them, it is ignored as per SPDY/3
+var connectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"}
+
+// checkRequestHeader checks that a SYN_STREAM has the pseudo-headers of a
+// request, or of a pushed resource, and no connection headers of HTTP/1.
+// CONNECT requests have no path nor scheme
+func checkRequestHeader(h http.Header, pushed bool) error {
+	required := []string{HEADER_METHOD, HEADER_PATH, HEADER_VERSION, HEADER_HOST, HEADER_SCHEME}
+	if pushed {
+		required = []string{HEADER_SCHEME, HEADER_HOST, HEADER_PATH}
+	} else if h.Get(HEADER_METHOD) == "CONNECT" {
+		required = []string{HEADER_METHOD, HEADER_VERSION, HEADER_HOST}
+	}
+	for _, name := range required {
+		if h.Get(name) == "" {
+			return malformedHeaderError(fmt.Sprintf("no %s", name))
+		}
+	}
+	return checkConnectionHeaders(h)
+}
+
+// checkReplyHeader checks that a SYN_REPLY has a status starting with its
+// code and a version, and no connection headers of HTTP/1
+func checkReplyHeader(h http.Header) error {
+	status := h.Get(HEADER_STATUS)
+	if len(status) < 3 || strings.Trim(status[:3], "0123456789") != "" {
+		return malformedHeaderError(fmt.Sprintf("%s of %q", HEADER_STATUS, status))
+	}
+	if h.Get(HEADER_VERSION) == "" {
+		return malformedHeaderError(fmt.Sprintf("no %s", HEADER_VERSION))
+	}
+	return checkConnectionHeaders(h)
+}
+
+func checkConnectionHeaders(h http.Header) error {
+	for _, name := range connectionHeaders {
+		if _, found := h[name]; found {
+			return malformedHeaderError(fmt.Sprintf("connection header %s", name))
+		}
+	}
+	return nil
+}
+
+// headerSize returns the bytes of the names and values of a header block
+func headerSize(h http.Header) (n int) {
+	for name, values := range h {
+		for _, v := range values {
+			n += len(name) + len(v)
+		}
+	}
+	return
+}
+
+// errHeaderReaderReleased is returned when decoding headers for a session
+// that is done
+var errHeaderReaderReleased = errors.New("header reader released")
+
+// zlib readers and writers with the SPDY dictionary, kept for new sessions
+// once their sessions are done, as they are expensive to create. Writers
+// are kept by compression level, from zlib.HuffmanOnly
+var (
+	headerDecompressors sync.Pool
+	headerCompressors   [zlib.BestCompression - zlib.HuffmanOnly + 1]sync.Pool
+)
+
 // A headerReader reads zlib-compressed headers from discontiguous sources.
 type headerReader struct {
 	source       hrSource
 	decompressor io.ReadCloser
+	maxSize      int    // maximum size of a decompressed header block
+	dict         []byte // the zlib dictionary, if not the one of SPDY/3
+	mu           sync.Mutex
+	released     bool
+	failed       error // the compressionError that lost the context, if any
 }
 
 // newHeaderReader creates a headerReader with the initial dictionary.
-func newHeaderReader() (hr *headerReader) {
+// Header blocks larger than max bytes, once decompressed, are rejected.
+func newHeaderReader(max int) (hr *headerReader) {
 	hr = new(headerReader)
 	hr.source.c = sync.NewCond(hr.source.m.RLocker())
+	hr.maxSize = max
 	return
 }
 
 // ReadHeader reads a set of headers from a reader.
 func (hr *headerReader) readHeader(r io.Reader) (h http.Header, err error) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.source.whole = false
 	hr.source.change(r)
 	h, err = hr.read()
 	return
@@ -68,48 +175,136 @@ func (hr *headerReader) readHeader(r io.Reader) (h http.Header, err error) {
 
 // Decode reads a set of headers from a block of bytes.
 func (hr *headerReader) decode(data []byte) (h http.Header, err error) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.source.whole = true
 	hr.source.change(bytes.NewBuffer(data))
 	h, err = hr.read()
 	return
 }
 
+// discard reads a whole header block from r, to its end, only to keep the
+// compression context in sync with the other end
+func (hr *headerReader) discard(r io.Reader) (err error) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.source.whole = true
+	hr.source.change(r)
+	_, err = hr.read()
+	io.Copy(ioutil.Discard, r)
+	return
+}
+
+// release gives the decompressor back to the pool. The headerReader
+// cannot be used any more
+func (hr *headerReader) release() {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.released = true
+	if hr.decompressor != nil {
+		headerDecompressors.Put(hr.decompressor)
+		hr.decompressor = nil
+	}
+}
+
 func (hr *headerReader) read() (h http.Header, err error) {
 	var count uint32
-	if hr.decompressor == nil {
-		hr.decompressor, err = zlib.NewReaderDict(&hr.source, headerDictionary)
-		if err != nil {
+	if hr.released {
+		return nil, errHeaderReaderReleased
+	}
+	if hr.failed != nil {
+		return nil, hr.failed
+	}
+	defer func() {
+		if _, ok := err.(malformedHeaderError); ok || err == nil || err == errHeaderTooLarge {
 			return
 		}
+		// no later block can be read after this one
+		err = compressionError{err}
+		hr.failed = err
+	}()
+	if hr.decompressor == nil {
+		dict := hr.dict
+		if dict == nil {
+			dict = headerDictionary
+		}
+		// the zlib header is read right away, from the first header block
+		if d, ok := headerDecompressors.Get().(io.ReadCloser); ok {
+			err = d.(zlib.Resetter).Reset(&hr.source, dict)
+			if err != nil {
+				return
+			}
+			hr.decompressor = d
+		} else {
+			hr.decompressor, err = zlib.NewReaderDict(&hr.source, dict)
+			if err != nil {
+				return
+			}
+		}
 	}
 	err = binary.Read(hr.decompressor, binary.BigEndian, &count)
 	if err != nil {
 		return
 	}
-	h = make(http.Header, int(count))
+	// the count is not trusted for preallocating the header
+	h = make(http.Header)
+	size := 4
+	// the block is read to the end all the same, for the compression
+	// context to stay in sync
+	var malformed error
+	seen := make(map[string]bool)
 	for i := 0; i < int(count); i++ {
 		var name, value string
-		name, err = readHeaderString(hr.decompressor)
+		name, err = readHeaderString(hr.decompressor, &size, hr.maxSize)
 		if err != nil {
 			return
 		}
-		value, err = readHeaderString(hr.decompressor)
+		value, err = readHeaderString(hr.decompressor, &size, hr.maxSize)
 		if err != nil {
 			return
 		}
+		if size > hr.maxSize {
+			continue
+		}
+		if malformed == nil {
+			switch {
+			case name == "":
+				malformed = malformedHeaderError("zero-length name")
+			case strings.IndexByte(name, 0) >= 0:
+				malformed = malformedHeaderError(fmt.Sprintf("name %q with a NUL", name))
+			case name != strings.ToLower(name):
+				malformed = malformedHeaderError(fmt.Sprintf("name %q not in lowercase", name))
+			case seen[name]:
+				malformed = malformedHeaderError(fmt.Sprintf("name %q more than once", name))
+			}
+		}
+		seen[name] = true
 		valueList := strings.Split(string(value), "\x00")
 		for _, v := range valueList {
 			h.Add(name, v)
 		}
 	}
-	return
+	if size > hr.maxSize {
+		return nil, errHeaderTooLarge
+	}
+	return h, malformed
 }
 
-func readHeaderString(r io.Reader) (s string, err error) {
+// readHeaderString reads a length-prefixed string, adding its size to the
+// running size of the header block. Once the block goes over max, strings
+// are discarded rather than allocated, but still consumed, so that the
+// compression context stays in sync with the other end.
+func readHeaderString(r io.Reader, size *int, max int) (s string, err error) {
 	var length uint32
 	err = binary.Read(r, binary.BigEndian, &length)
 	if err != nil {
 		return
 	}
+	*size += 4 + int(length)
+	if *size > max {
+		_, err = io.CopyN(ioutil.Discard, r, int64(length))
+		return
+	}
 	data := make([]byte, int(length))
 	_, err = io.ReadFull(r, data)
 	if err != nil {
@@ -122,42 +317,134 @@ func readHeaderString(r io.Reader) (s string, err error) {
 type headerWriter struct {
 	compressor *zlib.Writer
 	buffer     *bytes.Buffer
+	level      int
+	dict       []byte       // the zlib dictionary, if not the one of SPDY/3
+	block      bytes.Buffer // the header block before compression
+	failed     error        // the error that lost the context, if any
+	// atomic, bytes of the header blocks written, before and after
+	// compression
+	raw        int64
+	compressed int64
 }
 
 // creates a headerWriter ready to compress headers
 func newHeaderWriter() (hw *headerWriter) {
-	hw = &headerWriter{buffer: new(bytes.Buffer)}
-	hw.compressor, _ = zlib.NewWriterLevelDict(hw.buffer, zlib.BestCompression, headerDictionary)
+	return newHeaderWriterLevel(zlib.BestCompression)
+}
+
+// creates a headerWriter compressing headers with the given zlib level.
+// With zlib.NoCompression, the header blocks are written as stored blocks,
+// which any SPDY decompressor reads
+func newHeaderWriterLevel(level int) (hw *headerWriter) {
+	return newHeaderWriterDict(level, nil)
+}
+
+// creates a headerWriter compressing headers with the given zlib level and
+// dictionary, or the one of SPDY/3 if nil. Only the writers with the one of
+// SPDY/3 are pooled
+func newHeaderWriterDict(level int, dict []byte) (hw *headerWriter) {
+	if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+		level = zlib.BestCompression
+	}
+	hw = &headerWriter{buffer: new(bytes.Buffer), level: level, dict: dict}
+	if dict != nil {
+		hw.compressor, _ = zlib.NewWriterLevelDict(hw.buffer, level, dict)
+		return
+	}
+	if c, ok := headerCompressors[level-zlib.HuffmanOnly].Get().(*zlib.Writer); ok {
+		// as good as new, with the dictionary
+		c.Reset(hw.buffer)
+		hw.compressor = c
+		return
+	}
+	hw.compressor, _ = zlib.NewWriterLevelDict(hw.buffer, level, headerDictionary)
 	return
 }
 
+// compressionLevel returns the zlib level of the headers sent, as per the
+// options of a Server or a Transport
+func compressionLevel(level int, none bool) int {
+	if none {
+		return zlib.NoCompression
+	}
+	if level == 0 {
+		return zlib.BestCompression
+	}
+	return level
+}
+
+// release gives the compressor back to the pool. The headerWriter
+// cannot be used any more
+func (hw *headerWriter) release() {
+	if hw.compressor != nil && hw.dict == nil {
+		headerCompressors[hw.level-zlib.HuffmanOnly].Put(hw.compressor)
+	}
+	hw.compressor = nil
+}
+
 // write a header block directly to a writer
 func (hw *headerWriter) writeHeader(w io.Writer, h http.Header) (err error) {
-	hw.write(h)
+	err = hw.write(h)
+	if err != nil {
+		return
+	}
 	_, err = io.Copy(w, hw.buffer)
 	hw.buffer.Reset()
 	return
 }
 
 // Encode returns a compressed header block.
-func (hw *headerWriter) encode(h http.Header) (data []byte) {
-	hw.write(h)
+func (hw *headerWriter) encode(h http.Header) (data []byte, err error) {
+	err = hw.write(h)
+	if err != nil {
+		return
+	}
 	data = make([]byte, hw.buffer.Len())
 	hw.buffer.Read(data)
 	return
 }
 
-func (hw *headerWriter) write(h http.Header) {
-	binary.Write(hw.compressor, binary.BigEndian, uint32(len(h)))
+// write compresses a header block to the buffer. Once a block fails, the
+// compression context is out of sync with the other end, so no other
+// block can be written
+func (hw *headerWriter) write(h http.Header) (err error) {
+	if hw.failed != nil {
+		return hw.failed
+	}
+	if hw.compressor == nil {
+		return errors.New("header writer released")
+	}
+	hw.block.Reset()
+	binary.Write(&hw.block, binary.BigEndian, uint32(len(h)))
 	for k, vals := range h {
 		k = strings.ToLower(k)
-		binary.Write(hw.compressor, binary.BigEndian, uint32(len(k)))
-		binary.Write(hw.compressor, binary.BigEndian, []byte(k))
+		binary.Write(&hw.block, binary.BigEndian, uint32(len(k)))
+		hw.block.WriteString(k)
 		v := strings.Join(vals, "\x00")
-		binary.Write(hw.compressor, binary.BigEndian, uint32(len(v)))
-		binary.Write(hw.compressor, binary.BigEndian, []byte(v))
+		binary.Write(&hw.block, binary.BigEndian, uint32(len(v)))
+		hw.block.WriteString(v)
+	}
+	raw := hw.block.Len()
+	start := hw.buffer.Len()
+	_, err = hw.compressor.Write(hw.block.Bytes())
+	if err == nil {
+		err = hw.compressor.Flush()
+	}
+	if err != nil {
+		// nothing of the block is to be sent
+		hw.buffer.Truncate(start)
+		hw.failed = errors.New("header block not compressed: " + err.Error())
+		return hw.failed
+	}
+	compressed := hw.buffer.Len() - start
+	atomic.AddInt64(&hw.raw, int64(raw))
+	atomic.AddInt64(&hw.compressed, int64(compressed))
+	metrics.Add("header_bytes_raw", int64(raw))
+	metrics.Add("header_bytes_compressed", int64(compressed))
+	if o := observed(); o != nil {
+		o.HeaderCompressed(raw, compressed)
 	}
-	hw.compressor.Flush()
+	return nil
 }
 
 // compression header for SPDY/3
@@ -0,0 +1,126 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Metrics published with expvar, and observed by an Observer
+
+package spdy
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// Observer gets measures of all the sessions as they happen, e.g. to
+// build histograms of them. Its methods must not block
+type Observer interface {
+	// a stream is done, the given time after it started
+	StreamClosed(d time.Duration)
+	// a header block of raw bytes is sent as compressed bytes
+	HeaderCompressed(raw, compressed int)
+	// a stream had no send window for the given time
+	WindowStalled(d time.Duration)
+	// a frame of the given kind and size, header included, is sent or
+	// received
+	FrameSent(kind string, size int)
+	FrameReceived(kind string, size int)
+}
+
+// the current observer, in an observerValue
+var observer atomic.Value
+
+type observerValue struct{ Observer }
+
+// SetObserver sets the Observer of the measures of all the sessions,
+// or removes it if nil
+func SetObserver(o Observer) {
+	observer.Store(observerValue{o})
+}
+
+// observed returns the Observer set, if any
+func observed() Observer {
+	v, _ := observer.Load().(observerValue)
+	return v.Observer
+}
+
+// the counters of all the sessions, published under "spdy" with expvar,
+// and so served by /debug/vars along with the rest
+var (
+	metrics        = expvar.NewMap("spdy")
+	framesSent     = new(expvar.Map).Init()
+	framesReceived = new(expvar.Map).Init()
+)
+
+func init() {
+	for _, name := range []string{
+		"sessions_opened", "sessions_closed",
+		"streams_opened", "streams_closed",
+		"bytes_sent", "bytes_received",
+		"resets_sent", "resets_received",
+		"goaways_sent", "goaways_received",
+		"header_bytes_raw", "header_bytes_compressed",
+	} {
+		metrics.Add(name, 0)
+	}
+	metrics.Set("frames_sent", framesSent)
+	metrics.Set("frames_received", framesReceived)
+	metrics.Set("header_compression_ratio", expvar.Func(func() interface{} {
+		raw := metrics.Get("header_bytes_raw").(*expvar.Int).Value()
+		return compressionRatio(raw, metrics.Get("header_bytes_compressed").(*expvar.Int).Value())
+	}))
+}
+
+// compressionRatio returns the bytes of compressed header blocks over the
+// ones before compression, or 0 if none
+func compressionRatio(raw, compressed int64) float64 {
+	if raw == 0 {
+		return 0
+	}
+	return float64(compressed) / float64(raw)
+}
+
+// frameKind returns the name of the type of a frame, or "" for the
+// markers that are not sent
+func frameKind(f frame) string {
+	switch fr := f.(type) {
+	case controlFrame:
+		return fr.kind.String()
+	case dataFrame:
+		return "DATA"
+	case frameSynStream:
+		return "SYN_STREAM"
+	case frameSynReply:
+		return "SYN_REPLY"
+	case frameHeaders:
+		return "HEADERS"
+	}
+	return ""
+}
+
+// countFrame adds a frame sent or received, of the given size, to the
+// metrics
+func countFrame(f frame, size int, sent bool) {
+	kind := frameKind(f)
+	if kind == "" {
+		return
+	}
+	frames, direction := framesReceived, "received"
+	if sent {
+		frames, direction = framesSent, "sent"
+	}
+	frames.Add(kind, 1)
+	if o := observed(); o != nil {
+		if sent {
+			o.FrameSent(kind, size)
+		} else {
+			o.FrameReceived(kind, size)
+		}
+	}
+	switch kind {
+	case "RST_STREAM":
+		metrics.Add("resets_"+direction, 1)
+	case "GOAWAY":
+		metrics.Add("goaways_"+direction, 1)
+	}
+}
@@ -7,9 +7,13 @@
 package spdy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -20,6 +24,22 @@ func PriorityFor(req *url.URL) uint8 {
 	return 4
 }
 
+// requestPriority returns the priority of the stream of a request, from
+// the urgency in its Priority header, as per RFC 9218, which goes from 0
+// to 7 with 0 the most urgent like the priorities of SPDY, or else the
+// PriorityFor its URL
+func requestPriority(req *http.Request) uint8 {
+	for _, param := range strings.Split(req.Header.Get("Priority"), ",") {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "u=") {
+			if u, err := strconv.Atoi(param[2:]); err == nil && u >= 0 && u <= 7 {
+				return uint8(u)
+			}
+		}
+	}
+	return PriorityFor(req.URL)
+}
+
 // check to see if err is a connection reset
 func isConnReset(err error) bool {
 	if e, ok := err.(*net.OpError); ok {
@@ -45,3 +65,51 @@ func netErrorString(err error) string {
 	}
 	return fmt.Sprintf("%#v", err)
 }
+
+// apply sets the socket options on the TCP connection under c, if any.
+// Connections that are not TCP, like unix sockets or pipes, are left as
+// they are
+func (o *SocketOptions) apply(c net.Conn) (err error) {
+	if o == nil {
+		return nil
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	err = tc.SetNoDelay(!o.Nagle)
+	if err != nil {
+		return
+	}
+	switch {
+	case o.KeepAlive > 0:
+		err = tc.SetKeepAlive(true)
+		if err == nil {
+			err = tc.SetKeepAlivePeriod(o.KeepAlive)
+		}
+	case o.KeepAlive < 0:
+		err = tc.SetKeepAlive(false)
+	}
+	if err != nil {
+		return
+	}
+	if o.ReadBuffer > 0 {
+		err = tc.SetReadBuffer(o.ReadBuffer)
+		if err != nil {
+			return
+		}
+	}
+	if o.WriteBuffer > 0 {
+		err = tc.SetWriteBuffer(o.WriteBuffer)
+		if err != nil {
+			return
+		}
+	}
+	if o.Control != nil {
+		err = o.Control(tc)
+	}
+	return
+}
@@ -7,6 +7,10 @@
 package spdy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 )
 
@@ -15,18 +19,107 @@ import (
 // it will be returned, but the ResponseWriter will get a 404 Not Found.
 func (s *Session) NewStreamProxy(r *http.Request, w http.ResponseWriter) (err error) {
 
-	str := s.NewClientStream()
+	str := s.newClientStream(ContextClientTrace(r.Context()), false)
 	if str == nil {
-		log.Println("ERROR in NewClientStream: cannot create stream")
+		s.logger().Error("cannot create stream")
 		http.NotFound(w, r)
 		return
 	}
 	err = str.Request(r, w)
 	if err != nil {
 		http.NotFound(w, r)
-		log.Println("ERROR in Request:", err)
+		str.logger().Error("request failed", "err", err)
 		return
 	}
 
 	return
 }
+
+// Connect opens a CONNECT tunnel to the given authority (host:port) over a
+// new stream of a client session, returning it as a bidirectional byte pipe
+// once the other end replies with a 200. The context is for setting up the
+// tunnel only. Closing the connection half-closes and finishes the stream.
+func (s *Session) Connect(ctx context.Context, authority string) (net.Conn, error) {
+	header := make(http.Header)
+	header.Set(HEADER_METHOD, "CONNECT")
+	header.Set(HEADER_PATH, authority)
+	header.Set(HEADER_VERSION, "HTTP/1.1")
+	header.Set(HEADER_HOST, authority)
+	conn, _, err := s.openTunnel(ctx, header, http.StatusOK)
+	return conn, err
+}
+
+// OpenStream opens a new stream of a client session with the given
+// headers, for the OnStream of the server at the other end, returning it
+// as a bidirectional byte pipe once the other end accepts it. It is for
+// protocols other than HTTP, like RPC ones, to use the multiplexing of
+// the session. The context is for opening the stream only. Closing the
+// connection half-closes and finishes the stream.
+func (s *Session) OpenStream(ctx context.Context, header http.Header) (net.Conn, error) {
+	h := make(http.Header)
+	for name, values := range header {
+		h[http.CanonicalHeaderKey(name)] = values
+	}
+	h.Set(HEADER_METHOD, STREAM_METHOD)
+	h.Set(HEADER_VERSION, "HTTP/1.1")
+	if h.Get(HEADER_PATH) == "" {
+		h.Set(HEADER_PATH, "/")
+	}
+	if h.Get(HEADER_HOST) == "" {
+		h.Set(HEADER_HOST, s.conn.RemoteAddr().String())
+	}
+	if h.Get(HEADER_SCHEME) == "" {
+		h.Set(HEADER_SCHEME, "http")
+	}
+	conn, _, err := s.openTunnel(ctx, h, http.StatusOK)
+	return conn, err
+}
+
+// openTunnel starts a new stream of a client session with the given
+// request headers, returning it as a bidirectional byte pipe once the
+// other end replies with the given status, along with the reply
+func (s *Session) openTunnel(ctx context.Context, header http.Header, status int) (net.Conn, *http.Response, error) {
+	str := s.newClientStream(ContextClientTrace(ctx), true)
+	if str == nil {
+		return nil, nil, s.sessionError("cannot create a stream for " + header.Get(HEADER_METHOD))
+	}
+	rs := newResponseStreamer(nil)
+	str.response_writer = rs
+
+	f := frameSynStream{session: s, stream: str.id, header: header, flags: FLAG_NONE}
+	debug.Println("Sending SYN_STREAM:", f)
+	if !s.sendSynStream(f) {
+		return nil, nil, s.sessionError("session closed before the tunnel")
+	}
+
+	// the read side of the tunnel ends with the stream
+	done := make(chan error, 1)
+	go func() {
+		<-str.eos
+		var err error
+		if closeErr := str.closeError(); !str.finished.Load() && closeErr != nil {
+			err = closeErr
+		}
+		rs.finish(err)
+		done <- err
+	}()
+
+	select {
+	case <-rs.ready:
+		if rs.res.StatusCode != status {
+			str.sendRstStream(RST_CANCEL)
+			str.finish_stream()
+			return nil, rs.res, errors.New(fmt.Sprintf("spdy: %s %s failed: %s", header.Get(HEADER_METHOD), header.Get(HEADER_PATH), rs.res.Status))
+		}
+		return &streamConn{stream: str, body: rs.res.Body}, rs.res, nil
+	case err := <-done:
+		if err == nil {
+			err = &StreamError{StreamID: uint32(str.id), Reason: "closed without a reply"}
+		}
+		return nil, nil, err
+	case <-ctx.Done():
+		str.sendRstStream(RST_CANCEL)
+		str.finish_stream()
+		return nil, nil, ctx.Err()
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Server push, as per SPDY/3: pushed streams are started by the server
+// with a unidirectional SYN_STREAM associated to the stream of a request,
+// naming the resource, and get their reply in a HEADERS frame
+
+package spdy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPushLimit is the error of the pushes over the limits of the session:
+// of the pushed streams open at once, of the pushes along with a request,
+// or of the streams the client takes at once
+var ErrPushLimit = errors.New("spdy: push over the limits of the session")
+
+// ErrPushed is the error of the pushes of GET requests for resources
+// pushed on the session already, as per its PushCache
+var ErrPushed = errors.New("spdy: resource pushed on the session already")
+
+// the headers of a request copied to the requests of its pushes
+var pushedRequestHeaders = []string{"Accept-Encoding", "Accept-Language", "Authorization", "Cache-Control", "Cookie", "User-Agent"}
+
+// Push makes streams compatible with the net/http Pusher interface, for
+// handlers to push the resource at target, an absolute path or a URL of
+// the same origin, along with their reply. The pushed request is served
+// by the Handler of the session, with the method of the options, GET or
+// HEAD, and their headers. Pushed streams cannot push. A push reset by
+// the client, with CANCEL or REFUSED_STREAM, is stopped: the writes of its
+// handler fail, its data not sent is dropped, and the context of its
+// request is done.
+func (s *Stream) Push(target string, opts *http.PushOptions) error {
+	method := "GET"
+	var header http.Header
+	if opts != nil {
+		if opts.Method != "" {
+			method = opts.Method
+		}
+		header = opts.Header
+	}
+	if method != "GET" && method != "HEAD" {
+		return errors.New("spdy: push with method " + method)
+	}
+	return s.push(target, method, header)
+}
+
+// push starts a pushed stream for the resource at target along with the
+// stream of a handler, and serves it with the Handler of the session as a
+// request with the given method and header
+func (s *Stream) push(target, method string, header http.Header) error {
+	if s.request == nil || s.associated_stream != 0 {
+		return errors.New("spdy: push from a stream other than a request")
+	}
+	if s.closed.Load() || s.wroteFIN.Load() {
+		return s.writeError("push after the end of the reply")
+	}
+	if s.session.goingAway() {
+		return s.session.sessionError("push on a session going away")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	scheme := s.request.Header.Get(HEADER_SCHEME)
+	host := s.request.Host
+	if u.IsAbs() {
+		if u.Scheme != scheme || u.Host != host {
+			return errors.New("spdy: push of " + target + " from another origin")
+		}
+	} else if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return errors.New("spdy: push of " + target + " not an absolute path")
+	}
+
+	if !s.session.reservePush(s) {
+		return ErrPushLimit
+	}
+	if method == "GET" && s.session.pushCache.Pushed(s.session, scheme+"://"+host+u.RequestURI()) {
+		s.session.releasePush(s)
+		return ErrPushed
+	}
+	str := s.session.newPushStream(s)
+	if str == nil {
+		s.session.releasePush(s)
+		return s.session.sessionError("cannot create a stream for a push")
+	}
+	// the SYN_STREAM names the resource only
+	resource := make(http.Header)
+	resource.Set(HEADER_SCHEME, scheme)
+	resource.Set(HEADER_HOST, host)
+	resource.Set(HEADER_PATH, u.RequestURI())
+	str.requestHeader = resource
+	f := frameSynStream{session: s.session, stream: str.id, associated_stream: s.id, priority: str.priority, header: resource, flags: FLAG_UNIDIRECTIONAL}
+	debug.Println("Sending SYN_STREAM of push:", f)
+	if !s.session.sendSynStream(f) {
+		return s.session.sessionError("session closed before the push")
+	}
+
+	h := make(http.Header)
+	for name, values := range header {
+		h[http.CanonicalHeaderKey(name)] = values
+	}
+	for name, values := range resource {
+		h[name] = values
+	}
+	h.Set(HEADER_METHOD, method)
+	h.Set(HEADER_VERSION, "HTTP/1.1")
+	req := str.newRequest(h)
+	str.request = req
+	go str.requestHandler(req)
+	return nil
+}
+
+// Pushed records the URL as pushed on the session of the cache
+func (c *sessionPushCache) Pushed(s *Session, url string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.urls[url] {
+		return true
+	}
+	c.urls[url] = true
+	return false
+}
+
+// Forget does nothing, as the cache goes along with its session
+func (c *sessionPushCache) Forget(s *Session) {}
+
+// reservePush counts a push along with the stream of a request, if within
+// the limits of the session and of the client. The pushes, reserved or
+// open, are the streams of the server the client limits
+func (s *Session) reservePush(parent *Stream) bool {
+	if atomic.AddInt32(&parent.pushes, 1) > s.maxPushesPerRequest {
+		atomic.AddInt32(&parent.pushes, -1)
+		return false
+	}
+	if pushes := atomic.AddInt32(&s.activePushes, 1); pushes > s.maxConcurrentPushes || !s.peerAllows(int(pushes)) {
+		s.releasePush(parent)
+		return false
+	}
+	return true
+}
+
+// releasePush gives back a push counted with reservePush that did not
+// start
+func (s *Session) releasePush(parent *Stream) {
+	atomic.AddInt32(&parent.pushes, -1)
+	atomic.AddInt32(&s.activePushes, -1)
+}
+
+// newPushStream starts a stream of the server, to push a resource along
+// with the stream of a request, or returns nil if it cannot
+func (s *Session) newPushStream(parent *Stream) *Stream {
+	id := s.nextStreamID()
+	if id > MAX_STREAM_ID {
+		s.logger().Warn("no stream IDs left for pushes")
+		return nil
+	}
+	str := &Stream{
+		id:                id,
+		session:           s,
+		priority:          parent.priority,
+		associated_stream: parent.id,
+		headers:           make(http.Header),
+		control:           make(chan controlFrame),
+		data:              make(chan dataFrame),
+		response:          make(chan bool),
+		eos:               make(chan bool),
+		stop_server:       make(chan bool),
+		flow_req:          make(chan int32, 1),
+		flow_add:          make(chan int32, 1),
+		flow_done:         make(chan struct{}),
+		rate:              newRateLimiter(s.streamRate),
+		recvWindow:        s.receiveWindowLimit(),
+		started:           time.Now(),
+	}
+	// the push goes on after the stream of the request is done
+	str.ctx, str.cancel = context.WithCancel(context.WithValue(s.ctx, streamKey{}, str))
+
+	go str.serve()
+
+	// known to the sender before its SYN_STREAM, for its state
+	s.counted.Store(str.id, str)
+	select {
+	case s.new_stream <- str:
+		go str.flowManager(s.initialSendWindow(), str.flow_add, str.flow_req)
+		return str
+	case <-time.After(1500 * time.Millisecond):
+		debug.Printf("Stream #%d: cannot be created for a push", str.id)
+		s.counted.Delete(str.id)
+		s.synDone(str.id)
+		str.cancel()
+		return nil
+	}
+}
+
+// pushPreloads pushes the resources in the Link headers with rel=preload
+// of the reply of the stream, unless marked nopush
+func (s *Stream) pushPreloads() {
+	header := make(http.Header)
+	for _, name := range pushedRequestHeaders {
+		if values, ok := s.request.Header[name]; ok {
+			header[name] = values
+		}
+	}
+	for _, target := range preloads(s.headers["Link"]) {
+		if err := s.push(target, "GET", header); err != nil && err != ErrPushed {
+			s.logger().Warn("cannot push preload", "target", target, "err", err)
+		}
+	}
+}
+
+// preloads returns the targets of the links with rel=preload, and without
+// nopush, in the values of Link headers
+func preloads(links []string) (targets []string) {
+	for _, value := range links {
+		for _, link := range strings.Split(value, ",") {
+			params := strings.Split(link, ";")
+			target := strings.TrimSpace(params[0])
+			if len(target) < 2 || target[0] != '<' || target[len(target)-1] != '>' {
+				continue
+			}
+			preload, nopush := false, false
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "rel":
+					for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+						preload = preload || strings.EqualFold(rel, "preload")
+					}
+				case "nopush":
+					nopush = true
+				}
+			}
+			if preload && !nopush {
+				targets = append(targets, target[1:len(target)-1])
+			}
+		}
+	}
+	return
+}
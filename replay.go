@@ -0,0 +1,158 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Recording of sessions, and replay of the recorded server sessions
+
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Capture creates the capture file of a new session in the directory of
+// the Recorder, which is closed once the session is done. It returns nil,
+// so the session is not recorded, if the file cannot be created
+func (r *Recorder) Capture(s *Session) *FrameCapture {
+	r.mu.Lock()
+	r.seq++
+	name := fmt.Sprintf("session-%s-%d.cap", time.Now().Format("20060102-150405"), r.seq)
+	r.mu.Unlock()
+	f, err := os.Create(filepath.Join(r.Dir, name))
+	if err != nil {
+		s.logger().Error("cannot record session", "err", err)
+		return nil
+	}
+	rf := &recordFile{f: f}
+	go func() {
+		<-s.ctx.Done()
+		rf.close()
+	}()
+	return &FrameCapture{Binary: rf}
+}
+
+func (rf *recordFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.closed {
+		return len(p), nil
+	}
+	return rf.f.Write(p)
+}
+
+func (rf *recordFile) close() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.closed = true
+	rf.f.Close()
+}
+
+// Replay feeds the frames received in a binary capture of a server
+// session to a new server session, and waits for its streams to be done.
+// The frames sent in the capture are skipped, as the new session sends
+// its own. It returns the error the session failed with, if any
+func (r *Replayer) Replay(capture io.Reader) (err error) {
+	handler := r.Handler
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+	cn, sn := net.Pipe()
+	defer cn.Close()
+	ss := NewServerSession(sn, &http.Server{Handler: handler})
+	ss.SetFrameCapture(r.Capture)
+	served := make(chan error, 1)
+	go func() {
+		served <- ss.Serve()
+	}()
+
+	// the frames of the session are read for it not to block, until the
+	// PING after the replayed frames comes back
+	replied := make(chan bool)
+	go func() {
+		framer := NewFramer(cn)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if ping, ok := f.(*PingFrame); ok && ping.ID == REPLAY_PING_ID {
+				close(replied)
+			}
+		}
+	}()
+
+	err = r.feed(cn, NewCaptureReader(capture))
+	if err != nil {
+		ss.Close()
+		<-served
+		return
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_REPLAY_TIMEOUT
+	}
+	deadline := time.After(timeout)
+	select {
+	case <-replied:
+	case err = <-served:
+		return
+	case <-deadline:
+		ss.Close()
+		<-served
+		return errors.New("spdy: replayed session did not answer")
+	}
+	for ss.NumActiveStreams() > 0 {
+		select {
+		case err = <-served:
+			return
+		case <-deadline:
+			ss.Close()
+			<-served
+			return errors.New(fmt.Sprintf("spdy: %d replayed streams not done", ss.NumActiveStreams()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	ss.Close()
+	return <-served
+}
+
+// feed writes the received frames of a capture to the connection of a
+// session, followed by a PING. Frames that cannot be decoded are written
+// all the same, as they may be what is to be reproduced
+func (r *Replayer) feed(conn net.Conn, cr *CaptureReader) error {
+	var last time.Time
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if cf == nil {
+			return err
+		}
+		if cf.Sent {
+			continue
+		}
+		if r.Timing && !last.IsZero() {
+			time.Sleep(cf.Time.Sub(last))
+		}
+		last = cf.Time
+		_, err = conn.Write(cf.Wire)
+		if err != nil {
+			// the session is done, as it was in the capture maybe
+			return nil
+		}
+	}
+	ping, err := (&PingFrame{ID: REPLAY_PING_ID}).Marshal()
+	if err != nil {
+		return err
+	}
+	conn.Write(ping)
+	return nil
+}
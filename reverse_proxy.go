@@ -0,0 +1,44 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Reverse proxy from SPDY to HTTP backends
+
+package spdy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// NewReverseProxy returns an httputil.ReverseProxy, to be used as the
+// Handler of a Server, that forwards the requests of SPDY streams to the
+// given target, keeping the Host of the request, like
+// httputil.NewSingleHostReverseProxy does. The backend is reached with
+// the Transport of the proxy, http.DefaultTransport if nil, so it can be
+// HTTP/1.1, or HTTP/2 over TLS. Bodies are streamed both ways, with each
+// write of the backend flushed to the stream right away, and a stream
+// reset by the client cancels the context of the request to the backend.
+func NewReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			stripSpdyHeaders(r.Out.Header)
+			r.SetURL(target)
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		FlushInterval: -1,
+	}
+}
+
+// stripSpdyHeaders removes the SPDY headers, like :method and :host, from
+// a request to be forwarded, as they are not for the server it goes to
+func stripSpdyHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, ":") {
+			delete(h, name)
+		}
+	}
+}
@@ -7,29 +7,167 @@
 package spdy
 
 import (
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"errors"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-func (c *conn) handleConnection(outchan chan *Session) {
+// ErrSessionLimit is the error of the connections closed as their client
+// has MaxSessionsPerIP sessions served already
+var ErrSessionLimit = errors.New("spdy: over the sessions per client of the server")
+
+// newSession creates a server Session on the given connection,
+// configured with the options of the server and the given
+// settings for the session, if any
+func (srv *Server) newSession(cn net.Conn, config *SessionConfig) *Session {
+	if config == nil {
+		config = &SessionConfig{}
+	}
 	hserve := new(http.Server)
-	if c.srv.Handler == nil {
+	if config.Handler != nil {
+		hserve.Handler = config.Handler
+	} else if srv.Handler == nil {
 		hserve.Handler = http.DefaultServeMux
 	} else {
-		hserve.Handler = c.srv.Handler
+		hserve.Handler = srv.Handler
+	}
+	hserve.Addr = srv.Addr
+	hserve.MaxHeaderBytes = srv.MaxHeaderBytes
+	ss := NewServerSession(cn, hserve)
+	ss.tag = config.Tag
+	if srv.MaxFrameBytes > 0 {
+		ss.maxFrameBytes = srv.MaxFrameBytes
+	}
+	ss.strictFrames = srv.StrictFrames
+	ss.connState = srv.ConnState
+	ss.onStream = srv.OnStream
+	ss.pushPreloads = srv.PushPreloads
+	if srv.MaxConcurrentPushes > 0 {
+		ss.maxConcurrentPushes = int32(srv.MaxConcurrentPushes)
+	}
+	if srv.MaxPushesPerRequest > 0 {
+		ss.maxPushesPerRequest = int32(srv.MaxPushesPerRequest)
+	}
+	if srv.PushCache != nil {
+		ss.pushCache = srv.PushCache
+	}
+	ss.slogger = srv.Logger
+	ss.pingInterval = srv.PingInterval
+	if config.MaxConcurrentStreams > 0 {
+		ss.maxConcurrentStreams = config.MaxConcurrentStreams
+	} else if srv.MaxConcurrentStreams > 0 {
+		ss.maxConcurrentStreams = srv.MaxConcurrentStreams
+	}
+	ss.initialWindowSize = srv.InitialWindowSize
+	ss.budget.max = srv.MaxBufferedBytes
+	ss.rate = newRateLimiter(srv.SessionRateLimit)
+	ss.streamRate = srv.StreamRateLimit
+	ss.writeDelay = srv.WriteBufferDelay
+	ss.writeBufferSize = srv.WriteBufferSize
+	if ss.writeBufferSize == 0 {
+		ss.writeBufferSize = COALESCE_DATA_BYTES
+	}
+	if level := compressionLevel(srv.HeaderCompressionLevel, srv.NoHeaderCompression); level != zlib.BestCompression {
+		ss.setHeaderCompression(level)
+	}
+	if srv.HeaderDictionary != nil {
+		ss.SetHeaderDictionary(srv.HeaderDictionary)
+	}
+	if config.InitialWindowSize > 0 {
+		ss.initialWindowSize = config.InitialWindowSize
+	}
+	if srv.FrameCapture != nil {
+		ss.SetFrameCapture(srv.FrameCapture(ss))
+	}
+	if srv.Events != nil {
+		ss.SetEvents(srv.Events(ss))
+	}
+	return ss
+}
+
+// logger returns the logger for the messages of the server
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return defaultLogger(nil)
+}
+
+// sessionConfig calls the OnNewSession hook of the server, if any,
+// for the connection, completing the TLS handshake first
+func (srv *Server) sessionConfig(cn net.Conn) (*SessionConfig, error) {
+	if srv.OnNewSession == nil {
+		return nil, nil
+	}
+	var state *tls.ConnectionState
+	if tc, ok := cn.(*tls.Conn); ok {
+		err := tc.Handshake()
+		if err != nil {
+			return nil, err
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+	return srv.OnNewSession(cn, state)
+}
+
+// how often Shutdown checks for sessions to become idle
+const SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+
+func (c *conn) handleConnection(outchan chan *Session) error {
+	client, ok := c.srv.acquireClient(c.cn)
+	if !ok {
+		c.srv.logger().Warn("connection over the sessions of its client", "client", client, "max", c.srv.MaxSessionsPerIP)
+		c.cn.Close()
+		return ErrSessionLimit
 	}
-	hserve.Addr = c.srv.Addr
-	c.ss = NewServerSession(c.cn, hserve)
+	defer c.srv.releaseClient(client)
+	config, err := c.srv.sessionConfig(c.cn)
+	if err != nil {
+		debug.Printf("Connection from %s rejected: %s", c.cn.RemoteAddr(), err)
+		c.cn.Close()
+		return err
+	}
+	c.ss = c.srv.newSession(c.cn, config)
+	c.srv.trackSession(c.ss, true)
+	defer c.srv.trackSession(c.ss, false)
+	c.ss.setState(SESSION_NEW)
 	if outchan != nil {
 		outchan <- c.ss
 	}
-	c.ss.Serve()
+	return c.ss.Serve()
+}
+
+// ServeConn serves a SPDY session on a connection where both ends already
+// agree on the protocol, with prior knowledge, like the links of a service
+// mesh or a tunnel: no protocol is negotiated, even on TLS connections.
+// It returns once the session is done, with its error.
+func (srv *Server) ServeConn(c net.Conn) error {
+	cn, err := srv.newConn(c)
+	if err != nil {
+		return err
+	}
+	return cn.handleConnection(srv.ss_chan)
+}
+
+// ServeConn serves a SPDY session with prior knowledge on the connection,
+// calling handler to reply to the requests, or http.DefaultServeMux if
+// nil. It returns once the session is done, with its error.
+func ServeConn(c net.Conn, handler http.Handler) error {
+	server := &Server{Handler: handler}
+	return server.ServeConn(c)
 }
 
 // ListenAndServe listens on the TCP network address s.Addr and then
-// calls Serve to handle requests on incoming connections.
+// calls Serve to handle requests on incoming connections. The sessions
+// are plaintext SPDY, without TLS or protocol negotiation, and the
+// TLSConfig of the server is not used.
 func (s *Server) ListenAndServe() (err error) {
 	if s.Addr == "" {
 		s.Addr = ":http"
@@ -41,15 +179,30 @@ func (s *Server) ListenAndServe() (err error) {
 	return s.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
 }
 
+// ListenAndServeUnix listens on the unix domain socket at path and then
+// calls Serve to handle requests on incoming connections. The socket file
+// is removed when the listener is closed.
+func (s *Server) ListenAndServeUnix(path string) (err error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
 // Serve accepts incoming connections on the Listener l, creating a
 // new service goroutine for each.  The service goroutines read requests and
-// then call srv.Handler to reply to them.
+// then call srv.Handler to reply to them. Any listener can be used, like
+// one from socket activation or a custom TLS one. Serve always returns a
+// non-nil error, http.ErrServerClosed after Close or Shutdown.
 func (s *Server) Serve(ln net.Listener) (err error) {
+	s.mu.Lock()
 	s.ln = ln
-	defer s.ln.Close()
+	s.mu.Unlock()
+	defer ln.Close()
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		rw, err := s.ln.Accept()
+		rw, err := ln.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -60,10 +213,13 @@ func (s *Server) Serve(ln net.Listener) (err error) {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("http: Accept error: %v; retrying in %v", err, tempDelay)
+				s.logger().Warn("accept error", "err", err, "retry", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
+			if atomic.LoadInt32(&s.closed) == 1 {
+				return http.ErrServerClosed
+			}
 			return err
 		}
 		tempDelay = 0
@@ -75,14 +231,155 @@ func (s *Server) Serve(ln net.Listener) (err error) {
 	}
 }
 
-//close spdy server and return
+// close spdy server and return
 // Any blocked Accept operations will be unblocked and return errors.
 func (s *Server) Close() (err error) {
-	return s.ln.Close()
+	atomic.StoreInt32(&s.closed, 1)
+	ln, hs := s.listeners()
+	if hs != nil {
+		return hs.Close()
+	}
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
+}
+
+// listeners returns the listener of Serve and the http.Server of
+// ListenAndServeTLS, if serving
+func (s *Server) listeners() (net.Listener, *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ln, s.hs
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting new
+// connections, sends a GOAWAY on all sessions and waits for their active
+// streams to finish before closing them. If the context expires first,
+// the remaining sessions are closed anyway and the context error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closed, 1)
+	// stop accepting connections
+	ln, hs := s.listeners()
+	if hs != nil {
+		// it waits for the SPDY sessions too, as they are active
+		go hs.Shutdown(ctx)
+	} else if ln != nil {
+		ln.Close()
+	}
+
+	for _, ss := range s.activeSessions() {
+		ss.goAway(GOAWAY_OK)
+	}
+
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		sessions := s.activeSessions()
+		if len(sessions) == 0 {
+			return nil
+		}
+		idle := true
+		for _, ss := range sessions {
+			if ss.NumActiveStreams() > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			// they go away once their Serve is done
+			s.closeSessions()
+		}
+		select {
+		case <-ctx.Done():
+			s.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// add or remove a session from the ones being served
+func (s *Server) trackSession(ss *Session, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[*Session]bool)
+	}
+	if add {
+		s.sessions[ss] = true
+	} else {
+		delete(s.sessions, ss)
+	}
+}
+
+// acquireClient counts a session of the client of a connection, if within
+// the MaxSessionsPerIP of the server, returning the client
+func (s *Server) acquireClient(c net.Conn) (client string, ok bool) {
+	if s.MaxSessionsPerIP <= 0 {
+		return "", true
+	}
+	if s.ClientKey != nil {
+		client = s.ClientKey(c)
+	} else if addr := c.RemoteAddr(); addr != nil {
+		client = addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	if client == "" {
+		return "", true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[client] >= s.MaxSessionsPerIP {
+		return client, false
+	}
+	if s.clients == nil {
+		s.clients = make(map[string]int)
+	}
+	s.clients[client]++
+	return client, true
+}
+
+// releaseClient gives back a session counted with acquireClient
+func (s *Server) releaseClient(client string) {
+	if client == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[client]--; s.clients[client] <= 0 {
+		delete(s.clients, client)
+	}
+}
+
+// returns the sessions being served
+func (s *Server) activeSessions() (list []*Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ss := range s.sessions {
+		list = append(list, ss)
+	}
+	return
+}
+
+// closes all the sessions being served
+func (s *Server) closeSessions() {
+	for _, ss := range s.activeSessions() {
+		ss.Close()
+	}
 }
 
 // Create new connection from rw
 func (server *Server) newConn(rwc net.Conn) (c *conn, err error) {
+	err = server.SocketOptions.apply(rwc)
+	if err != nil {
+		server.logger().Error("cannot set socket options", "err", err)
+		rwc.Close()
+		return nil, err
+	}
 	c = &conn{
 		srv: server,
 		cn:  rwc,
@@ -94,7 +391,8 @@ func (server *Server) newConn(rwc net.Conn) (c *conn, err error) {
 // and then calls Serve with handler to handle requests
 // on incoming connections.  Handler is typically nil,
 // in which case the DefaultServeMux is used. This creates a spdy
-// only server without TLS
+// only server without TLS: clients must speak plaintext SPDY, as
+// the ones from NewClient do
 //
 // A trivial example server is:
 //
@@ -128,7 +426,7 @@ func ListenAndServe(addr string, handler http.Handler) (err error) {
 }
 
 // ListenAndServeTLS acts identically to ListenAndServe, except that it
-// expects HTTPS connections. Servers created this way have NPN Negotiation and
+// expects HTTPS connections. Servers created this way negotiate the protocol (ALPN) and
 // accept requests from both spdy and http clients.
 // Additionally, files containing a certificate and matching private
 // key for the server must be provided. If the certificate is signed by a certificate
@@ -159,26 +457,176 @@ func ListenAndServe(addr string, handler http.Handler) (err error) {
 //
 // One can use makecert.sh in /certs to generate certfile and keyfile
 func ListenAndServeTLS(addr string, certFile string, keyFile string, handler http.Handler) error {
-	server := &http.Server{
+	server := &Server{
 		Addr:    addr,
 		Handler: handler,
-		TLSConfig: &tls.Config{
-			NextProtos: []string{"spdy/3.1", "spdy/3"},
-		},
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeTLS listens on the TCP network address srv.Addr and then
+// handles requests on incoming TLS connections. The SPDY protocol is
+// negotiated with ALPN: clients asking for spdy/3.1 or spdy/3 get a SPDY
+// Session, and the rest are served HTTP/2 or HTTP/1.1 by net/http, with
+// the same Handler. Clients asking for both h2 and SPDY get h2.
+//
+// Filenames containing a certificate and matching private key for
+// the server must be provided. If the certificate is signed by a
+// certificate authority, the certFile should be the concatenation
+// of the server's certificate followed by the CA's certificate.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if config.NextProtos == nil {
+		config.NextProtos = []string{"h2", "spdy/3.1", "spdy/3", "http/1.1"}
+	}
+	hs := &http.Server{
+		Addr:           srv.Addr,
+		Handler:        srv.Handler,
+		TLSConfig:      config,
+		MaxHeaderBytes: srv.MaxHeaderBytes,
 		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
-			"spdy/3.1": nextproto3,
-			"spdy/3":   nextproto3,
+			"spdy/3.1": srv.nextProto,
+			"spdy/3":   srv.nextProto,
 		},
+		// HTTP/2 is off by default with a TLSNextProto without h2
+		Protocols: httpProtocols(true),
 	}
-	if server.Handler == nil {
-		server.Handler = http.DefaultServeMux
+	srv.mu.Lock()
+	srv.hs = hs
+	srv.mu.Unlock()
+	return hs.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ConfigureServer configures an existing http.Server to serve SPDY on its
+// TLS connections, besides HTTPS, through its TLSNextProto. The SPDY
+// sessions share the Handler of hs, as well as its MaxHeaderBytes,
+// WriteTimeout, IdleTimeout, ErrorLog and ConnState hook. HTTP/2 is kept
+// on, unless disabled in hs already, and preferred over SPDY for the
+// clients asking for both, so the same Handler and port serve legacy SPDY
+// clients and HTTP/2 ones alike. The Shutdown of hs sends a GOAWAY on the
+// SPDY sessions and closes them once their active streams are done. It
+// must be called before the server starts serving.
+func ConfigureServer(hs *http.Server) error {
+	if hs.TLSConfig == nil {
+		hs.TLSConfig = &tls.Config{}
 	}
-	return server.ListenAndServeTLS(certFile, keyFile)
+	_, h2 := hs.TLSNextProto["h2"]
+	if hs.Protocols == nil {
+		h2 = h2 || hs.TLSNextProto == nil
+		hs.Protocols = httpProtocols(h2)
+	} else {
+		h2 = h2 || hs.Protocols.HTTP2()
+	}
+	if hs.TLSConfig.NextProtos == nil {
+		// keep serving HTTPS to the rest
+		hs.TLSConfig.NextProtos = []string{"http/1.1"}
+		if h2 {
+			hs.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	var protos []string
+	for _, proto := range hs.TLSConfig.NextProtos {
+		if proto == "spdy/3.1" || proto == "spdy/3" {
+			return errors.New("spdy: server already configured for " + proto)
+		}
+		if proto == "h2" {
+			protos = append(protos, proto)
+		}
+	}
+	// after h2, if any, and before the rest
+	protos = append(protos, "spdy/3.1", "spdy/3")
+	for _, proto := range hs.TLSConfig.NextProtos {
+		if proto != "h2" {
+			protos = append(protos, proto)
+		}
+	}
+	hs.TLSConfig.NextProtos = protos
+	if hs.TLSNextProto == nil {
+		hs.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	sessions := &nextProtoSessions{sessions: make(map[*Session]bool)}
+	for _, proto := range []string{"spdy/3.1", "spdy/3"} {
+		hs.TLSNextProto[proto] = sessions.serve
+	}
+	// net/http does not know when the sessions are idle, they are to go
+	// away on their own
+	hs.RegisterOnShutdown(sessions.shutdown)
+	return nil
+}
+
+// httpProtocols returns the protocols served by net/http next to SPDY:
+// HTTP/1.1, and HTTP/2 if h2 is set
+func httpProtocols(h2 bool) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(h2)
+	return p
 }
 
-func nextproto3(s *http.Server, c *tls.Conn, h http.Handler) {
-	server_session := NewServerSession(c, s)
-	server_session.Serve()
+// serve serves a connection of an http.Server that negotiated SPDY
+func (n *nextProtoSessions) serve(hs *http.Server, c *tls.Conn, h http.Handler) {
+	ss := NewServerSession(c, hs)
+	if hs.ConnState != nil {
+		// the http.Server reports the connection as new and closed itself
+		ss.connState = func(ss *Session, state SessionState) {
+			switch state {
+			case SESSION_ACTIVE:
+				hs.ConnState(c, http.StateActive)
+			case SESSION_IDLE:
+				hs.ConnState(c, http.StateIdle)
+			}
+		}
+	}
+	n.mu.Lock()
+	shuttingDown := n.shuttingDown
+	n.sessions[ss] = true
+	n.mu.Unlock()
+	if shuttingDown {
+		go ss.drain()
+	}
+	ss.Serve()
+	n.mu.Lock()
+	delete(n.sessions, ss)
+	n.mu.Unlock()
+}
+
+// shutdown sends a GOAWAY on the sessions, closing each once its active
+// streams are done, as the http.Server is shut down
+func (n *nextProtoSessions) shutdown() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.shuttingDown = true
+	for ss := range n.sessions {
+		go ss.drain()
+	}
+}
+
+// drain sends a GOAWAY on the session and closes it once its active
+// streams are done, unless it is closed before
+func (s *Session) drain() {
+	s.goAway(GOAWAY_OK)
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for s.NumActiveStreams() > 0 {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	s.Close()
+}
+
+// nextProto serves a TLS connection that negotiated SPDY
+func (srv *Server) nextProto(hs *http.Server, c *tls.Conn, h http.Handler) {
+	cn, err := srv.newConn(c)
+	if err != nil {
+		return
+	}
+	cn.handleConnection(srv.ss_chan)
 }
 
 func ListenAndServeTLSSpdyOnly(addr string, certFile string, keyFile string, handler http.Handler) error {
@@ -204,7 +652,7 @@ func (srv *Server) ListenAndServeTLSSpdyOnly(certFile, keyFile string) error {
 	}
 	config := &tls.Config{}
 	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+		config = srv.TLSConfig.Clone()
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"spdy/3.1", "spdy/3"}
@@ -7,14 +7,30 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -189,3 +205,2841 @@ func TestTLSServerSpdyOnly(t *testing.T) {
 	server.Close()
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestTLSServerNegotiation(t *testing.T) {
+	//make server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	go server.ListenAndServeTLS(SERVER_CERTFILE, SERVER_KEYFILE)
+	time.Sleep(400 * time.Millisecond)
+
+	//spdy client
+	config := tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	conn, err := tls.Dial("tcp", "127.0.0.1:4040", &config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.ConnectionState().NegotiatedProtocol != "spdy/3.1" {
+		t.Fatal("spdy/3.1 was not negotiated")
+	}
+	client, err := NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data")
+	}
+	res.Body.Close()
+	client.Close()
+
+	//plain https client
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err = https.Get("https://127.0.0.1:4040/monkeys")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err = ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love monkeys!" {
+		t.Fatal("Unexpected Data")
+	}
+	res.Body.Close()
+
+	//HTTP/2 client
+	h2 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	res, err = h2.Get("https://127.0.0.1:4040/monkeys")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err = ioutil.ReadAll(res.Body)
+	if res.ProtoMajor != 2 || string(data) != "Hi there, I love monkeys!" {
+		t.Fatal("Unexpected HTTP/2 response:", res.Proto, string(data))
+	}
+	res.Body.Close()
+
+	//server close
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestConfigureServer(t *testing.T) {
+	//make an http server serving spdy too
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		ServerHandler(w, r)
+	})
+	server := &http.Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	err := ConfigureServer(server)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ConfigureServer(server) == nil {
+		t.Fatal("Server configured twice")
+	}
+	go server.ListenAndServeTLS(SERVER_CERTFILE, SERVER_KEYFILE)
+	time.Sleep(400 * time.Millisecond)
+
+	config := tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3"}}
+	conn, err := tls.Dial("tcp", "127.0.0.1:4040", &config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client, err := NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data")
+	}
+	res.Body.Close()
+	client.Close()
+
+	//HTTP/2 clients on the same port, also preferred to SPDY
+	config = tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1", "h2"}}
+	conn, err = tls.Dial("tcp", "127.0.0.1:4040", &config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		t.Fatal("h2 was not negotiated:", conn.ConnectionState().NegotiatedProtocol)
+	}
+	conn.Close()
+	h2 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	res, err = h2.Get("https://127.0.0.1:4040/monkeys")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err = ioutil.ReadAll(res.Body)
+	if res.ProtoMajor != 2 || string(data) != "Hi there, I love monkeys!" {
+		t.Fatal("Unexpected HTTP/2 response:", res.Proto, string(data))
+	}
+	res.Body.Close()
+
+	//the shutdown sends a GOAWAY to the spdy sessions, waiting for their
+	//active requests
+	config = tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3"}}
+	conn, err = tls.Dial("tcp", "127.0.0.1:4040", &config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client, err = NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://localhost:4040/slow", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			done <- err
+			return
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		if string(data) != "Hi there, I love slow!" {
+			err = errors.New("Unexpected Data: " + string(data))
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Fatal("Shutdown not done with the spdy sessions:", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestShutdown(t *testing.T) {
+	//make server with a slow handler
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		ServerHandler(w, r)
+	})
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := NewClient("localhost:4040")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			done <- err
+			return
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		if string(data) != "Hi there, I love banana!" {
+			done <- errors.New("Unexpected Data")
+			return
+		}
+		done <- nil
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	//the active request must finish before the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(server.activeSessions()) != 0 {
+		t.Fatal("Sessions left after shutdown")
+	}
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestConnState(t *testing.T) {
+	states := make(chan SessionState, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+		ConnState: func(ss *Session, state SessionState) {
+			states <- state
+		},
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := NewClient("localhost:4040")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+
+	expected := []SessionState{SESSION_NEW, SESSION_ACTIVE, SESSION_IDLE, SESSION_CLOSED}
+	for _, e := range expected {
+		select {
+		case state := <-states:
+			if state != e {
+				t.Fatal("Unexpected session state", state, "instead of", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Session state", e, "not reported")
+		}
+	}
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestOnNewSession(t *testing.T) {
+	var reject atomic.Bool
+	reject.Store(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+		OnNewSession: func(c net.Conn, state *tls.ConnectionState) (*SessionConfig, error) {
+			if state != nil {
+				return nil, errors.New("unexpected TLS state")
+			}
+			if reject.Load() {
+				return nil, errors.New("rejected")
+			}
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "Hi %s", ContextStream(r.Context()).Session().Tag())
+			}
+			return &SessionConfig{Handler: http.HandlerFunc(handler), Tag: "tenant"}, nil
+		},
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	//rejected connections are closed right away
+	conn, err := net.Dial("tcp", "localhost:4040")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("Connection not rejected:", err)
+	}
+	conn.Close()
+
+	//accepted connections use the handler of the session
+	reject.Store(false)
+	client, err := NewClient("localhost:4040")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi tenant" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	client.Close()
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTrailers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		ServerHandler(w, r)
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	})
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := NewClient("localhost:4040")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" || res.Trailer.Get("X-Late") != "yes" {
+		t.Fatal("Unexpected trailers:", res.Trailer)
+	}
+	if res.Header.Get("X-Checksum") != "" {
+		t.Fatal("Trailer sent in the headers")
+	}
+	client.Close()
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// a listener handing out the server ends of in-memory connections
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+func (l *pipeListener) Dial() net.Conn {
+	cn, sn := net.Pipe()
+	l.conns <- sn
+	return cn
+}
+
+// DialContext dials the listener, as the DialContext of a Transport
+func (l *pipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return l.Dial(), nil
+}
+
+// newPipeListener returns a listener of the connections made with its Dial
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan bool)}
+}
+
+// servePipe serves the server on a pipeListener until the test is done
+func servePipe(t testing.TB, server *Server) *pipeListener {
+	ln := newPipeListener()
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln
+}
+
+// newPipeServer serves the server on a pipeListener until the test is
+// done, returning a client with a Transport dialing it
+func newPipeServer(t testing.TB, server *Server) (*http.Client, *Transport) {
+	transport := &Transport{DialContext: servePipe(t, server).DialContext}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}, transport
+}
+
+func TestServeListener(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux}
+	ln := newPipeListener()
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost:4040/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	client.Close()
+
+	server.Close()
+	if err = <-served; err != http.ErrServerClosed {
+		t.Fatal("Unexpected error from Serve:", err)
+	}
+}
+
+func TestMaxSessionsPerIP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux, MaxSessionsPerIP: 1}
+	get := func(c net.Conn) error {
+		client, err := NewClientConn(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		if string(data) != "Hi there, I love banana!" {
+			return errors.New("unexpected data: " + string(data))
+		}
+		return nil
+	}
+
+	// pipes are all of the same client
+	cn, sn := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeConn(sn)
+	}()
+	client, err := NewClientConn(cn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	//connections over the limit are closed right away
+	cn2, sn2 := net.Pipe()
+	if err = server.ServeConn(sn2); err != ErrSessionLimit {
+		t.Fatal("Connection not refused:", err)
+	}
+	if _, err = cn2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Connection not closed:", err)
+	}
+
+	//the session is counted until it is done
+	client.Close()
+	<-served
+	cn2, sn2 = net.Pipe()
+	go server.ServeConn(sn2)
+	if err = get(cn2); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//connections without a client are not limited
+	server.ClientKey = func(c net.Conn) string { return "" }
+	cn, sn = net.Pipe()
+	go server.ServeConn(sn)
+	cn2, sn2 = net.Pipe()
+	go server.ServeConn(sn2)
+	if err = get(cn); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = get(cn2); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spdy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spdy.sock")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux}
+	go server.ListenAndServeUnix(path)
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := Dial("unix", path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", "http://localhost/banana", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestTransport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	go server.ListenAndServeTLS(SERVER_CERTFILE, SERVER_KEYFILE)
+	time.Sleep(400 * time.Millisecond)
+
+	transport := &Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: transport}
+	for _, fruit := range []string{"banana", "monkeys"} {
+		res, err := client.Get("https://localhost:4040/" + fruit)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("Unexpected status:", res.Status)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != "Hi there, I love "+fruit+"!" {
+			t.Fatal("Unexpected Data:", string(data))
+		}
+		res.Body.Close()
+	}
+	if len(transport.sessions["https://localhost:4040"]) != 1 {
+		t.Fatal("Sessions not shared, got", len(transport.sessions))
+	}
+
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTransportPool(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		ServerHandler(w, r)
+	})
+	server := &Server{
+		Addr:                 "localhost:4040",
+		Handler:              mux,
+		MaxConcurrentStreams: 1,
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	transport := &Transport{}
+	client := &http.Client{Transport: transport}
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := client.Get("http://localhost:4040/banana")
+			if err != nil {
+				done <- err
+				return
+			}
+			data, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(data) != "Hi there, I love banana!" {
+				done <- errors.New("Unexpected Data: " + string(data))
+				return
+			}
+			done <- nil
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	transport.mu.Lock()
+	n := len(transport.sessions["http://localhost:4040"])
+	transport.mu.Unlock()
+	if n != 2 {
+		t.Fatal("Expected a second session over the streams limit, got", n)
+	}
+
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTransportDialContext(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux}
+	ln := servePipe(t, server)
+
+	var dialed string
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return ln.Dial(), nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://fake.example/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	res.Body.Close()
+	if dialed != "fake.example:80" {
+		t.Fatal("Unexpected address dialed:", dialed)
+	}
+	server.Close()
+}
+
+func TestTransportRequestHost(t *testing.T) {
+	hosts := make(chan string, 2)
+	server := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	})}
+	_, transport := newPipeServer(t, server)
+
+	//the Host of the request, if any, rather than the one of its URL
+	for host, expected := range map[string]string{"example.com": "example.com", "": "127.0.0.1:8080"} {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8080/x", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Host = host
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		if got := <-hosts; got != expected {
+			t.Fatalf("Unexpected Host for %q: %s", host, got)
+		}
+	}
+}
+
+func TestTransportCancel(t *testing.T) {
+	cancelled := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(2 * time.Second):
+			cancelled <- false
+		}
+	})
+	server := &Server{
+		Addr:    "localhost:4040",
+		Handler: mux,
+	}
+	go server.ListenAndServe()
+	time.Sleep(200 * time.Millisecond)
+
+	client := &http.Client{Transport: &Transport{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost:4040/slow", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(res.Body, buf)
+	if err != nil || string(buf) != "partial" {
+		t.Fatal("Unexpected Data:", string(buf), err)
+	}
+
+	//the pending read is unblocked and the server stream reset
+	cancel()
+	_, err = ioutil.ReadAll(res.Body)
+	if err != context.Canceled {
+		t.Fatal("Unexpected error reading a cancelled body:", err)
+	}
+	if !<-cancelled {
+		t.Fatal("Server stream not reset")
+	}
+
+	//other requests on the session are not affected
+	res, err = client.Get("http://localhost:4040/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	res.Body.Close()
+
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTransportRetry(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux}
+	ln := servePipe(t, server)
+
+	//the first session goes away without processing the request
+	dials := 0
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			if dials > 1 {
+				return ln.Dial(), nil
+			}
+			cn, sn := net.Pipe()
+			go func() {
+				framer := NewFramer(sn)
+				for {
+					f, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					if _, ok := f.(*SynStreamFrame); ok {
+						framer.WriteFrame(&GoAwayFrame{LastGoodStreamID: 0, Status: GOAWAY_OK})
+						io.Copy(ioutil.Discard, sn)
+						return
+					}
+				}
+			}()
+			return cn, nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post("http://localhost/banana", "text/plain", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	res.Body.Close()
+	if dials != 2 {
+		t.Fatal("Expected the request retried on a new session, dials:", dials)
+	}
+	server.Close()
+}
+
+func TestTransportReplayAfterGoAway(t *testing.T) {
+	server := &Server{Handler: http.HandlerFunc(ServerHandler)}
+	ln := servePipe(t, server)
+
+	//the first session processes stream 1 only, going away on stream 3
+	first := make(chan bool, 1)
+	var dials int32
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) > 1 {
+				return ln.Dial(), nil
+			}
+			cn, sn := net.Pipe()
+			go func() {
+				framer := NewFramer(sn)
+				for {
+					f, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					syn, ok := f.(*SynStreamFrame)
+					if !ok {
+						continue
+					}
+					if syn.StreamID == 1 {
+						first <- true
+						continue
+					}
+					framer.WriteFrame(&GoAwayFrame{LastGoodStreamID: 1, Status: GOAWAY_OK})
+					header := http.Header{HEADER_STATUS: {"200 OK"}, HEADER_VERSION: {"HTTP/1.1"}}
+					framer.WriteFrame(&SynReplyFrame{StreamID: 1, Flags: FLAG_FIN, Header: header})
+				}
+			}()
+			return cn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	done := make(chan error, 1)
+	go func() {
+		res, err := client.Get("http://localhost/one")
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	<-first
+	res, err := client.Post("http://localhost/banana", "text/plain", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Request processed before the GOAWAY failed:", err)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatal("Expected the request replayed on a new session, dials:", dials)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Host != "example.com:443" {
+			http.Error(w, "not a tunnel", http.StatusBadRequest)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := client.Connect("example.com:443")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, msg := range []string{"ping", "pong"} {
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatal("Unexpected tunnel data:", string(buf), err)
+		}
+	}
+	conn.Close()
+	client.Close()
+	server.Close()
+}
+
+func TestCloseWrite(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		//the client is done sending, with the reply still to come
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		fmt.Fprintf(conn, "got %s", data)
+		conn.Close()
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := client.Connect("example.com:443")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.Write([]byte("banana"))
+	err = conn.(interface{ CloseWrite() error }).CloseWrite()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = conn.Write([]byte("more")); err == nil {
+		t.Fatal("Write after CloseWrite")
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != "got banana" {
+		t.Fatal("Unexpected reply:", string(data), err)
+	}
+	conn.Close()
+	client.Close()
+	server.Close()
+}
+
+func TestTunnelDeadline(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		//nothing is sent back
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := client.Connect("example.com:443")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("Unexpected error past the deadline:", err)
+	}
+	conn.Close()
+	client.Close()
+	server.Close()
+}
+
+func TestTransportRedirectCookies(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "banana"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		http.Redirect(w, r, "/upload", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		session, err := r.Cookie("session")
+		if err != nil {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Method, session.Value, body)
+	})
+	server := &Server{Handler: mux}
+	client, _ := newPipeServer(t, server)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Jar = jar
+	res, err := client.Post("http://localhost/login", "text/plain", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "POST banana hello" {
+		t.Fatal("Unexpected Data:", res.Status, string(data))
+	}
+	u, _ := url.Parse("http://localhost/")
+	if len(jar.Cookies(u)) != 2 {
+		t.Fatal("Unexpected cookies:", jar.Cookies(u))
+	}
+	server.Close()
+}
+
+func TestTransportResponseHeaderTimeout(t *testing.T) {
+	cancelled := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(2 * time.Second):
+			cancelled <- false
+		}
+	})
+	server := &Server{Handler: mux}
+	client, transport := newPipeServer(t, server)
+	transport.ResponseHeaderTimeout = 100 * time.Millisecond
+	_, err := client.Get("http://localhost/slow")
+	if err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !<-cancelled {
+		t.Fatal("Server stream not reset")
+	}
+
+	//the session is still good for other requests
+	res, err := client.Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	server.Close()
+}
+
+func TestTransportUpload(t *testing.T) {
+	upload := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		// slower than the client, which has to wait for the window
+		time.Sleep(100 * time.Millisecond)
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(data, upload) {
+			http.Error(w, fmt.Sprint("bad upload of ", len(data), " bytes: ", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %s", len(data), r.Header.Get("Content-Length"))
+	})
+	server := &Server{Handler: mux}
+	client, _ := newPipeServer(t, server)
+	tests := []struct {
+		body   io.Reader
+		expect string
+	}{
+		{bytes.NewReader(upload), fmt.Sprint(len(upload), " ", len(upload))},
+		// of unknown length
+		{struct{ io.Reader }{bytes.NewReader(upload)}, fmt.Sprint(len(upload), " ")},
+	}
+	for _, test := range tests {
+		res, err := client.Post("http://localhost/upload", "application/octet-stream", test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(data) != test.expect {
+			t.Fatal("Unexpected reply:", res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestTransportSmallFrames(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lines", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 50; i++ {
+			fmt.Fprintf(w, "line %03d\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		// the frames of the body pile up meanwhile
+		time.Sleep(200 * time.Millisecond)
+		data, err := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %v", len(data), err)
+	})
+	server := &Server{Handler: mux}
+	client, _ := newPipeServer(t, server)
+
+	//the reply in many frames, read after they all arrived
+	res, err := client.Get("http://localhost/lines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || len(data) != 450 {
+		t.Fatal("Unexpected reply:", len(data), err)
+	}
+
+	//an upload in frames of one byte
+	body := iotest.OneByteReader(bytes.NewReader(bytes.Repeat([]byte("x"), 500)))
+	res, err = client.Post("http://localhost/upload", "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "500 <nil>" {
+		t.Fatal("Unexpected upload:", string(data))
+	}
+}
+
+func TestTransportDialing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{Handler: mux}
+	ln := servePipe(t, server)
+
+	var dials int32
+	stuck := make(chan bool)
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "stuck") {
+				select {
+				case <-stuck:
+				case <-ctx.Done():
+				}
+				return nil, errors.New("unreachable")
+			}
+			atomic.AddInt32(&dials, 1)
+			time.Sleep(50 * time.Millisecond)
+			return ln.Dial(), nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	go client.Get("http://stuck/banana")
+	time.Sleep(50 * time.Millisecond)
+
+	//the requests to other hosts go on while one is dialed, sharing the
+	//session of their host
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			res, err := client.Get("http://localhost/banana")
+			if err == nil {
+				data, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if string(data) != "Hi there, I love banana!" {
+					err = errors.New("unexpected data: " + string(data))
+				}
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Requests held up by the dial of another host")
+		}
+	}
+	close(stuck)
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatal("Unexpected number of dials:", n)
+	}
+}
+
+func TestTransportIdle(t *testing.T) {
+	server := &Server{Handler: http.HandlerFunc(ServerHandler)}
+	client, transport := newPipeServer(t, server)
+	transport.MaxIdleTime = 200 * time.Millisecond
+	get := func() {
+		res, err := client.Get("http://localhost/banana")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(data) != "Hi there, I love banana!" {
+			t.Fatal("Unexpected Data:", string(data))
+		}
+	}
+	pooled := func() int {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		return len(transport.sessions["http://localhost:80"])
+	}
+
+	//the idle session is closed after a while
+	get()
+	if pooled() != 1 {
+		t.Fatal("Session not pooled")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if pooled() != 0 {
+		t.Fatal("Idle session not closed")
+	}
+
+	//or right away, when asked to, once its stream is done
+	get()
+	time.Sleep(50 * time.Millisecond)
+	client.CloseIdleConnections()
+	if pooled() != 0 {
+		t.Fatal("Idle session not closed")
+	}
+	get()
+	server.Close()
+}
+
+func TestTransportHostTLS(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServerHandler)
+	server := &Server{
+		Addr:      "localhost:4040",
+		Handler:   mux,
+		TLSConfig: &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+		OnNewSession: func(c net.Conn, state *tls.ConnectionState) (*SessionConfig, error) {
+			if state == nil || len(state.PeerCertificates) == 0 {
+				return nil, errors.New("no client certificate")
+			}
+			return nil, nil
+		},
+	}
+	go server.ListenAndServeTLS(SERVER_CERTFILE, SERVER_KEYFILE)
+	time.Sleep(400 * time.Millisecond)
+
+	cert, err := tls.LoadX509KeyPair("cert/clientTLS/client.pem", "cert/clientTLS/client.key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	transport := &Transport{
+		HostTLSClientConfigs: map[string]*tls.Config{
+			"localhost": {InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}},
+		},
+	}
+	client := &http.Client{Transport: transport}
+
+	//the configuration of the host has the client certificate
+	res, err := client.Get("https://localhost:4040/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+
+	//other hosts get the default configuration, which does not trust the server
+	_, err = client.Get("https://127.0.0.1:4040/banana")
+	if err == nil {
+		t.Fatal("Expected a TLS error")
+	}
+
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestReadFrom(t *testing.T) {
+	//larger than the flow control window
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	path := filepath.Join(t.TempDir(), "file")
+	err := ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			http.Error(w, "not a ReaderFrom", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		io.Copy(w, f)
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, _ := newPipeServer(t, server)
+	res, err := client.Get("http://localhost/file")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("Unexpected data of size", len(data), res.Status)
+	}
+	server.Close()
+}
+
+func BenchmarkConcurrentStreams(b *testing.B) {
+	server := &Server{Handler: http.HandlerFunc(ServerHandler), MaxConcurrentStreams: 1000}
+	client, _ := newPipeServer(b, server)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 1000; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := client.Get("http://localhost/banana")
+				if err != nil {
+					b.Error(err.Error())
+					return
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkLargeTransfer(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, struct{ io.Reader }{bytes.NewReader(content)})
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, _ := newPipeServer(b, server)
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := client.Get("http://localhost/file")
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		n, _ := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if n != int64(len(content)) {
+			b.Fatal("Unexpected data of size", n)
+		}
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	//larger than the flow control window, written at once
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, _ := newPipeServer(t, server)
+	res, err := client.Get("http://localhost/large")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("Unexpected data of size", len(data))
+	}
+	server.Close()
+}
+
+func TestHeaderCompressionLevel(t *testing.T) {
+	server := &Server{Handler: http.HandlerFunc(ServerHandler), HeaderCompressionLevel: zlib.BestSpeed}
+	client, transport := newPipeServer(t, server)
+	transport.HeaderCompressionLevel = zlib.HuffmanOnly
+	for _, fruit := range []string{"banana", "monkeys"} {
+		res, err := client.Get("http://localhost/" + fruit)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(data) != "Hi there, I love "+fruit+"!" {
+			t.Fatal("Unexpected Data:", string(data))
+		}
+	}
+	server.Close()
+}
+
+func TestHeaderDictionary(t *testing.T) {
+	dict := []byte("x-api-tokenx-api-versionapplication/vnd.example+json")
+	server := &Server{Handler: http.HandlerFunc(ServerHandler), HeaderDictionary: dict}
+	ln := servePipe(t, server)
+
+	transport := &Transport{
+		HeaderDictionary: dict,
+		DialContext:      ln.DialContext,
+	}
+	client := &http.Client{Transport: transport}
+	for _, fruit := range []string{"banana", "monkeys"} {
+		res, err := client.Get("http://localhost/" + fruit)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(data) != "Hi there, I love "+fruit+"!" {
+			t.Fatal("Unexpected Data:", string(data))
+		}
+	}
+
+	// the other end has to use the same dictionary
+	transport = &Transport{
+		DialContext: ln.DialContext,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/banana", nil)
+	if res, err := transport.RoundTrip(req); err == nil {
+		res.Body.Close()
+		t.Fatal("Unexpected reply with another dictionary")
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	nodelay := func(c *net.TCPConn) int {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var value int
+		raw.Control(func(fd uintptr) {
+			value, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return value
+	}
+	accepted := make(chan int, 1)
+	server := &Server{
+		Handler: http.HandlerFunc(ServerHandler),
+		SocketOptions: &SocketOptions{
+			Nagle:     true,
+			KeepAlive: time.Minute,
+			Control: func(c *net.TCPConn) error {
+				accepted <- nodelay(c)
+				return nil
+			},
+		},
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	dialed := make(chan int, 1)
+	transport := &Transport{
+		SocketOptions: &SocketOptions{
+			KeepAlive:  -1,
+			ReadBuffer: 1 << 16,
+			Control: func(c *net.TCPConn) error {
+				dialed <- nodelay(c)
+				return nil
+			},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://" + ln.Addr().String() + "/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected Data:", string(data))
+	}
+	if <-accepted != 0 {
+		t.Fatal("Nagle's algorithm not enabled on the accepted connection")
+	}
+	if <-dialed == 0 {
+		t.Fatal("Nagle's algorithm enabled on the dialed connection")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 48<<10))
+	}
+	for _, limits := range []struct{ session, stream int64 }{{0, 64 << 10}, {128 << 10, 0}} {
+		server := &Server{
+			Handler:          http.HandlerFunc(handler),
+			SessionRateLimit: limits.session,
+			StreamRateLimit:  limits.stream,
+		}
+		ln := servePipe(t, server)
+		framer := NewFramer(ln.Dial())
+
+		//one stream at 64KB/s, or two sharing a session at 128KB/s
+		rate, streams := limits.stream, 1
+		if limits.session > 0 {
+			rate, streams = limits.session, 2
+		}
+		for i := 0; i < streams; i++ {
+			err := framer.WriteFrame(&SynStreamFrame{StreamID: uint32(2*i + 1), Flags: FLAG_FIN, Header: testRequestHeader("/big")})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		//past the first DATA frame, the bytes sent by any time are within
+		//the burst of the bucket and the rate, with a frame of slack for
+		//the frames read late
+		var start time.Time
+		sent, ended := 0, 0
+		for ended < streams {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			df, ok := f.(*DataFrame)
+			if !ok {
+				continue
+			}
+			if start.IsZero() {
+				start = time.Now()
+			}
+			sent += len(df.Data)
+			if max := 2*DATA_BUFFER_SIZE + int(float64(rate)*time.Since(start).Seconds()); sent > max {
+				t.Fatalf("Sent %d bytes over %d with limits %v", sent, max, limits)
+			}
+			if df.Flags&FLAG_FIN != 0 {
+				ended++
+			}
+		}
+		if sent != streams*48<<10 {
+			t.Fatal("Unexpected Data length:", sent)
+		}
+		server.Close()
+	}
+
+	//a wait for the bucket ends with the stream
+	r := newRateLimiter(1)
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	waited := make(chan bool)
+	go func() {
+		r.wait(1<<20, done)
+		waited <- true
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait not ended with the stream")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	count := func(name string) int64 {
+		return expvar.Get("spdy").(*expvar.Map).Get(name).(*expvar.Int).Value()
+	}
+	frames := func(name, kind string) int64 {
+		v := expvar.Get("spdy").(*expvar.Map).Get(name).(*expvar.Map).Get(kind)
+		if v == nil {
+			return 0
+		}
+		return v.(*expvar.Int).Value()
+	}
+	opened, streams, sent := count("sessions_opened"), count("streams_opened"), count("bytes_sent")
+	replies := frames("frames_received", "SYN_REPLY")
+
+	server := &Server{Handler: http.HandlerFunc(ServerHandler)}
+	client, _ := newPipeServer(t, server)
+	res, err := client.Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	server.Close()
+
+	//both ends count
+	if count("sessions_opened")-opened < 2 {
+		t.Fatal("Sessions not counted")
+	}
+	if count("streams_opened")-streams < 2 {
+		t.Fatal("Streams not counted")
+	}
+	if count("bytes_sent") <= sent {
+		t.Fatal("Bytes sent not counted")
+	}
+	if frames("frames_received", "SYN_REPLY") <= replies {
+		t.Fatal("Frames received not counted")
+	}
+}
+
+type testObserver struct {
+	mu                               sync.Mutex
+	streams, headers, stalls, frames int
+}
+
+func (o *testObserver) count(n *int) {
+	o.mu.Lock()
+	*n++
+	o.mu.Unlock()
+}
+
+func (o *testObserver) StreamClosed(d time.Duration)         { o.count(&o.streams) }
+func (o *testObserver) HeaderCompressed(raw, compressed int) { o.count(&o.headers) }
+func (o *testObserver) WindowStalled(d time.Duration)        { o.count(&o.stalls) }
+func (o *testObserver) FrameSent(kind string, size int)      { o.count(&o.frames) }
+func (o *testObserver) FrameReceived(kind string, size int)  { o.count(&o.frames) }
+
+func TestObserver(t *testing.T) {
+	o := &testObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, transport := newPipeServer(t, server)
+	//the reply does not fit in the window of the client
+	transport.InitialWindowSize = 1024
+	res, err := client.Get("http://localhost/big")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if len(data) != 4096 {
+		t.Fatal("Unexpected Data length:", len(data))
+	}
+	server.Close()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.streams == 0 || o.headers == 0 || o.stalls == 0 || o.frames == 0 {
+		t.Fatalf("Measures not observed: %+v", o)
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	server := &Server{Handler: http.HandlerFunc(ServerHandler)}
+	client, _ := newPipeServer(t, server)
+
+	var mu sync.Mutex
+	var events []string
+	event := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	trace := &ClientTrace{
+		GotConn: func(info GotConnInfo) {
+			event(fmt.Sprintf("GotConn reused=%v", info.Reused))
+		},
+		WroteHeaders:         func() { event("WroteHeaders") },
+		GotFirstResponseByte: func() { event("GotFirstResponseByte") },
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+		req = req.WithContext(WithClientTrace(req.Context(), trace))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"GotConn reused=false", "WroteHeaders", "GotFirstResponseByte",
+		"GotConn reused=true", "WroteHeaders", "GotFirstResponseByte",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatal("Unexpected trace:", events)
+	}
+}
+
+func TestClientTraceReset(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	//the server resets every stream
+	go func() {
+		framer := NewFramer(sn)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if syn, ok := f.(*SynStreamFrame); ok {
+				framer.WriteFrame(&RstStreamFrame{StreamID: syn.StreamID, Status: RST_INTERNAL_ERROR})
+			}
+		}
+	}()
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cn, nil
+		},
+		RetryPolicy: func(req *http.Request, attempts int, err error) bool { return false },
+	}
+	reset := make(chan uint32, 1)
+	trace := &ClientTrace{StreamReset: func(status uint32) { reset <- status }}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	req = req.WithContext(WithClientTrace(req.Context(), trace))
+	_, err := transport.RoundTrip(req)
+	if err == nil {
+		t.Fatal("Reset stream did not fail")
+	}
+	select {
+	case status := <-reset:
+		if status != RST_INTERNAL_ERROR {
+			t.Fatal("Unexpected reset status:", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reset not traced")
+	}
+}
+
+func TestMalformedReply(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	//the server replies without a :status, and gets a reset
+	reset := make(chan uint32, 1)
+	go func() {
+		framer := NewFramer(sn)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *SynStreamFrame:
+				header := make(http.Header)
+				header.Set(HEADER_VERSION, "HTTP/1.1")
+				framer.WriteFrame(&SynReplyFrame{StreamID: f.StreamID, Flags: FLAG_FIN, Header: header})
+			case *RstStreamFrame:
+				reset <- f.Status
+			}
+		}
+	}()
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cn, nil
+		},
+		RetryPolicy: func(req *http.Request, attempts int, err error) bool { return false },
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	_, err := transport.RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), HEADER_STATUS) {
+		t.Fatal("Unexpected error of a reply without status:", err)
+	}
+	select {
+	case status := <-reset:
+		if status != RST_PROTOCOL_ERROR {
+			t.Fatal("Unexpected reset status:", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Malformed reply not reset")
+	}
+}
+
+func TestReplyOutOfPlace(t *testing.T) {
+	header := http.Header{HEADER_STATUS: {"200 OK"}, HEADER_VERSION: {"HTTP/1.1"}}
+	cases := []struct {
+		name   string
+		frames func(id uint32) []Frame
+		status uint32
+	}{
+		{"DATA before SYN_REPLY", func(id uint32) []Frame {
+			return []Frame{&DataFrame{StreamID: id, Data: []byte("banana")}}
+		}, RST_PROTOCOL_ERROR},
+		{"SYN_REPLY twice", func(id uint32) []Frame {
+			return []Frame{&SynReplyFrame{StreamID: id, Header: header}, &SynReplyFrame{StreamID: id, Header: header}}
+		}, RST_STREAM_IN_USE},
+	}
+	for _, c := range cases {
+		cn, sn := net.Pipe()
+		reset := make(chan uint32, 1)
+		go func() {
+			framer := NewFramer(sn)
+			for {
+				f, err := framer.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *SynStreamFrame:
+					for _, out := range c.frames(f.StreamID) {
+						framer.WriteFrame(out)
+					}
+				case *RstStreamFrame:
+					reset <- f.Status
+				}
+			}
+		}()
+		transport := &Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return cn, nil
+			},
+			RetryPolicy: func(req *http.Request, attempts int, err error) bool { return false },
+		}
+		go func() {
+			req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+			if res, err := transport.RoundTrip(req); err == nil {
+				ioutil.ReadAll(res.Body)
+			}
+		}()
+		select {
+		case status := <-reset:
+			if status != c.status {
+				t.Errorf("%s: unexpected reset status %d", c.name, status)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: stream not reset", c.name)
+		}
+		sn.Close()
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		answer func(framer *Framer, id uint32)
+		check  func(err error) bool
+	}{
+		{"reset", func(framer *Framer, id uint32) {
+			framer.WriteFrame(&RstStreamFrame{StreamID: id, Status: RST_INTERNAL_ERROR})
+		}, func(err error) bool {
+			var se *StreamError
+			return errors.As(err, &se) && se.StreamID == 1 && se.Status == RST_INTERNAL_ERROR && se.Remote &&
+				!errors.Is(err, ErrStreamUnprocessed)
+		}},
+		{"refused", func(framer *Framer, id uint32) {
+			framer.WriteFrame(&RstStreamFrame{StreamID: id, Status: RST_REFUSED_STREAM})
+		}, func(err error) bool {
+			var se *StreamError
+			return errors.As(err, &se) && se.Retry && errors.Is(err, ErrStreamUnprocessed)
+		}},
+		{"gone away", func(framer *Framer, id uint32) {
+			framer.WriteFrame(&GoAwayFrame{Status: GOAWAY_INTERNAL_ERROR})
+		}, func(err error) bool {
+			var se *SessionError
+			return errors.As(err, &se) && se.GoAway && se.Remote && se.Status == GOAWAY_INTERNAL_ERROR &&
+				errors.Is(err, ErrStreamUnprocessed) && errors.Is(err, ErrSessionClosed)
+		}},
+		{"closed", func(framer *Framer, id uint32) {
+			framer.rw.(net.Conn).Close()
+		}, func(err error) bool {
+			var se *SessionError
+			return errors.As(err, &se) && !se.GoAway && errors.Is(err, ErrSessionClosed) && !errors.Is(err, ErrStreamUnprocessed)
+		}},
+	}
+	for _, c := range cases {
+		cn, sn := net.Pipe()
+		go func() {
+			framer := NewFramer(sn)
+			for {
+				f, err := framer.ReadFrame()
+				if err != nil {
+					return
+				}
+				if f, ok := f.(*SynStreamFrame); ok {
+					c.answer(framer, f.StreamID)
+				}
+			}
+		}()
+		transport := &Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return cn, nil
+			},
+			RetryPolicy: func(req *http.Request, attempts int, err error) bool { return false },
+		}
+		req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+		_, err := transport.RoundTrip(req)
+		if !c.check(err) {
+			t.Errorf("%s: unexpected error %#v", c.name, err)
+		}
+		sn.Close()
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	//the server never replies
+	reset := make(chan uint32, 1)
+	go func() {
+		framer := NewFramer(sn)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f, ok := f.(*RstStreamFrame); ok {
+				reset <- f.Status
+			}
+		}
+	}()
+	client, _ := NewClientConnConfig(cn, &ClientConfig{ResponseHeaderTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	_, err := client.Do(req)
+	if err != ErrResponseHeaderTimeout {
+		t.Fatal("Unexpected error of a request without reply:", err)
+	}
+	select {
+	case status := <-reset:
+		if status != RST_CANCEL {
+			t.Fatal("Unexpected reset status:", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stream without reply not reset")
+	}
+}
+
+// a buffer written by the sessions while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Bytes returns a copy of what was written so far
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *syncBuffer) String() string {
+	return string(b.Bytes())
+}
+
+func TestFrameCapture(t *testing.T) {
+	binary, text := new(syncBuffer), new(syncBuffer)
+	server := &Server{
+		Handler: http.HandlerFunc(ServerHandler),
+		FrameCapture: func(ss *Session) *FrameCapture {
+			return &FrameCapture{Binary: binary, Text: text}
+		},
+	}
+	client, _ := newPipeServer(t, server)
+	for _, path := range []string{"banana", "apple"} {
+		res, err := client.Get("http://localhost/" + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	//the headers of both requests decode, in order, with the data sent
+	var paths []string
+	var data string
+	r := NewCaptureReader(bytes.NewReader(binary.Bytes()))
+	for {
+		cf, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := cf.Frame.(type) {
+		case *SynStreamFrame:
+			if cf.Sent {
+				t.Fatal("SYN_STREAM captured as sent")
+			}
+			paths = append(paths, f.Header.Get(HEADER_PATH))
+		case *DataFrame:
+			if cf.Sent {
+				data += string(f.Data)
+			}
+		}
+	}
+	if fmt.Sprint(paths) != "[/banana /apple]" {
+		t.Fatal("Unexpected requests captured:", paths)
+	}
+	if data != "Hi there, I love banana!Hi there, I love apple!" {
+		t.Fatal("Unexpected data captured:", data)
+	}
+	if !strings.Contains(text.String(), "received SYN_STREAM #3") || !strings.Contains(text.String(), "sent SYN_REPLY") {
+		t.Fatal("Unexpected text capture:", text.String())
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	rec := &Recorder{Dir: t.TempDir()}
+	server := &Server{Handler: http.HandlerFunc(ServerHandler), FrameCapture: rec.Capture}
+	client, transport := newPipeServer(t, server)
+	for _, path := range []string{"banana", "apple"} {
+		res, err := client.Post("http://localhost/"+path, "text/plain", strings.NewReader("ripe"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	transport.CloseIdleConnections()
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(rec.Dir, "*.cap"))
+	if err != nil || len(files) != 1 {
+		t.Fatal("Unexpected capture files:", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	//the requests are served again, with their bodies
+	var mu sync.Mutex
+	var requests []string
+	text := new(bytes.Buffer)
+	replayer := &Replayer{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			requests = append(requests, r.URL.Path+" "+string(body))
+			mu.Unlock()
+			ServerHandler(w, r)
+		}),
+		Capture: &FrameCapture{Text: text},
+	}
+	err = replayer.Replay(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sort.Strings(requests)
+	if fmt.Sprint(requests) != "[/apple ripe /banana ripe]" {
+		t.Fatal("Unexpected requests replayed:", requests)
+	}
+	if !strings.Contains(text.String(), "sent SYN_REPLY #3") {
+		t.Fatal("Unexpected replayed frames:", text.String())
+	}
+}
+
+func TestConcurrentHeaders(t *testing.T) {
+	server := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		ServerHandler(w, r)
+	})}
+	_, transport := newPipeServer(t, server)
+
+	//the replies of one session come in any order, each with its headers
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		go func(path string) {
+			req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.Header.Get("X-Path") != path {
+				err = errors.New(fmt.Sprintf("headers of %s for %s", res.Header.Get("X-Path"), path))
+			}
+			errs <- err
+		}(fmt.Sprintf("/fruit%d", i))
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		//render the sessions from within a stream
+		DebugHandler().ServeHTTP(w, r)
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, _ := newPipeServer(t, server)
+	res, err := client.Get("http://localhost/debug/spdy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	page := string(data)
+	for _, s := range []string{"server session with pipe, active", "client session with pipe, active", "<td>1</td><td>open</td>"} {
+		if !strings.Contains(page, s) {
+			t.Fatalf("%q missing in the page: %s", s, page)
+		}
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	stats := make(chan StreamStats, 1)
+	//an access log of the bytes sent and received
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ServerHandler(w, r)
+		w.(http.Flusher).Flush()
+		stats <- ContextStream(r.Context()).Stats()
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	client, _ := newPipeServer(t, server)
+	res, err := client.Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	s := <-stats
+	//the SYN_STREAM, and maybe a WINDOW_UPDATE for the DATA, then the
+	//SYN_REPLY and the DATA
+	if s.FramesReceived < 1 || s.BytesReceived <= 8 {
+		t.Fatalf("Unexpected received counters: %+v", s)
+	}
+	if s.FramesSent != 2 || s.BytesSent <= 16+int64(len("Hi there, I love banana!")) {
+		t.Fatalf("Unexpected sent counters: %+v", s)
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	canceled := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HEADER_METHOD) != "" || r.Header.Get("X-Forwarded-Host") != "localhost:80" {
+			t.Errorf("Unexpected headers at the backend: %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+		if r.URL.Path != "/wait" {
+			return
+		}
+		//the first part is streamed before the handler is done
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		canceled <- true
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	server := &Server{Handler: NewReverseProxy(target)}
+	client, _ := newPipeServer(t, server)
+
+	res, err := client.Post("http://localhost/banana", "text/plain", strings.NewReader("split"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "POST /banana split" {
+		t.Fatalf("Unexpected response: %s %q", res.Status, body)
+	}
+
+	//the client goes away in the middle of the response
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/wait", nil)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := make([]byte, len("GET /wait "))
+	if _, err = io.ReadFull(res.Body, buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel()
+	res.Body.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request to the backend was not canceled")
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HEADER_HOST) != "" {
+			t.Errorf("Unexpected headers at the origin: %v", r.Header)
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, r.URL.Path)
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	server := &Server{Handler: &ForwardProxy{}}
+	ln := servePipe(t, server)
+
+	//the proxy is the other end of all the sessions
+	client := &http.Client{Transport: &Transport{DialContext: ln.DialContext}}
+	res, err := client.Get(origin.URL + "/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "GET "+host+" /banana" {
+		t.Fatalf("Unexpected response: %s %q", res.Status, body)
+	}
+
+	//and an HTTP/1.1 request through a tunnel to the origin
+	cn, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer cn.Close()
+	conn, err := cn.Connect(host)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest("GET", origin.URL+"/split", nil)
+	req.Write(conn)
+	res, err = http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	if string(body) != "GET "+host+" /split" {
+		t.Fatalf("Unexpected response through the tunnel: %s %q", res.Status, body)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	closed := make(chan error, 1)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sec-WebSocket-Protocol", "echo")
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		//echo the messages until the client closes
+		for {
+			kind, data, err := ws.ReadMessage()
+			if err != nil {
+				closed <- err
+				ws.Close()
+				return
+			}
+			ws.WriteMessage(kind, data)
+		}
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	//a plain request is not a handshake
+	req, _ := http.NewRequest("GET", "http://localhost/chat", nil)
+	res, err := client.Do(req)
+	if err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Unexpected reply to a plain request:", res, err)
+	}
+
+	ws, err := client.DialWebSocket("ws://localhost/chat", http.Header{"Sec-WebSocket-Protocol": {"echo"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ws.Subprotocol != "echo" {
+		t.Fatal("Unexpected subprotocol:", ws.Subprotocol)
+	}
+	large := bytes.Repeat([]byte("banana"), 20000)
+	messages := []struct {
+		kind int
+		data []byte
+	}{{WS_TEXT, []byte("hello")}, {WS_BINARY, large[:1000]}, {WS_BINARY, large}}
+	for _, m := range messages {
+		if err = ws.WriteMessage(m.kind, m.data); err != nil {
+			t.Fatal(err.Error())
+		}
+		//the ping is answered while reading the echo
+		ws.WriteMessage(WS_PING, []byte("ping"))
+		kind, data, err := ws.ReadMessage()
+		if err != nil || kind != m.kind || !bytes.Equal(data, m.data) {
+			t.Fatalf("Unexpected echo of %d bytes: %d %d bytes %v", len(m.data), kind, len(data), err)
+		}
+	}
+	ws.Close()
+	select {
+	case err = <-closed:
+		if err != io.EOF {
+			t.Fatal("Unexpected error of the server on close:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not see the close")
+	}
+}
+
+func TestOpenStream(t *testing.T) {
+	//an RPC that replies with the upper case of the request
+	onStream := func(conn net.Conn, header http.Header) {
+		if header.Get("Rpc-Method") != "upper" {
+			t.Errorf("Unexpected headers: %v", header)
+		}
+		req, _ := ioutil.ReadAll(conn)
+		conn.Write(bytes.ToUpper(req))
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The handler got the stream")
+	}
+	server := &Server{Handler: http.HandlerFunc(handler), OnStream: onStream}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	var wg sync.WaitGroup
+	for _, msg := range []string{"banana", "split", "cherry"} {
+		wg.Add(1)
+		go func(msg string) {
+			defer wg.Done()
+			conn, err := client.OpenStream(http.Header{"rpc-method": {"upper"}})
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte(msg))
+			conn.(interface{ CloseWrite() error }).CloseWrite()
+			res, err := ioutil.ReadAll(conn)
+			if err != nil || string(res) != strings.ToUpper(msg) {
+				t.Errorf("Unexpected reply to %s: %q %v", msg, res, err)
+			}
+		}(msg)
+	}
+	wg.Wait()
+}
+
+func TestStreamNetConn(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(SERVER_CERTFILE, SERVER_KEYFILE)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//TLS within the tunnel, on top of the stream
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		conn, err := w.(*Stream).NetConn()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if conn.RemoteAddr() == nil || conn.LocalAddr() == nil {
+			t.Error("No addresses for the stream")
+		}
+		tconn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(tconn, buf); err != nil {
+			t.Error(err.Error())
+		}
+		tconn.Write(bytes.ToUpper(buf))
+		tconn.Close()
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	client, err := NewClientConn(ln.Dial())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+	conn, err := client.Connect("example.com:443")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tconn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tconn.Close()
+	tconn.SetDeadline(time.Now().Add(5 * time.Second))
+	tconn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(tconn, buf); err != nil || string(buf) != "PING" {
+		t.Fatal("Unexpected data over TLS:", string(buf), err)
+	}
+}
+
+func TestHTTP2Gateway(t *testing.T) {
+	canceled := make(chan bool, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.Header.Get("Priority"))
+		if r.URL.Path == "/wait" {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			canceled <- true
+		}
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	server := &Server{Handler: NewHTTP2Gateway(target)}
+	client, _ := newPipeServer(t, server)
+
+	//the priority of the stream, given by the Priority header of the
+	//request or the default one, is the urgency upstream
+	for priority, expected := range map[string]string{"": "HTTP/2.0 u=4", "u=1": "HTTP/2.0 u=1"} {
+		req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+		if priority != "" {
+			req.Header.Set("Priority", priority)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != expected {
+			t.Fatalf("Unexpected response: %q instead of %q", body, expected)
+		}
+	}
+
+	//a stream reset by the client cancels the upstream one
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/wait", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := make([]byte, len("HTTP/2.0 u=4"))
+	if _, err = io.ReadFull(res.Body, buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel()
+	res.Body.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The upstream stream was not canceled")
+	}
+}
+
+func TestSPDYGateway(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d %s", ContextStream(r.Context()).priority, r.Host)
+	}
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	ln := servePipe(t, server)
+
+	target, _ := url.Parse("http://spdy.example.com")
+	gateway := NewSPDYGateway(target)
+	gateway.Transport.(*Transport).DialContext = ln.DialContext
+	front := httptest.NewUnstartedServer(gateway)
+	front.Config.Protocols = new(http.Protocols)
+	front.Config.Protocols.SetUnencryptedHTTP2(true)
+	front.Start()
+	defer front.Close()
+
+	h2 := &http.Transport{Protocols: new(http.Protocols)}
+	h2.Protocols.SetUnencryptedHTTP2(true)
+	req, _ := http.NewRequest("GET", front.URL+"/banana", nil)
+	req.Header.Set("Priority", "u=2, i")
+	//the upstream gets the Host of the client, not the one of the target
+	req.Host = "www.example.org"
+	res, err := (&http.Client{Transport: h2}).Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 || string(body) != "2 www.example.org" {
+		t.Fatalf("Unexpected response: %s %q", res.Proto, body)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	//plaintext, on both ends
+	cn, sn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeConn(sn, http.HandlerFunc(ServerHandler))
+	}()
+	client, err := NewClientConn(cn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	if string(data) != "Hi there, I love banana!" {
+		t.Fatal("Unexpected data:", string(data))
+	}
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return once the session was done")
+	}
+
+	//TLS without ALPN
+	cert, err := tls.LoadX509KeyPair(SERVER_CERTFILE, SERVER_KEYFILE)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := &Server{Handler: http.HandlerFunc(ServerHandler)}
+	transport := &Transport{
+		PriorKnowledge:  true,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			go server.ServeConn(tls.Server(sn, &tls.Config{Certificates: []tls.Certificate{cert}}))
+			return cn, nil
+		},
+	}
+	res, err = (&http.Client{Transport: transport}).Get("https://localhost/monkeys")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "Hi there, I love monkeys!" {
+		t.Fatal("Unexpected data:", string(data))
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		_, err := w.Write([]byte("more"))
+		handlerErr <- err
+	}
+	sessions := make(chan *Session, 1)
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			go ServeConn(sn, http.HandlerFunc(handler))
+			return cn, nil
+		},
+		Events: func(ss *Session) *SessionEvents {
+			sessions <- ss
+			return nil
+		},
+	}
+	res, err := (&http.Client{Transport: transport}).Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := make([]byte, 7)
+	if _, err := io.ReadFull(res.Body, data); err != nil || string(data) != "partial" {
+		t.Fatal("Unexpected data:", string(data), err)
+	}
+	ss := <-sessions
+	if ss.CloseWithError(42) == nil {
+		t.Fatal("Unexpected close with an unknown status")
+	}
+	start := time.Now()
+	err = ss.CloseWithError(GOAWAY_INTERNAL_ERROR)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var se *SessionError
+	_, err = ioutil.ReadAll(res.Body)
+	if time.Since(start) > time.Second {
+		t.Fatal("Reply not failed right away:", time.Since(start))
+	}
+	if !errors.As(err, &se) || se.Status != GOAWAY_INTERNAL_ERROR || se.Remote {
+		t.Fatal("Unexpected reply:", string(data), err)
+	}
+	select {
+	case err := <-handlerErr:
+		if !errors.As(err, &se) || se.Status != GOAWAY_INTERNAL_ERROR || !se.Remote {
+			t.Fatal("Unexpected error of the handler:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler not done")
+	}
+}
+
+func TestConnectionMetadata(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(SERVER_CERTFILE, SERVER_KEYFILE)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	requests := make(chan *http.Request, 1)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}
+	sessions := make(chan *Session, 1)
+	server := &Server{Handler: http.HandlerFunc(handler)}
+	transport := &Transport{
+		PriorKnowledge:  true,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			go server.ServeConn(tls.Server(sn, &tls.Config{Certificates: []tls.Certificate{cert}}))
+			return cn, nil
+		},
+		Events: func(ss *Session) *SessionEvents {
+			sessions <- ss
+			return nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get("https://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	r := <-requests
+	if r.RemoteAddr != "pipe" {
+		t.Fatal("Unexpected remote address:", r.RemoteAddr)
+	}
+	if r.TLS == nil || !r.TLS.HandshakeComplete {
+		t.Fatal("Unexpected TLS state:", r.TLS)
+	}
+	ss := <-sessions
+	if ss.LocalAddr() == nil || ss.RemoteAddr() == nil {
+		t.Fatal("No addresses for the session")
+	}
+	if state := ss.TLSConnectionState(); state == nil || state.ServerName != "localhost" {
+		t.Fatal("Unexpected TLS state of the session:", state)
+	}
+
+	//without TLS
+	transport = &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			go server.ServeConn(sn)
+			return cn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	res, err = (&http.Client{Transport: transport}).Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	r = <-requests
+	if r.RemoteAddr != "pipe" || r.TLS != nil {
+		t.Fatal("Unexpected request metadata:", r.RemoteAddr, r.TLS)
+	}
+}
+
+func TestSessionStreams(t *testing.T) {
+	release := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}
+	sessions := make(chan *Session, 1)
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			go ServeConn(sn, http.HandlerFunc(handler))
+			return cn, nil
+		},
+		Events: func(ss *Session) *SessionEvents {
+			sessions <- ss
+			return nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get("http://localhost/banana")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := make([]byte, 7)
+	if _, err := io.ReadFull(res.Body, data); err != nil {
+		t.Fatal(err.Error())
+	}
+	ss := <-sessions
+	if ss.NumActiveStreams() != 1 {
+		t.Fatal("Unexpected active streams:", ss.NumActiveStreams())
+	}
+	streams := ss.Streams()
+	if len(streams) != 1 {
+		t.Fatalf("Unexpected streams: %+v", streams)
+	}
+	s := streams[0]
+	//the SYN_STREAM, and the WINDOW_UPDATE of the data read if written yet
+	if s.ID != 1 || s.State != STREAM_HALF_CLOSED_LOCAL || s.FramesSent < 1 || s.FramesSent > 2 || s.BytesReceived <= int64(len("partial")) {
+		t.Fatalf("Unexpected stream: %+v", s)
+	}
+
+	close(release)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for ss.NumActiveStreams() != 0 || len(ss.Streams()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Streams left: %+v", ss.Streams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a SettingsStore in a map, recording the values stored
+type testSettingsStore struct {
+	mu     sync.Mutex
+	values map[string][]SettingsValue
+}
+
+func (m *testSettingsStore) Load(origin string) []SettingsValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[origin]
+}
+
+func (m *testSettingsStore) Store(origin string, values []SettingsValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[origin] = values
+}
+
+func TestPersistedSettings(t *testing.T) {
+	sent := make(chan *SettingsFrame, 2)
+	var dials int32
+	store := &testSettingsStore{values: make(map[string][]SettingsValue)}
+	sessions := make(chan *Session, 2)
+	transport := &Transport{
+		SettingsStore: store,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cn, sn := net.Pipe()
+			first := atomic.AddInt32(&dials, 1) == 1
+			go func() {
+				framer := NewFramer(sn)
+				if first {
+					framer.WriteFrame(&SettingsFrame{Values: []SettingsValue{
+						{Flags: FLAG_SETTINGS_PERSIST_VALUE, ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: 7},
+						{ID: SETTINGS_ROUND_TRIP_TIME, Value: 50},
+					}})
+				}
+				for {
+					f, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					switch f := f.(type) {
+					case *SettingsFrame:
+						sent <- f
+					case *SynStreamFrame:
+						header := http.Header{HEADER_STATUS: {"200 OK"}, HEADER_VERSION: {"HTTP/1.1"}}
+						framer.WriteFrame(&SynReplyFrame{StreamID: f.StreamID, Flags: FLAG_FIN, Header: header})
+					}
+				}
+			}()
+			return cn, nil
+		},
+		Events: func(ss *Session) *SessionEvents {
+			sessions <- ss
+			return nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://localhost/banana")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		ss := <-sessions
+		//the second session starts with the persisted limit
+		if i == 1 && atomic.LoadUint32(&ss.peerMaxConcurrentStreams) != 7 {
+			t.Fatal("Persisted settings not applied:", atomic.LoadUint32(&ss.peerMaxConcurrentStreams))
+		}
+		ss.Close()
+	}
+
+	values := store.Load("http://localhost:80")
+	if len(values) != 1 || values[0].ID != SETTINGS_MAX_CONCURRENT_STREAMS || values[0].Value != 7 {
+		t.Fatalf("Unexpected persisted settings: %+v", values)
+	}
+	select {
+	case f := <-sent:
+		if len(f.Values) != 1 || f.Values[0].Flags != FLAG_SETTINGS_PERSISTED || f.Values[0].ID != SETTINGS_MAX_CONCURRENT_STREAMS || f.Values[0].Value != 7 {
+			t.Fatalf("Unexpected SETTINGS of the client: %+v", f.Values)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Persisted settings not sent back")
+	}
+	if len(sent) != 0 {
+		t.Fatal("Unexpected SETTINGS of the first session")
+	}
+}
@@ -8,12 +8,16 @@ package spdy
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"sort"
 	"sync/atomic"
 	"time"
 )
@@ -22,30 +26,62 @@ import (
 // This Session should be used as a server, and the given http.Server will be
 // used to serve requests arriving.  The user should call Serve() once it's
 // ready to start serving. New streams will be created as per the SPDY
-// protocol.
+// protocol. The MaxHeaderBytes of the given http.Server, if set, limits
+// the size of the request headers, its WriteTimeout limits the time to
+// write each frame, its IdleTimeout closes the Session when there are no
+// streams for that long, and its ErrorLog gets the errors of the Session.
 func NewServerSession(conn net.Conn, server *http.Server) *Session {
+	maxHeader := DEFAULT_MAX_HEADER_BYTES
+	if server != nil && server.MaxHeaderBytes > 0 {
+		maxHeader = server.MaxHeaderBytes
+	}
 	s := &Session{
 		conn:         conn,
 		out:          make(chan frame),
 		in:           make(chan frame),
 		new_stream:   make(chan *Stream),
 		end_stream:   make(chan *Stream),
+		list_streams: make(chan chan []*Stream),
 		server:       server,
 		headerWriter: newHeaderWriter(),
-		headerReader: newHeaderReader(),
+		headerReader: newHeaderReader(maxHeader),
 		nextStream:   2,
 		nextPing:     2,
 		streams:      make(map[streamID]*Stream),
 		pinger:       make(chan uint32),
+		sender_exit:  make(chan bool),
+		done:         make(chan bool),
+
+		maxFrameBytes: DEFAULT_MAX_FRAME_BYTES,
+		writeTimeout:  DEFAULT_WRITE_TIMEOUT,
+	}
+	if server != nil {
+		s.maxConcurrentStreams = DEFAULT_MAX_CONCURRENT_STREAMS
+		s.maxConcurrentPushes = DEFAULT_MAX_CONCURRENT_PUSHES
+		s.maxPushesPerRequest = DEFAULT_MAX_PUSHES_PER_REQUEST
+		s.pushCache = &sessionPushCache{urls: make(map[string]bool)}
+		if server.WriteTimeout > 0 {
+			s.writeTimeout = server.WriteTimeout
+		}
+		s.idleTimeout = server.IdleTimeout
+		s.errorLog = server.ErrorLog
 	}
 
+	// with the values net/http gives the contexts of its requests
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, conn.LocalAddr())
+	if server != nil {
+		ctx = context.WithValue(ctx, http.ServerContextKey, server)
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
 	return s
 }
 
 // NewClientSession creates a new Session that should be used as a client.
-// the given http.Server will be used to serve requests arriving.  The user
-// should call Serve() once it's ready to start serving. New streams will be
-// created as per the SPDY protocol.
+// The user should call Serve() once it's ready to start serving. New
+// streams will be created as per the SPDY protocol. No protocol is
+// negotiated: both ends of the connection are to agree on SPDY already,
+// with prior knowledge, as with ServeConn at the other end.
 func NewClientSession(conn net.Conn) *Session {
 	s := &Session{
 		conn:         conn,
@@ -53,15 +89,23 @@ func NewClientSession(conn net.Conn) *Session {
 		in:           make(chan frame),
 		new_stream:   make(chan *Stream),
 		end_stream:   make(chan *Stream),
+		list_streams: make(chan chan []*Stream),
 		server:       nil,
 		headerWriter: newHeaderWriter(),
-		headerReader: newHeaderReader(),
+		headerReader: newHeaderReader(DEFAULT_MAX_HEADER_BYTES),
 		nextStream:   1,
 		nextPing:     1,
 		streams:      make(map[streamID]*Stream),
 		pinger:       make(chan uint32),
+		sender_exit:  make(chan bool),
+		done:         make(chan bool),
+
+		maxFrameBytes: DEFAULT_MAX_FRAME_BYTES,
+		writeTimeout:  DEFAULT_WRITE_TIMEOUT,
 	}
 
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
 	return s
 }
 
@@ -70,9 +114,18 @@ func NewClientSession(conn net.Conn) *Session {
 func (s *Session) Serve() (err error) {
 
 	debug.Println("Session server started")
+	metrics.Add("sessions_opened", 1)
+	defer metrics.Add("sessions_closed", 1)
+	liveSessions.add(s)
+	defer liveSessions.remove(s)
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+	if s.pingInterval > 0 {
+		go s.pingLoop()
+	}
 
-	receiver_done := make(chan bool)
-	sender_done := make(chan bool)
+	// buffered, as only one of them is waited for
+	receiver_done := make(chan bool, 1)
+	sender_done := make(chan bool, 1)
 
 	// start frame sender
 	go s.frameSender(sender_done, s.out)
@@ -80,21 +133,39 @@ func (s *Session) Serve() (err error) {
 	// start frame receiver
 	go s.frameReceiver(receiver_done, s.in)
 
+	s.sendSettings()
+
 	// start serving loop
 	err = s.session_loop(sender_done, receiver_done)
 	if err != nil {
-		log.Printf("ERROR: %s", netErrorString(err))
+		s.logger().Error("session failed", "err", netErrorString(err))
+		err = s.sessionError(err.Error())
 	}
 
+	// the streams fail with the error of the session, and everything
+	// with a context derived from its own, like handlers and the requests
+	// they make, unwinds right away
+	for _, str := range s.streams {
+		str.initCloseErr(s.sessionError("session closed before the reply"))
+	}
+	s.cancel()
+
 	// force removing all existing streams
 	for i := range s.streams {
-		str := s.streams[i]
-		str.finish_stream()
-		delete(s.streams, i)
+		s.streams[i].finish_stream()
+		s.removeStream(i)
 	}
 
 	// close this session
 	s.Close()
+	s.headerReader.release()
+	if s.pushCache != nil {
+		s.pushCache.Forget(s)
+	}
+	s.setState(SESSION_CLOSED)
+	if s.events != nil && s.events.SessionClosed != nil {
+		s.events.SessionClosed(err)
+	}
 	debug.Println("Session closed. Session server done.")
 
 	return
@@ -102,14 +173,27 @@ func (s *Session) Serve() (err error) {
 
 func (s *Session) session_loop(sender_done, receiver_done <-chan bool) (err error) {
 	for {
+		var idle <-chan time.Time
+		if s.idleTimeout > 0 && len(s.streams) == 0 {
+			idle = time.After(s.idleTimeout)
+		}
 		select {
-		case f := <-s.in:
+		case f, ok := <-s.in:
+			if !ok {
+				// the receiver is done
+				return
+			}
 			// received a frame
+			if str, ok := s.streams[frameStreamID(f)]; ok {
+				str.countReceived(8 + len(f.Data()))
+			}
 			switch frame := f.(type) {
 			case controlFrame:
 				err = s.processControlFrame(frame)
 			case dataFrame:
 				err = s.processDataFrame(frame)
+			case largeHeaderFrame:
+				err = s.processLargeHeaders(frame)
 			}
 			if err != nil {
 				return
@@ -117,23 +201,37 @@ func (s *Session) session_loop(sender_done, receiver_done <-chan bool) (err erro
 		case ns, ok := <-s.new_stream:
 			// registering a new stream for this session
 			if ok {
-				s.streams[ns.id] = ns
+				s.addStream(ns)
 			} else {
 				return
 			}
 		case os, ok := <-s.end_stream:
 			// unregistering a stream from this session
 			if ok {
-				delete(s.streams, os.id)
+				s.removeStream(os.id)
 			} else {
 				return
 			}
+		case reply := <-s.list_streams:
+			// the streams for other goroutines
+			list := make([]*Stream, 0, len(s.streams))
+			for _, str := range s.streams {
+				list = append(list, str)
+			}
+			reply <- list
 		case _, _ = <-receiver_done:
 			debug.Println("Session receiver is done")
 			return
+		case <-s.done:
+			debug.Println("Session closed")
+			return
 		case _, _ = <-sender_done:
 			debug.Println("Session sender is done")
 			return
+		case <-idle:
+			debug.Println("Session idle for too long")
+			s.goAway(GOAWAY_OK)
+			return
 		}
 	}
 }
@@ -142,123 +240,753 @@ func (s *Session) session_loop(sender_done, receiver_done <-chan bool) (err erro
 // It should be called when the Session is idle for best results.
 func (s *Session) Close() {
 	// FIXME - what else do we need to do here?
-	if s.closed {
+	if !s.closed.CompareAndSwap(false, true) {
 		debug.Println("WARNING: session was already closed - why?")
 		return
 	}
 
-	s.closed = true
-
 	// in case any of the closes below clashes
 	defer no_panics()
 
-	close(s.out)
-	close(s.in)
-	close(s.pinger)
+	close(s.done)
+
+	// give the sender a chance to flush its last frame, like a GOAWAY
+	select {
+	case <-s.sender_exit:
+	case <-time.After(time.Second):
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
 
 	debug.Println("Closing the network connection")
 	s.conn.Close()
 }
 
-// return the next stream id
+// CloseWithError closes the Session right away, without waiting for its
+// streams, telling the other end why with a GOAWAY of the given status:
+// GOAWAY_OK, GOAWAY_PROTOCOL_ERROR or GOAWAY_INTERNAL_ERROR. The reads,
+// writes and requests of the streams still open fail with a *SessionError
+// of the GOAWAY, and the network connection is closed
+func (s *Session) CloseWithError(status uint32) error {
+	if status > GOAWAY_INTERNAL_ERROR {
+		return errors.New(fmt.Sprintf("spdy: unknown GOAWAY status %d", status))
+	}
+	if s.closed.Load() {
+		return s.sessionError("session already closed")
+	}
+	s.goAway(status)
+	s.Close()
+	return nil
+}
+
+// Context returns the context of the Session, which is done once the
+// session is, like when its connection goes away. The contexts of the
+// requests served on it are derived from it
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// LocalAddr returns the local network address of the Session
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the network address of the peer of the Session
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// TLSConnectionState returns the state of the TLS connection of the
+// Session, or nil if the Session is not over TLS
+func (s *Session) TLSConnectionState() *tls.ConnectionState {
+	c, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := c.ConnectionState()
+	return &state
+}
+
+// Tag returns the Tag of the SessionConfig of the Session, as returned by
+// the OnNewSession hook of its Server, if any
+func (s *Session) Tag() interface{} {
+	return s.tag
+}
+
+// Stats returns a snapshot of the counters of the Session
+func (s *Session) Stats() SessionStats {
+	version := "spdy/3"
+	if state := s.TLSConnectionState(); state != nil && state.NegotiatedProtocol != "" {
+		version = state.NegotiatedProtocol
+	}
+	raw := atomic.LoadInt64(&s.headerWriter.raw)
+	compressed := atomic.LoadInt64(&s.headerWriter.compressed)
+	return SessionStats{
+		ActiveStreams: s.NumActiveStreams(),
+		TotalStreams:  atomic.LoadInt64(&s.totalStreams),
+		BytesSent:     atomic.LoadInt64(&s.bytesSent),
+		BytesReceived: atomic.LoadInt64(&s.bytesReceived),
+		SendWindow:    s.initialSendWindow(),
+		ReceiveWindow: s.initialReceiveWindow(),
+		LastPingRTT:   time.Duration(atomic.LoadInt64(&s.lastPingRTT)),
+		RTT:           time.Duration(atomic.LoadInt64(&s.rtt)),
+		Version:       version,
+
+		HeaderBytes:            raw,
+		CompressedHeaderBytes:  compressed,
+		HeaderCompressionRatio: compressionRatio(raw, compressed),
+	}
+}
+
+// setHeaderCompression makes the session compress the headers it sends
+// with the given zlib level. It is to be called before serving
+func (s *Session) setHeaderCompression(level int) {
+	s.headerWriter.release()
+	s.headerWriter = newHeaderWriterDict(level, s.headerWriter.dict)
+}
+
+// SetHeaderDictionary makes the session compress and decompress the
+// header blocks with the given zlib dictionary, rather than the one of
+// SPDY/3, for private deployments with headers of their own. The other
+// end is to use the same dictionary. It is to be called before serving
+func (s *Session) SetHeaderDictionary(dict []byte) {
+	if len(dict) == 0 {
+		dict = nil
+	}
+	s.headerReader.dict = dict
+	s.headerWriter.release()
+	s.headerWriter = newHeaderWriterDict(s.headerWriter.level, dict)
+}
+
+// SetLogger sets the logger for the messages of this session, which are
+// otherwise written to the ErrorLog of its http.Server, if any, or to the
+// log of the package. It is to be called before serving
+func (s *Session) SetLogger(l *slog.Logger) {
+	s.slogger = l
+}
+
+// logger returns the logger for the messages of this session, with its
+// remote address
+func (s *Session) logger() *slog.Logger {
+	l := s.slogger
+	if l == nil {
+		l = defaultLogger(s.errorLog)
+	}
+	return l.With("session", s.conn.RemoteAddr().String())
+}
+
+// return the next stream id, with the stream to send its SYN_STREAM
+// after the ones before it
 func (s *Session) nextStreamID() streamID {
-	return (streamID)(atomic.AddUint32((*uint32)(&s.nextStream), 2) - 2)
+	s.synMu.Lock()
+	defer s.synMu.Unlock()
+	id := (streamID)(atomic.AddUint32((*uint32)(&s.nextStream), 2) - 2)
+	if id <= MAX_STREAM_ID {
+		if s.synPending == nil {
+			s.synPending = make(map[streamID]bool)
+		}
+		s.synPending[id] = true
+	}
+	return id
+}
+
+// sendSynStream queues the SYN_STREAM of a stream of this end once the
+// streams with lower IDs are done with theirs, as the other end takes
+// them in the order of their IDs only. It returns false if the session
+// is closed
+func (s *Session) sendSynStream(f frameSynStream) bool {
+	for {
+		s.synMu.Lock()
+		if s.synTurn == nil {
+			s.synTurn = make(chan struct{})
+		}
+		turn := s.synTurn
+		first := true
+		for id := range s.synPending {
+			if id < f.stream {
+				first = false
+				break
+			}
+		}
+		if first {
+			// queued with the lock held, for the next one to go after it
+			ok := s.send(f)
+			s.synDoneLocked(f.stream)
+			s.synMu.Unlock()
+			return ok
+		}
+		s.synMu.Unlock()
+		select {
+		case <-turn:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// synDone lets the streams after the given one send their SYN_STREAM, as
+// it will not send its own, like when it ends before its request
+func (s *Session) synDone(id streamID) {
+	s.synMu.Lock()
+	defer s.synMu.Unlock()
+	s.synDoneLocked(id)
+}
+
+func (s *Session) synDoneLocked(id streamID) {
+	if !s.synPending[id] {
+		return
+	}
+	delete(s.synPending, id)
+	if s.synTurn != nil {
+		close(s.synTurn)
+		s.synTurn = nil
+	}
+}
+
+// register a stream in the session
+func (s *Session) addStream(str *Stream) {
+	if _, found := s.streams[str.id]; !found {
+		metrics.Add("streams_opened", 1)
+		atomic.AddInt64(&s.totalStreams, 1)
+		s.counted.Store(str.id, str)
+		if atomic.AddInt32(&s.activeStreams, 1) == 1 {
+			s.setState(SESSION_ACTIVE)
+		}
+		if !s.isLocalStream(str.id) {
+			atomic.AddInt32(&s.peerStreams, 1)
+		}
+		s.streams[str.id] = str
+		if s.events != nil && s.events.StreamOpened != nil {
+			s.events.StreamOpened(str)
+		}
+		return
+	}
+	s.streams[str.id] = str
+}
+
+// unregister a stream from the session
+func (s *Session) removeStream(id streamID) {
+	if str, found := s.streams[id]; found {
+		metrics.Add("streams_closed", 1)
+		s.counted.Delete(id)
+		if o := observed(); o != nil {
+			o.StreamClosed(time.Since(str.started))
+		}
+		if str.associated_stream != 0 {
+			atomic.AddInt32(&s.activePushes, -1)
+		}
+		if !s.isLocalStream(id) {
+			atomic.AddInt32(&s.peerStreams, -1)
+		}
+		// the data charged after the stream let go of its own, if any
+		s.budget.drop(str)
+		if atomic.AddInt32(&s.activeStreams, -1) == 0 {
+			atomic.StoreInt64(&s.idleSince, time.Now().UnixNano())
+			s.setState(SESSION_IDLE)
+		}
+		delete(s.streams, id)
+		if s.events != nil && s.events.StreamClosed != nil {
+			s.events.StreamClosed(str, str.closeError())
+		}
+		return
+	}
+	delete(s.streams, id)
+}
+
+// SetReplyTimeout makes the client streams of the session that get no
+// SYN_REPLY within d reset with RST_CANCEL, failing their requests with
+// ErrResponseHeaderTimeout. It is to be called before serving
+func (s *Session) SetReplyTimeout(d time.Duration) {
+	s.replyTimeout = d
+}
+
+// SetMaxFrameBytes sets the maximum payload size of the frames received,
+// over which the session goes away, or only the stream is reset for a
+// header frame. It is to be called before serving
+func (s *Session) SetMaxFrameBytes(n int) {
+	s.maxFrameBytes = n
+}
+
+// SetEvents makes the session run the callbacks of the SessionEvents on
+// its events. It is to be called before serving
+func (s *Session) SetEvents(e *SessionEvents) {
+	s.events = e
+}
+
+// liveStreams returns the streams of the session by ID, as of the
+// session loop, or none if it is not serving
+func (s *Session) liveStreams() (list []*Stream) {
+	reply := make(chan []*Stream, 1)
+	select {
+	case s.list_streams <- reply:
+		list = <-reply
+	case <-s.sender_exit:
+		return nil
+	case <-time.After(time.Second):
+		return nil
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return
+}
+
+// Streams returns a snapshot of the streams open on the Session, by ID,
+// or none if it is not serving
+func (s *Session) Streams() (list []StreamInfo) {
+	for _, str := range s.liveStreams() {
+		list = append(list, StreamInfo{ID: uint32(str.id), Priority: str.priority, StreamStats: str.Stats()})
+	}
+	return
+}
+
+// report a change of state of the session
+func (s *Session) setState(state SessionState) {
+	atomic.StoreInt32(&s.state, int32(state))
+	if s.connState != nil {
+		s.connState(s, state)
+	}
+}
+
+func (state SessionState) String() string {
+	switch state {
+	case SESSION_NEW:
+		return "new"
+	case SESSION_ACTIVE:
+		return "active"
+	case SESSION_IDLE:
+		return "idle"
+	case SESSION_CLOSED:
+		return "closed"
+	}
+	return fmt.Sprintf("SessionState(%d)", int(state))
+}
+
+// NumActiveStreams returns the number of streams open on the Session
+func (s *Session) NumActiveStreams() int {
+	return int(atomic.LoadInt32(&s.activeStreams))
+}
+
+// numPeerStreams returns the number of streams open on the Session that
+// the other end started
+func (s *Session) numPeerStreams() int {
+	return int(atomic.LoadInt32(&s.peerStreams))
+}
+
+// can another stream be started without going over the streams
+// limit of the other end? Only the streams of this end count
+func (s *Session) canOpenStream() bool {
+	local := s.NumActiveStreams() - s.numPeerStreams()
+	return s.peerAllows(local + int(atomic.LoadInt32(&s.reservedStreams)) + 1)
+}
+
+// peerAllows tells if n streams of this end are within the streams limit
+// of the other end
+func (s *Session) peerAllows(n int) bool {
+	max := atomic.LoadUint32(&s.peerMaxConcurrentStreams)
+	return max == 0 || n <= int(max)
+}
+
+// hasStreamIDs tells if there are stream IDs left for new streams
+func (s *Session) hasStreamIDs() bool {
+	return atomic.LoadUint32((*uint32)(&s.nextStream)) <= MAX_STREAM_ID
+}
+
+// goAway tells the other end with a GOAWAY that no more streams will be
+// accepted, and refuses any new streams from now on
+func (s *Session) goAway(status uint32) {
+	defer no_panics()
+	atomic.StoreInt32(&s.going_away, 1)
+	s.wentAway(status, s.lastGoodStreamID(), false)
+	s.send(goawayFor(s.lastGoodStreamID(), status))
+}
+
+// is this session going away?
+func (s *Session) goingAway() bool {
+	return atomic.LoadInt32(&s.going_away) == 1
+}
+
+// refuseStream resets the stream of a SYN_STREAM frame with REFUSED_STREAM
+func (s *Session) refuseStream(frame controlFrame) error {
+	debug.Printf("Refusing stream #%d", frame.streamID())
+	return s.rejectStream(frame, RST_REFUSED_STREAM)
+}
+
+// rejectStream resets the stream of a SYN_STREAM frame with the given
+// status, without starting it
+func (s *Session) rejectStream(frame controlFrame, status uint32) error {
+	if len(frame.data) > 10 {
+		// keep the compression context in sync
+		if err := s.decodeHeaders(&frame, 10); err != nil {
+			return err
+		}
+	}
+	s.send(rstStreamFor(frame.streamID(), status))
+	return nil
+}
+
+// decodeHeaders decodes the header block of a frame received, from the
+// given offset of its data, in the compression context of the session.
+// A block that cannot be inflated leaves the context out of sync with the
+// other end for good, so the session goes away, with the error returned
+// to end it
+func (s *Session) decodeHeaders(frame *controlFrame, offset int) error {
+	frame.headers, frame.headerErr = s.headerReader.decode(frame.data[offset:])
+	if err, ok := frame.headerErr.(compressionError); ok {
+		s.logger().Error("compression context lost", "stream", frame.streamID(), "err", err)
+		s.goAway(GOAWAY_PROTOCOL_ERROR)
+		return err
+	}
+	return nil
+}
+
+// checkSynStreamID checks the ID of a SYN_STREAM of the other end, which
+// is to be of its parity and above the ones before it. A second SYN_STREAM
+// for a stream still open is an error of the stream, which is reset, and
+// anything else an error of the session. It returns if the stream can be
+// started
+func (s *Session) checkSynStreamID(frame controlFrame) (ok bool, err error) {
+	id := frame.streamID()
+	switch {
+	case id == 0:
+		err = errors.New("SYN_STREAM for stream 0")
+	case s.isLocalStream(id):
+		err = errors.New(fmt.Sprintf("SYN_STREAM #%d with an ID of this end", id))
+	case s.streams[id] != nil:
+		s.logger().Warn("resetting stream opened twice", "stream", id)
+		return false, s.rejectStream(frame, RST_PROTOCOL_ERROR)
+	case id <= s.lastPeerStream:
+		err = errors.New(fmt.Sprintf("SYN_STREAM #%d after #%d", id, s.lastPeerStream))
+	}
+	if err != nil {
+		s.logger().Error("invalid stream ID", "err", err)
+		s.goAway(GOAWAY_PROTOCOL_ERROR)
+		return false, err
+	}
+	s.lastPeerStream = id
+	return true, nil
+}
+
+// return the last stream id initiated by the other end
+func (s *Session) lastGoodStreamID() streamID {
+	return (streamID)(atomic.LoadUint32((*uint32)(&s.lastGoodStream)))
 }
 
 // frameSender takes a channel and gets each of the frames coming from
 // it and sends them down the session connection, until the channel
-// is closed or there are errors in sending over the network
+// is closed or there are errors in sending over the network. It is the
+// only writer of the connection, so the streams of the session hand their
+// frames over without any locking
 func (s *Session) frameSender(done chan<- bool, in <-chan frame) {
-	for f := range in {
-		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		_, err := f.Write(s.conn)
+sending:
+	for {
+		var batch []frame
+		select {
+		case f := <-in:
+			batch = append(batch, f)
+		case <-s.done:
+			// the frames taken before Close, like a GOAWAY, are written
+			break sending
+		}
+		// take the frames queued after it too, to write them at once
+	queued:
+		for len(batch) < MAX_WRITE_BATCH {
+			select {
+			case f := <-in:
+				batch = append(batch, f)
+			default:
+				break queued
+			}
+		}
+		err := s.writeFrames(batch)
+		if s.budget.max > 0 {
+			for _, f := range batch {
+				s.budget.dequeue(queuedSize(f))
+			}
+		}
 		if err != nil {
-			log.Println("ERROR in frameSender.Write:", err)
+			s.logger().Error("cannot write frames", "err", err)
 			break
 		}
 	}
+	// nothing else is compressed for this session
+	s.headerWriter.release()
 	done <- true
+	close(s.sender_exit)
 	debug.Printf("Session sender ended")
 }
 
+// send queues a frame for the sender of the session, returning false if
+// the session is closed, or its sender is done, as then it is not sent.
+// Over the MaxBufferedBytes of the session, DATA waits for the frames
+// queued before it to be sent, while control frames go ahead
+func (s *Session) send(f frame) bool {
+	_, data := f.(dataFrame)
+	size := queuedSize(f)
+	for room := s.budget.queue(size, data); room != nil; room = s.budget.queue(size, data) {
+		select {
+		case <-room:
+		case <-s.done:
+			return false
+		case <-s.sender_exit:
+			return false
+		}
+	}
+	select {
+	case s.out <- f:
+		return true
+	case <-s.done:
+	case <-s.sender_exit:
+	}
+	s.budget.dequeue(size)
+	return false
+}
+
+// queuedSize returns the bytes a frame queued to be sent is counted for.
+// Header blocks are counted as not compressed, as they are compressed only
+// once written
+func queuedSize(f frame) int {
+	switch fr := f.(type) {
+	case dataFrame:
+		return 8 + len(fr.data)
+	case controlFrame:
+		return 8 + len(fr.data)
+	case frameSynStream:
+		return 18 + headerSize(fr.header)
+	case frameSynReply:
+		return 12 + headerSize(fr.headers)
+	case frameHeaders:
+		return 12 + headerSize(fr.headers)
+	}
+	return 8
+}
+
+// writeFrames writes a batch of frames to the network connection with as
+// few writes as possible. The frames and the small DATA payloads are put
+// together, and the larger payloads are written from their own buffers,
+// all in one writev system call over TCP
+func (s *Session) writeFrames(frames []frame) (err error) {
+	var bufs net.Buffers
+	small := new(bytes.Buffer)
+	// the current run of small frames becomes the next buffer
+	cut := func() {
+		if small.Len() > 0 {
+			bufs = append(bufs, small.Bytes())
+			small = new(bytes.Buffer)
+		}
+	}
+	write := func() error {
+		cut()
+		if len(bufs) == 0 {
+			return nil
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		n, err := bufs.WriteTo(s.conn)
+		metrics.Add("bytes_sent", n)
+		atomic.AddInt64(&s.bytesSent, n)
+		bufs = nil
+		return err
+	}
+
+	// the frames as written, for the capture
+	captured := func(start int, data []byte) {
+		if s.capture != nil {
+			s.capture.record(s, append(small.Bytes()[start:small.Len():small.Len()], data...), true)
+		}
+	}
+	for _, f := range frames {
+		if !s.checkSent(f) {
+			if fr, ok := f.(dataFrame); ok && fr.pooled {
+				putDataBuffer(fr.data)
+			}
+			continue
+		}
+		start := small.Len()
+		switch fr := f.(type) {
+		case flushMarker:
+			// done once the frames before it are written
+			err = write()
+			if err != nil {
+				return
+			}
+			fr.Write(s.conn)
+		case dataFrame:
+			countFrame(f, 8+len(fr.data), true)
+			s.countSent(f, 8+len(fr.data))
+			if fr.pooled {
+				defer putDataBuffer(fr.data)
+			}
+			if len(fr.data) <= COALESCE_DATA_BYTES {
+				fr.Write(small)
+				captured(start, nil)
+				continue
+			}
+			fr.writeHead(small)
+			captured(start, fr.data)
+			cut()
+			bufs = append(bufs, fr.data)
+		default:
+			n, werr := f.Write(small)
+			if werr != nil {
+				// a header block not compressed, with the context lost
+				small.Truncate(start)
+				return s.compressionFailed(werr, write)
+			}
+			countFrame(f, int(n), true)
+			s.countSent(f, int(n))
+			captured(start, nil)
+		}
+	}
+	return write()
+}
+
+// compressionFailed ends the session once a header block cannot be
+// compressed, as no other can be from then on: it goes away with an
+// INTERNAL_ERROR, sent after the frames before it, and the error becomes
+// the one of the session and its streams
+func (s *Session) compressionFailed(err error, write func() error) error {
+	s.logger().Error("compression context lost", "err", err)
+	atomic.StoreInt32(&s.going_away, 1)
+	s.wentAway(GOAWAY_INTERNAL_ERROR, s.lastGoodStreamID(), false)
+	write()
+	goawayFor(s.lastGoodStreamID(), GOAWAY_INTERNAL_ERROR).Write(s.conn)
+	return err
+}
+
+// countSent adds a frame sent to the counters of its stream, if any
+func (s *Session) countSent(f frame, size int) {
+	if id := frameStreamID(f); id != 0 {
+		if str, ok := s.counted.Load(id); ok {
+			atomic.AddInt64(&str.(*Stream).bytesSent, int64(size))
+			atomic.AddInt64(&str.(*Stream).framesSent, 1)
+		}
+	}
+}
+
+// frameStreamID returns the ID of the stream of a frame, or 0 for the
+// frames of the session as a whole
+func frameStreamID(f frame) streamID {
+	switch fr := f.(type) {
+	case dataFrame:
+		return fr.stream
+	case *dataFrame:
+		return fr.stream
+	case frameSynStream:
+		return fr.stream
+	case frameSynReply:
+		return fr.stream
+	case frameHeaders:
+		return fr.stream
+	case controlFrame:
+		switch fr.kind {
+		case FRAME_SYN_STREAM, FRAME_SYN_REPLY, FRAME_RST_STREAM, FRAME_HEADERS, FRAME_WINDOW_UPDATE:
+			if len(fr.data) >= 4 {
+				return fr.streamID()
+			}
+		}
+	}
+	return 0
+}
+
 // frameReceiver takes a channel and receives frames, sending them to
-// the network connection until there is an error
+// the network connection until there is an error or the session is closed.
+// It is the only sender on the channel, which it closes once done
 func (s *Session) frameReceiver(done chan<- bool, incoming chan<- frame) {
 	defer no_panics()
 
+receiving:
 	for {
-		frame, err := readFrame(s.conn)
+		frame, err := readFrame(s.conn, s.maxFrameBytes)
 		if err == io.EOF {
 			// normal reasons, like disconnection, etc.
 			break
 		}
+		if large, ok := frame.(largeHeaderFrame); ok && err == errFrameTooLarge {
+			// the session reads it from the connection, in order with
+			// the header blocks before it
+			large.r = io.LimitReader(s.conn, int64(large.length))
+			large.done = make(chan bool)
+			atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+			select {
+			case incoming <- large:
+			case <-s.done:
+				break receiving
+			}
+			select {
+			case <-large.done:
+			case <-s.done:
+				break receiving
+			}
+			continue
+		}
+		if err == errFrameTooLarge {
+			// the rest of the connection cannot be trusted, go away
+			s.logger().Error("frame too large received", "max", s.maxFrameBytes)
+			s.goAway(GOAWAY_PROTOCOL_ERROR)
+			break
+		}
 		if err != nil {
 			// some other communication error
-			log.Printf("WARN: communication error: %s", netErrorString(err))
+			s.logger().Warn("communication error", "err", netErrorString(err))
 			break
 		}
 		// ship the frame upstream -- this must be ensured to not block
 		debug.Printf("Session got: %s", frame)
-		incoming <- frame
+		atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+		countFrame(frame, 8+len(frame.Data()), false)
+		if s.capture != nil {
+			wire := new(bytes.Buffer)
+			frame.Write(wire)
+			s.capture.record(s, wire.Bytes(), false)
+		}
+		metrics.Add("bytes_received", int64(8+len(frame.Data())))
+		atomic.AddInt64(&s.bytesReceived, int64(8+len(frame.Data())))
+		select {
+		case incoming <- frame:
+		case <-s.done:
+			break receiving
+		}
 	}
+	close(incoming)
 	done <- true
 	debug.Printf("Session receiver ended")
 }
 func (s *Session) processControlFrame(frame controlFrame) (err error) {
+	err = checkSize(frame)
+	if err != nil {
+		// nothing can be read from it, nor answered to its stream
+		s.logger().Error("malformed frame", "err", err)
+		s.goAway(GOAWAY_PROTOCOL_ERROR)
+		return
+	}
 
 	switch frame.kind {
 	case FRAME_SYN_STREAM:
-		err = s.processSynStream(frame)
-		select {
-		case ns, ok := <-s.new_stream:
-			// registering a new stream for this session
-			if ok {
-				s.streams[ns.id] = ns
-			} else {
-				return
-			}
+		var ok bool
+		if ok, err = s.checkSynStreamID(frame); !ok {
+			return
 		}
-		controlflag := 0
-		// for non-FIN frames wait for data frames
-		if !frame.isFIN() {
-			for controlflag == 0 {
-				deadline := time.After(3 * time.Second)
-				select {
-				case f := <-s.in:
-					// received a frame
-					switch fr := f.(type) {
-					case dataFrame:
-						//process data frames
-						err = s.processDataFrame(fr)
-						if fr.isFIN() {
-							controlflag = 1
-						}
-						break
-					case controlFrame:
-						err = s.processControlFrame(fr)
-
-					}
-					if err != nil {
-						return
-					}
-					break
-				case <-deadline:
-					//unsuccessfully waited for FIN
-					debug.Println("Waited long enough but no data frames recieved")
-					controlflag = 2
-					break
-				}
-			}
+		if s.server == nil {
+			// clients do not take pushes
+			debug.Printf("Cancelling pushed stream #%d", frame.streamID())
+			return s.rejectStream(frame, RST_CANCEL)
 		}
-		return
+		if s.goingAway() {
+			return s.refuseStream(frame)
+		}
+		// the limit is of the streams of the other end, not of the pushes
+		if open := s.numPeerStreams(); s.maxConcurrentStreams > 0 && open >= int(s.maxConcurrentStreams) {
+			s.logger().Warn("refusing stream", "stream", frame.streamID(), "open", open)
+			return s.refuseStream(frame)
+		}
+		return s.processSynStream(frame)
 	case FRAME_SYN_REPLY:
 		return s.processSynReply(frame)
 	case FRAME_SETTINGS:
 		s.processSettings(frame)
 		return nil
 	case FRAME_RST_STREAM:
-		// just to avoid locking issues, send it in a goroutine
-		go s.processRstStream(frame)
+		s.processRstStream(frame)
 	case FRAME_PING:
 		return s.processPing(frame)
 	case FRAME_WINDOW_UPDATE:
@@ -266,25 +994,40 @@ func (s *Session) processControlFrame(frame controlFrame) (err error) {
 	case FRAME_GOAWAY:
 		s.processGoaway(frame)
 	case FRAME_HEADERS:
-		panic("FIXME HEADERS")
+		return s.processHeaders(frame)
+	default:
+		// NOOP (from SPDY/2) and unknown frames are to be ignored
+		return s.processUnknownFrame(frame)
 	}
 
 	return
 }
-func (s *Session) SendGoaway(f frameFlags, dat []byte) {
-	s.out <- controlFrame{kind: FRAME_GOAWAY, flags: f, data: dat}
+
+// processUnknownFrame ignores the frame, unless the session is strict
+// about them, in which case it goes away
+func (s *Session) processUnknownFrame(frame controlFrame) (err error) {
+	if !s.strictFrames {
+		debug.Printf("Ignoring %s", frame)
+		return
+	}
+	s.logger().Error("unexpected frame", "frame", frame)
+	s.goAway(GOAWAY_PROTOCOL_ERROR)
+	return errors.New(fmt.Sprintf("unexpected control frame %s", frame.kind))
+}
+func (s *Session) SendGoaway(f FrameFlags, dat []byte) {
+	s.send(controlFrame{kind: FRAME_GOAWAY, flags: f, data: dat})
 }
 
 func (s *Session) processGoaway(frame controlFrame) {
 	if len(frame.data) != 8 {
-		log.Println("ERROR: could not process goaway: Frame should be 8 bits long")
+		s.logger().Error("GOAWAY frame not 8 bytes long", "length", len(frame.data))
 		return
 	}
 	status_code := bytes.NewBuffer(frame.data[4:8])
 	var status int32
 	err := binary.Read(status_code, binary.BigEndian, &status)
 	if err != nil {
-		log.Println("ERROR: Cannot read status code from a goaway frame:", err)
+		s.logger().Error("cannot read the status of a GOAWAY frame", "err", err)
 		return
 	}
 
@@ -295,17 +1038,23 @@ func (s *Session) processGoaway(frame controlFrame) {
 	closeSessionFlag := 0
 
 	//Start going away
-	s.goaway_recvd = true
+	s.goaway_recvd.Store(true)
+	s.wentAway(uint32(status), lst_id, true)
+	if s.events != nil && s.events.GoAwayReceived != nil {
+		s.events.GoAwayReceived(uint32(lst_id), uint32(status))
+	}
 
 	//Close streams with ID > Last-good-stream-ID
 	for id, st := range s.streams {
 		if id > lst_id {
-			if !st.closed {
+			if !st.closed.Load() {
+				st.setCloseErr(&SessionError{GoAway: true, Status: uint32(status), Remote: true, LastGoodStreamID: uint32(lst_id),
+					Retry: true, Reason: fmt.Sprintf("stream #%d not processed", id)})
 				st.finish_stream()
-				delete(s.streams, id)
+				s.removeStream(id)
 			}
 		} else {
-			if !st.closed {
+			if !st.closed.Load() {
 				closeSessionFlag = 1
 			}
 		}
@@ -320,33 +1069,291 @@ func (s *Session) processGoaway(frame controlFrame) {
 func (s *Session) processDataFrame(frame dataFrame) (err error) {
 	stream, found := s.streams[frame.stream]
 	if !found {
-		// no error because this could happen if a stream is closed with outstanding data
+		// like the data in flight for a stream closed by this end, it
+		// is not an error of the session
 		debug.Printf("WARN: stream %d not found", frame.stream)
+		if frame.stream != 0 && !s.goingAway() {
+			s.send(rstStreamFor(frame.stream, RST_INVALID_STREAM))
+		}
 		return
 	}
+	if !s.checkReceived(stream, 0, frame.flags&FLAG_FIN != 0) {
+		return
+	}
+	if atomic.AddInt32(&stream.recvWindow, -int32(len(frame.data))) < 0 {
+		stream.logger().Warn("resetting stream over its flow control window", "size", len(frame.data))
+		s.resetStream(stream, RST_FLOW_CONTROL_ERROR, "over its flow control window")
+		return
+	}
+	if !s.budget.charge(stream, len(frame.data)) {
+		// make room by resetting the streams with the most data waiting
+		for !s.budget.charge(stream, len(frame.data)) {
+			largest := s.budget.largest()
+			if largest == nil || largest == stream {
+				s.resetBuffered(stream)
+				return
+			}
+			s.resetBuffered(largest)
+		}
+	}
 	// send it to the stream for processing. this BETTER NOT BLOCK!
 	deadline := time.After(300 * time.Millisecond)
 	select {
 	case stream.data <- frame:
 		// send this data frame to the corresponding stream
 	case <-deadline:
-		// maybe it closed just before we tried to send it
+		// maybe it closed just before we tried to send it. If not, the
+		// reader is not to take the body without it as complete
 		debug.Printf("Stream #%d: session timed out while sending northbound data", stream.id)
+		s.budget.drop(stream)
+		if !stream.closed.Load() {
+			stream.logger().Warn("resetting stream with data not delivered", "size", len(frame.data))
+			s.resetStream(stream, RST_INTERNAL_ERROR, "data not delivered")
+		}
 	}
 
 	return
 }
 
+// resetBuffered resets a stream to free the data buffered for it, as the
+// session is over its MaxBufferedBytes
+func (s *Session) resetBuffered(str *Stream) {
+	str.logger().Warn("resetting stream over the buffered data limit", "buffered", s.budget.buffered(str), "max", s.budget.max)
+	s.resetStream(str, RST_CANCEL, "over the buffered data limit")
+}
+
+// resetStream resets a stream with the given status, ending it with a
+// StreamError for the reason given
+func (s *Session) resetStream(str *Stream, status uint32, reason string) {
+	str.setCloseErr(&StreamError{StreamID: uint32(str.id), Status: status, Reason: reason})
+	str.sendRstStream(status)
+	s.budget.drop(str)
+	go str.finish_stream()
+}
+
+// newRateLimiter returns a limiter of the given bytes per second, or nil
+// for no limit
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: DATA_BUFFER_SIZE, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until they are there or
+// done is closed, when the bytes are given back. The bytes are reserved
+// first, so that concurrent frames go in turns
+func (r *rateLimiter) wait(n int, done <-chan struct{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > DATA_BUFFER_SIZE {
+		r.tokens = DATA_BUFFER_SIZE
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	delay := time.Duration(-r.tokens / r.rate * float64(time.Second))
+	r.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+		r.mu.Lock()
+		r.tokens += float64(n)
+		r.mu.Unlock()
+	}
+}
+
+// charge accounts for n more bytes buffered for a stream, if they are
+// within the limit
+func (b *bufferBudget) charge(str *Stream, n int) bool {
+	if b.max == 0 || n == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.total+int64(n) > b.max {
+		return false
+	}
+	if b.streams == nil {
+		b.streams = make(map[*Stream]int64)
+	}
+	b.total += int64(n)
+	b.streams[str] += int64(n)
+	return true
+}
+
+// fits returns if n more bytes are within the limit
+func (b *bufferBudget) fits(n int) bool {
+	if b.max == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total+int64(n) <= b.max
+}
+
+// add accounts for n more bytes buffered for a stream, over the limit or not
+func (b *bufferBudget) add(str *Stream, n int) {
+	if b.max == 0 || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streams == nil {
+		b.streams = make(map[*Stream]int64)
+	}
+	b.total += int64(n)
+	b.streams[str] += int64(n)
+}
+
+// queue accounts for a frame of n bytes queued to be sent. If it is to wait
+// and is over the limit with other frames queued, it is not counted, and
+// the channel returned is closed once some of them are sent
+func (b *bufferBudget) queue(n int, wait bool) <-chan struct{} {
+	if b.max == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait && b.sending > 0 && b.total+int64(n) > b.max {
+		if b.room == nil {
+			b.room = make(chan struct{})
+		}
+		return b.room
+	}
+	b.total += int64(n)
+	b.sending += int64(n)
+	return nil
+}
+
+// dequeue accounts for a frame of n bytes sent, or not to be sent
+func (b *bufferBudget) dequeue(n int) {
+	if b.max == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total -= int64(n)
+	b.sending -= int64(n)
+	if b.room != nil {
+		close(b.room)
+		b.room = nil
+	}
+}
+
+// release accounts for n bytes of a stream consumed
+func (b *bufferBudget) release(str *Stream, n int) {
+	if b.max == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	size := int64(n)
+	if size > b.streams[str] {
+		// reset already
+		size = b.streams[str]
+	}
+	b.total -= size
+	b.streams[str] -= size
+	if b.streams[str] == 0 {
+		delete(b.streams, str)
+	}
+}
+
+// drop forgets about the bytes buffered for a stream, once it is done
+func (b *bufferBudget) drop(str *Stream) {
+	if b.max == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total -= b.streams[str]
+	delete(b.streams, str)
+}
+
+// buffered returns the bytes buffered for a stream
+func (b *bufferBudget) buffered(str *Stream) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.streams[str]
+}
+
+// largest returns the stream with the most bytes buffered, if any
+func (b *bufferBudget) largest() (str *Stream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var max int64
+	for s, size := range b.streams {
+		if size > max {
+			str, max = s, size
+		}
+	}
+	return
+}
+
 func (s *Session) processSynStream(frame controlFrame) (err error) {
+	err = s.decodeHeaders(&frame, 10)
+	if err != nil {
+		return
+	}
+	atomic.StoreUint32((*uint32)(&s.lastGoodStream), uint32(frame.streamID()))
+	if !s.budget.fits(headerSize(frame.headers)) {
+		s.logger().Warn("refusing stream over the buffered data limit", "stream", frame.streamID(), "max", s.budget.max)
+		s.send(rstStreamFor(frame.streamID(), RST_REFUSED_STREAM))
+		return
+	}
 	_, err = s.newServerStream(frame)
 	if err != nil {
-		log.Printf(fmt.Sprintf("cannot create syn stream frame: %s", err))
+		s.logger().Error("cannot create stream", "stream", frame.streamID(), "err", err)
 		return
 	}
 
 	return
 }
 
+// processLargeHeaders reads the header block of a frame over the size
+// limit off the connection and resets its stream with FRAME_TOO_LARGE,
+// rather than going away for a single stream
+func (s *Session) processLargeHeaders(frame largeHeaderFrame) (err error) {
+	defer close(frame.done)
+	fixed := 4
+	if frame.kind == FRAME_SYN_STREAM {
+		fixed = 10
+	}
+	frame.data = make([]byte, fixed)
+	_, err = io.ReadFull(frame.r, frame.data)
+	if err != nil {
+		return
+	}
+	err = s.headerReader.discard(frame.r)
+	if _, ok := err.(compressionError); ok {
+		s.logger().Error("compression context lost", "stream", frame.streamID(), "err", err)
+		s.goAway(GOAWAY_PROTOCOL_ERROR)
+		return
+	}
+	id := frame.streamID()
+	s.logger().Warn("resetting stream with a header frame too large", "stream", id, "size", frame.length, "max", s.maxFrameBytes)
+	if frame.kind == FRAME_SYN_STREAM {
+		var ok bool
+		if ok, err = s.checkSynStreamID(frame.controlFrame); ok {
+			s.send(rstStreamFor(id, RST_FRAME_TOO_LARGE))
+		}
+		return
+	}
+	if str, ok := s.streams[id]; ok && !str.closed.Load() {
+		s.resetStream(str, RST_FRAME_TOO_LARGE, "header frame too large")
+	}
+	return nil
+}
+
 func (s *Session) processSynReply(frame controlFrame) (err error) {
 
 	debug.Println("Processing SYN_REPLY received")
@@ -357,43 +1364,217 @@ func (s *Session) processSynReply(frame controlFrame) (err error) {
 	}
 
 	stream, ok := s.streams[id]
-	if !ok {
-		err = errors.New(fmt.Sprintf("Stream with ID %d not found", id))
-		log.Printf("ERROR: %s", err)
-		return
+	if !ok || stream.closed.Load() {
+		// like a stream cancelled by this end, keep the compression context in sync
+		debug.Printf("SYN_REPLY for unknown stream #%d ignored", id)
+		return s.decodeHeaders(&frame, 4)
 	}
 
 	// send this control frame to the corresponding stream
+	err = s.decodeHeaders(&frame, 4)
+	if err != nil {
+		return
+	}
+	if !s.checkReceived(stream, frame.kind, frame.isFIN()) {
+		return
+	}
+	if !s.budget.charge(stream, headerSize(frame.headers)) {
+		s.resetBuffered(stream)
+		return
+	}
 	stream.control <- frame
 	return
 }
 
 // Read details for SETTINGS frame
-//FIXME : shows error unexpected EOF when communicating with firefox
+func (s *Session) processHeaders(frame controlFrame) (err error) {
+
+	debug.Println("Processing HEADERS received")
+	id := frame.streamID()
+	if id == 0 {
+		err = errors.New("Invalid stream ID 0 received")
+		return
+	}
+
+	stream, ok := s.streams[id]
+	if !ok || stream.closed.Load() {
+		// like a stream cancelled by this end, keep the compression context in sync
+		debug.Printf("HEADERS for unknown stream #%d ignored", id)
+		return s.decodeHeaders(&frame, 4)
+	}
+
+	// send this control frame to the corresponding stream
+	err = s.decodeHeaders(&frame, 4)
+	if err != nil {
+		return
+	}
+	if !s.checkReceived(stream, frame.kind, frame.isFIN()) {
+		return
+	}
+	if !s.budget.charge(stream, headerSize(frame.headers)) {
+		s.resetBuffered(stream)
+		return
+	}
+	stream.control <- frame
+	return
+}
+
 func (s *Session) processSettings(frame controlFrame) (err error) {
-	s.settings = new(settings)
-	data := bytes.NewBuffer(frame.data)
-	err = binary.Read(data, binary.BigEndian, &s.settings.count)
+	settings := new(SettingsFrame)
+	err = settings.fromControl(frame)
 	if err != nil {
+		s.logger().Error("cannot read SETTINGS frame", "err", err)
 		return
 	}
-	s.settings.svp = make([]settingsValuePairs, s.settings.count)
-	for i := uint32(0); i < s.settings.count; i++ {
-		err = binary.Read(data, binary.BigEndian, &s.settings.svp[i].flags)
-		if err != nil {
-			return
+	debug.Println("Got", settings)
+	s.settings = settings
+	if settings.Flags&FLAG_SETTINGS_CLEAR_SETTINGS != 0 {
+		s.clearSettings()
+	}
+	for _, v := range settings.Values {
+		s.applySetting(v)
+	}
+	if s.settingsStore != nil && s.server == nil {
+		s.persist(settings.Values)
+	}
+	if s.events != nil && s.events.SettingsReceived != nil {
+		s.events.SettingsReceived(settings)
+	}
+	return
+}
+
+// applySetting takes a SETTINGS value of the other end
+func (s *Session) applySetting(v SettingsValue) {
+	switch v.ID {
+	case SETTINGS_MAX_CONCURRENT_STREAMS:
+		atomic.StoreUint32(&s.peerMaxConcurrentStreams, v.Value)
+	case SETTINGS_INITIAL_WINDOW_SIZE:
+		s.setInitialWindowSize(v.Value)
+	}
+}
+
+// clearSettings reverts the SETTINGS of the other end to the defaults,
+// and clears the ones persisted by a client
+func (s *Session) clearSettings() {
+	debug.Println("Clearing the SETTINGS of the other end")
+	atomic.StoreUint32(&s.peerMaxConcurrentStreams, 0)
+	s.setInitialWindowSize(uint32(INITIAL_FLOW_CONTOL_WINDOW))
+	if s.settingsStore != nil && s.server == nil && len(s.persisted) > 0 {
+		s.persisted = nil
+		s.settingsStore.Store(s.origin, nil)
+	}
+}
+
+// SetSettingsStore makes a client session persist the SETTINGS values its
+// server asks for in the store, for the origin, e.g. "https://host:443".
+// The session starts with the values persisted already, and sends them
+// back to the server, as per SPDY/3. It is to be called before serving
+func (s *Session) SetSettingsStore(store SettingsStore, origin string) {
+	s.settingsStore, s.origin, s.persisted = store, origin, nil
+	if store == nil || s.server != nil {
+		return
+	}
+	// a copy, changed by the session loop
+	s.persisted = append([]SettingsValue(nil), store.Load(origin)...)
+	for _, v := range s.persisted {
+		s.applySetting(v)
+	}
+}
+
+// persist keeps the values of a SETTINGS frame that the server asks to
+// persist, storing them along with the ones persisted already
+func (s *Session) persist(values []SettingsValue) {
+	changed := false
+	for _, v := range values {
+		if v.Flags&FLAG_SETTINGS_PERSIST_VALUE == 0 {
+			continue
 		}
-		err = binary.Read(data, binary.BigEndian, &s.settings.svp[i].id)
-		if err != nil {
-			return
+		v.Flags = 0
+		i := 0
+		for i < len(s.persisted) && s.persisted[i].ID != v.ID {
+			i++
 		}
-		err = binary.Read(data, binary.BigEndian, &s.settings.svp[i].value)
-		if err != nil {
-			return
+		if i == len(s.persisted) {
+			s.persisted = append(s.persisted, v)
+		} else {
+			s.persisted[i] = v
 		}
+		changed = true
 	}
+	if changed {
+		s.settingsStore.Store(s.origin, append([]SettingsValue(nil), s.persisted...))
+	}
+}
 
-	return
+// setInitialWindowSize takes a new initial window size from the other end,
+// which changes the send window of the open streams by the difference
+func (s *Session) setInitialWindowSize(size uint32) {
+	if size > 0x7fffffff {
+		s.logger().Warn("initial window size in SETTINGS ignored", "size", size)
+		return
+	}
+	delta := int32(size) - s.initialSendWindow()
+	atomic.StoreUint32(&s.peerInitialWindowSize, size)
+	if delta == 0 {
+		return
+	}
+	debug.Printf("Initial window size now %d, adjusting open streams by %d", size, delta)
+	for _, str := range s.streams {
+		go str.addFlow(delta)
+	}
+}
+
+// initialSendWindow returns the send window that streams start with
+func (s *Session) initialSendWindow() int32 {
+	if size := atomic.LoadUint32(&s.peerInitialWindowSize); size > 0 {
+		return int32(size)
+	}
+	return INITIAL_FLOW_CONTOL_WINDOW
+}
+
+// initialReceiveWindow returns the receive window that streams start
+// with, as per our SETTINGS
+func (s *Session) initialReceiveWindow() int32 {
+	if s.initialWindowSize > 0 {
+		return int32(s.initialWindowSize)
+	}
+	return INITIAL_FLOW_CONTOL_WINDOW
+}
+
+// receiveWindowLimit returns the bytes the other end may send on a new
+// stream before a WINDOW_UPDATE, which is never below the default, as it
+// may send before getting our SETTINGS
+func (s *Session) receiveWindowLimit() int32 {
+	if window := s.initialReceiveWindow(); window > INITIAL_FLOW_CONTOL_WINDOW {
+		return window
+	}
+	return INITIAL_FLOW_CONTOL_WINDOW
+}
+
+// send our SETTINGS, if there is anything to tell the other end
+func (s *Session) sendSettings() {
+	settings := new(SettingsFrame)
+	if s.maxConcurrentStreams > 0 {
+		settings.Values = append(settings.Values, SettingsValue{ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: s.maxConcurrentStreams})
+	}
+	if s.initialWindowSize > 0 {
+		settings.Values = append(settings.Values, SettingsValue{ID: SETTINGS_INITIAL_WINDOW_SIZE, Value: s.initialWindowSize})
+	}
+	// the values of the server persisted by the client go back to it,
+	// unless the client has its own
+persisted:
+	for _, v := range s.persisted {
+		for _, own := range settings.Values {
+			if own.ID == v.ID {
+				continue persisted
+			}
+		}
+		v.Flags = FLAG_SETTINGS_PERSISTED
+		settings.Values = append(settings.Values, v)
+	}
+	if len(settings.Values) > 0 {
+		s.send(settings.toControl())
+	}
 }
 
 func (s *Session) processRstStream(frame controlFrame) {
@@ -401,24 +1582,26 @@ func (s *Session) processRstStream(frame controlFrame) {
 	debug.Println("Processing RST_STREAM received")
 	id := frame.streamID()
 	if id == 0 {
-		log.Printf("Session: invalid stream ID 0 received")
+		s.logger().Error("RST_STREAM for stream 0 received")
 		return
 	}
 
 	stream, ok := s.streams[id]
-	if !ok || (ok && stream.closed) {
+	if !ok || (ok && stream.closed.Load()) {
 		debug.Printf("Window update for unknown stream #%d ignored", id)
 		debug.Println("known streams are", s.streams)
 		return
 	}
-
-	// send this control frame to the corresponding stream
-	stream.control <- frame
+	// just to avoid locking issues, send this control frame to the
+	// corresponding stream in a goroutine
+	go func() {
+		stream.reset()
+		stream.control <- frame
+	}()
 }
 
 // Read details for PING frame
 func (s *Session) processPing(frame controlFrame) (err error) {
-	s.settings = new(settings)
 	var id uint32
 	data := bytes.NewBuffer(frame.data[0:4])
 	binary.Read(data, binary.BigEndian, &id)
@@ -438,7 +1621,7 @@ func (s *Session) processPing(frame controlFrame) (err error) {
 	}
 
 	// send it right back!
-	s.out <- frame
+	s.send(frame)
 
 	return
 }
@@ -464,17 +1647,20 @@ func (s *Session) Ping(d time.Duration) (pinged bool) {
 
 	defer no_panics()
 
-	s.out <- ping
-
-	pinged = false
+	start := time.Now()
+	if !s.send(ping) {
+		return false
+	}
 
 	select {
-	case pid, ok := <-s.pinger:
-		if ok { // make sure we get the same id we sent back
-			if pid == id {
-				pinged = true
-			}
+	case pid := <-s.pinger:
+		// make sure we get the same id we sent back
+		if pid == id {
+			pinged = true
+			s.addRTT(time.Since(start))
 		}
+	case <-s.done:
+		// closed meanwhile
 	case <-time.After(d):
 		debug.Printf("Pingback timed out")
 		// timeout
@@ -483,13 +1669,66 @@ func (s *Session) Ping(d time.Duration) (pinged bool) {
 	return pinged
 }
 
+// addRTT records the round trip time of a PING, adding it to the moving
+// average with a weight of 1/8, as for TCP
+func (s *Session) addRTT(rtt time.Duration) {
+	atomic.StoreInt64(&s.lastPingRTT, int64(rtt))
+	for {
+		old := atomic.LoadInt64(&s.rtt)
+		avg := int64(rtt)
+		if old > 0 {
+			avg = old - old/8 + avg/8
+		}
+		if atomic.CompareAndSwapInt64(&s.rtt, old, avg) {
+			return
+		}
+	}
+}
+
+// pingLoop pings the session whenever nothing is received for the ping
+// interval, closing it if the other end does not reply
+func (s *Session) pingLoop() {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		quiet := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastReceived)))
+		if quiet < s.pingInterval || s.Ping(s.pingInterval) {
+			continue
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.logger().Warn("closing session without PING reply", "quiet", quiet)
+		s.Close()
+		return
+	}
+}
+
+// windowUpdateThreshold returns the bytes of a stream to consume before
+// giving them back, as per the round trip time of the session
+func (s *Session) windowUpdateThreshold() int64 {
+	rtt := time.Duration(atomic.LoadInt64(&s.rtt))
+	if rtt == 0 || rtt >= BATCH_WINDOW_UPDATE_RTT {
+		return 0
+	}
+	if s.initialWindowSize > 0 {
+		return int64(s.initialWindowSize) / 4
+	}
+	return int64(INITIAL_FLOW_CONTOL_WINDOW) / 4
+}
+
 func (s *Session) processWindowUpdate(frame controlFrame) {
 
 	id := frame.streamID()
 	if id == 0 {
-		// FIXME - rather than panic, just issue a warning, since some
-		// browsers will trigger the panic naturally
-		log.Println("WARNING: no support for session flow control yet")
+		// FIXME - rather than panic, just ignore it, since browsers
+		// send them all the time
+		s.logger().Debug("no support for session flow control yet")
 	}
 
 	stream, ok := s.streams[id]
@@ -497,11 +1736,22 @@ func (s *Session) processWindowUpdate(frame controlFrame) {
 		debug.Printf("Window update for unknown stream #%d ignored", id)
 		return
 	}
-	if stream.closed {
+	if stream.closed.Load() {
 		debug.Printf("Window update for closed stream #%d ignored", id)
 		debug.Println("known streams are", s.streams)
 		return
 	}
+	delta := binary.BigEndian.Uint32(frame.data[4:8]) & 0x7fffffff
+	if delta == 0 {
+		stream.logger().Warn("resetting stream for a WINDOW_UPDATE of 0")
+		s.resetStream(stream, RST_PROTOCOL_ERROR, "WINDOW_UPDATE of 0")
+		return
+	}
+	if int64(atomic.LoadInt32(&stream.sendWindow))+int64(delta) > 0x7fffffff {
+		stream.logger().Warn("resetting stream for a send window over 2^31-1", "delta", delta)
+		s.resetStream(stream, RST_FLOW_CONTROL_ERROR, "send window over 2^31-1")
+		return
+	}
 
 	// just to avoid locking issues, send it in a goroutine, and put a deadline
 	go func() {
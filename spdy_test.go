@@ -8,11 +8,19 @@ package spdy
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -114,7 +122,7 @@ func TestFrames(t *testing.T) {
 		t.Fatal("ERROR in NewClientStream: cannot create stream")
 		return
 	}
-	str.sendRstStream()
+	str.sendRstStream(RST_CANCEL)
 
 	//ping test
 	ping, err := client.Ping(time.Second)
@@ -170,6 +178,11 @@ func TestGoaway(t *testing.T) {
 	f := frameSynStream{session: client_stream1.session, stream: client_stream1.id, header: request.Header, flags: 2}
 	client_stream1.session.out <- f
 
+	//the header of the first request may be being written still
+	request, err = http.NewRequest("POST", "http://localhost:4040/banana", bytes.NewBufferString("hello world"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 	client_stream2 := client.ss.NewClientStream()
 	err = client_stream2.prepareRequestHeader(request)
 	if err != nil {
@@ -187,11 +200,11 @@ func TestGoaway(t *testing.T) {
 		t.Fatal("Stream Made even after goaway sent")
 	}
 
-	if client_stream1.closed == true {
+	if client_stream1.closed.Load() {
 		t.Fatal("Stream#1 closed: unexpected")
 	}
 
-	if client_stream2.closed == false {
+	if !client_stream2.closed.Load() {
 		t.Fatal("Stream#2 alive: unexpected")
 	}
 
@@ -203,3 +216,1989 @@ func TestGoaway(t *testing.T) {
 	//server close
 	server.Close()
 }
+
+func testEncode(t *testing.T, hw *headerWriter, h http.Header) []byte {
+	block, err := hw.encode(h)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return block
+}
+
+func TestHeaderLimit(t *testing.T) {
+	hw := newHeaderWriter()
+	hr := newHeaderReader(64)
+
+	big := make(http.Header)
+	big.Set("X-Big", string(bytes.Repeat([]byte{'a'}, 100)))
+	_, err := hr.decode(testEncode(t, hw, big))
+	if err != errHeaderTooLarge {
+		t.Fatal("Expected a header too large error, got", err)
+	}
+
+	// the compression context must still be usable afterwards
+	small := make(http.Header)
+	small.Set("X-Small", "banana")
+	h, err := hr.decode(testEncode(t, hw, small))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if h.Get("X-Small") != "banana" {
+		t.Fatal("Unexpected header after an oversized block")
+	}
+}
+
+func TestHeaderCompressionFailure(t *testing.T) {
+	hw := newHeaderWriter()
+	hr := newHeaderReader(DEFAULT_MAX_HEADER_BYTES)
+
+	h := make(http.Header)
+	h.Set("X-Small", "banana")
+	block := testEncode(t, hw, h)
+	_, err := hr.decode(block[:len(block)/2])
+	if _, ok := err.(compressionError); !ok {
+		t.Fatal("Expected a compression error, got", err)
+	}
+
+	// the compression context is lost for the blocks after it
+	_, err = hr.decode(testEncode(t, hw, h))
+	if _, ok := err.(compressionError); !ok {
+		t.Fatal("Expected a compression error after a failed block, got", err)
+	}
+}
+
+func TestHeaderWriterFailure(t *testing.T) {
+	hw := newHeaderWriter()
+	h := testRequestHeader("/banana")
+	hw.compressor.Close()
+	hw.buffer.Reset()
+	if _, err := hw.encode(h); err == nil {
+		t.Fatal("Expected an error of a closed compressor")
+	}
+	if hw.buffer.Len() != 0 {
+		t.Fatal("Unexpected data of a failed block:", hw.buffer.Len())
+	}
+
+	// a session goes away once it cannot send a header block
+	cn, sn := net.Pipe()
+	defer cn.Close()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	ss.headerWriter.compressor.Close()
+	go ss.Serve()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: h})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal("No GOAWAY:", err)
+		}
+		switch f := f.(type) {
+		case *SynReplyFrame:
+			t.Fatal("Unexpected reply:", f)
+		case *GoAwayFrame:
+			if f.Status != GOAWAY_INTERNAL_ERROR || f.LastGoodStreamID != 1 {
+				t.Fatal("Unexpected GOAWAY:", f)
+			}
+			return
+		}
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	dataFrame{stream: 1, data: make([]byte, 100)}.Write(buf)
+	_, err := readFrame(buf, 10)
+	if err != errFrameTooLarge {
+		t.Fatal("Expected a frame too large error, got", err)
+	}
+}
+
+func TestClientFrameLimit(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	client, _ := NewClientConnConfig(cn, &ClientConfig{MaxFrameBytes: 1024})
+	defer client.Close()
+	go func() {
+		req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+		client.Do(req)
+	}()
+
+	//a reply with a DATA frame over the limit of the client
+	framer := NewFramer(sn)
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := f.(type) {
+		case *SynStreamFrame:
+			header := make(http.Header)
+			header.Set(HEADER_STATUS, "200 OK")
+			header.Set(HEADER_VERSION, "HTTP/1.1")
+			go func(id uint32) {
+				framer.WriteFrame(&SynReplyFrame{StreamID: id, Header: header})
+				framer.WriteFrame(&DataFrame{StreamID: id, Flags: FLAG_FIN, Data: make([]byte, 2048)})
+			}(f.StreamID)
+		case *GoAwayFrame:
+			if f.Status != GOAWAY_PROTOCOL_ERROR {
+				t.Fatal("Unexpected GOAWAY:", f)
+			}
+			return
+		}
+	}
+}
+
+func TestLargeHeaderFrame(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer cn.Close()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	ss.maxFrameBytes = 1024
+	go ss.Serve()
+
+	//a request with a header block too large, and a good one after it
+	framer := NewFramer(cn)
+	go func() {
+		big := testRequestHeader("/banana")
+		for i := 0; i < 500; i++ {
+			big.Add("X-Big", fmt.Sprint(i*i*7919))
+		}
+		framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: big})
+		framer.WriteFrame(&SynStreamFrame{StreamID: 3, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	}()
+	reset, replied := false, false
+	for !reset || !replied {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := f.(type) {
+		case *RstStreamFrame:
+			if f.StreamID != 1 || f.Status != RST_FRAME_TOO_LARGE {
+				t.Fatal("Unexpected reset:", f)
+			}
+			reset = true
+		case *SynReplyFrame:
+			if f.StreamID != 3 || f.Header.Get(HEADER_STATUS) != "200 OK" {
+				t.Fatal("Unexpected reply:", f)
+			}
+			replied = true
+		case *GoAwayFrame:
+			t.Fatal("Session gone away:", f)
+		}
+	}
+}
+
+func TestDataBuffers(t *testing.T) {
+	for _, size := range []int{100, DATA_BUFFER_SIZE, DATA_BUFFER_SIZE + 1} {
+		buf := new(bytes.Buffer)
+		data := bytes.Repeat([]byte("x"), size)
+		dataFrame{stream: 1, data: data}.Write(buf)
+		f, err := readFrame(buf, MAX_DATA_PAYLOAD)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		df := f.(dataFrame)
+		if !bytes.Equal(df.data, data) {
+			t.Fatal("Unexpected data of size", len(df.data))
+		}
+		//only payloads that fit in a buffer of the pool use one
+		if df.pooled != (size <= DATA_BUFFER_SIZE) {
+			t.Fatal("Unexpected buffer use for size", size)
+		}
+		putDataBuffer(df.data)
+	}
+}
+
+// a connection counting the writes to it
+type countingConn struct {
+	net.Conn
+	writes int
+	buf    bytes.Buffer
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.buf.Write(p)
+}
+
+func (c *countingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestWriteBatch(t *testing.T) {
+	conn := &countingConn{}
+	ss := &Session{conn: conn, writeTimeout: time.Second}
+	ping := controlFrame{kind: FRAME_PING, data: []byte{0, 0, 0, 1}}
+	small := dataFrame{stream: 1, data: []byte("small")}
+	large := dataFrame{stream: 1, data: make([]byte, 2*COALESCE_DATA_BYTES)}
+
+	//small frames are written together
+	err := ss.writeFrames([]frame{ping, small, small, small})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.writes != 1 {
+		t.Fatal("Small frames not coalesced, writes:", conn.writes)
+	}
+
+	//large payloads are written from their own buffers
+	conn.writes = 0
+	err = ss.writeFrames([]frame{small, large, small})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.writes != 3 {
+		t.Fatal("Unexpected writes:", conn.writes)
+	}
+
+	for _, size := range []int{4, 5, 5, 5, 5, len(large.data), 5} {
+		f, err := readFrame(&conn.buf, MAX_DATA_PAYLOAD)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(f.Data()) != size {
+			t.Fatal("Unexpected frame:", f)
+		}
+	}
+}
+
+func TestHeaderCompressionPool(t *testing.T) {
+	h := testRequestHeader("/banana")
+	hw := newHeaderWriter()
+	first := testEncode(t, hw, h)
+	hw.release()
+	hr := newHeaderReader(DEFAULT_MAX_HEADER_BYTES)
+	_, err := hr.decode(first)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hr.release()
+	_, err = hr.decode(first)
+	if err != errHeaderReaderReleased {
+		t.Fatal("Expected a released reader error, got", err)
+	}
+
+	//pooled compressors start over with the dictionary, like new ones
+	hw = newHeaderWriter()
+	hr = newHeaderReader(DEFAULT_MAX_HEADER_BYTES)
+	for i := 0; i < 2; i++ {
+		decoded, err := hr.decode(testEncode(t, hw, h))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if decoded.Get(HEADER_PATH) != "/banana" {
+			t.Fatal("Unexpected headers:", decoded)
+		}
+	}
+}
+
+func TestNoHeaderCompression(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Secret", "banana")
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.setHeaderCompression(zlib.NoCompression)
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if reply, ok := f.(*SynReplyFrame); ok {
+			//the header block is readable as it is, and decoded all the same
+			if !bytes.Contains(reply.HeaderBlock, []byte("banana")) {
+				t.Fatal("Header block compressed")
+			}
+			if reply.Header.Get("X-Secret") != "banana" {
+				t.Fatal("Unexpected headers:", reply.Header)
+			}
+			return
+		}
+	}
+}
+
+func TestFramer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := NewFramer(buf)
+	reader := NewFramer(buf)
+
+	header := make(http.Header)
+	header.Set(HEADER_METHOD, "GET")
+	header.Set(HEADER_PATH, "/banana")
+	for i := 0; i < 2; i++ {
+		// twice, to go through the compression context
+		syn := &SynStreamFrame{StreamID: 1, Priority: 3, Flags: FLAG_FIN, Header: header}
+		err := writer.WriteFrame(syn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		f, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ss, ok := f.(*SynStreamFrame)
+		if !ok || ss.StreamID != 1 || ss.Priority != 3 || ss.Flags != FLAG_FIN {
+			t.Fatal("Unexpected frame read:", f)
+		}
+		if ss.Header.Get(HEADER_PATH) != "/banana" {
+			t.Fatal("Unexpected header read:", ss.Header)
+		}
+	}
+
+	err := writer.WriteFrame(&DataFrame{StreamID: 1, Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	df, ok := f.(*DataFrame)
+	if !ok || df.StreamID != 1 || string(df.Data) != "hello" {
+		t.Fatal("Unexpected frame read:", f)
+	}
+}
+
+func TestFrameMarshal(t *testing.T) {
+	set := &SettingsFrame{Values: []SettingsValue{{ID: 4, Value: 6}, {Flags: 1, ID: 7, Value: 1 << 20}}}
+	data, err := set.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parsed := new(SettingsFrame)
+	err = parsed.Parse(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(parsed.Values) != 2 || parsed.Values[1] != set.Values[1] {
+		t.Fatal("Unexpected SETTINGS parsed:", parsed)
+	}
+
+	goaway := &GoAwayFrame{LastGoodStreamID: 5, Status: GOAWAY_PROTOCOL_ERROR}
+	data, err = goaway.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = new(PingFrame).Parse(data); err == nil {
+		t.Fatal("GOAWAY frame parsed as a PING frame")
+	}
+	parsedGoaway := new(GoAwayFrame)
+	err = parsedGoaway.Parse(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if *parsedGoaway != *goaway {
+		t.Fatal("Unexpected GOAWAY parsed:", parsedGoaway)
+	}
+}
+
+func TestUnknownFrames(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		cn, sn := net.Pipe()
+		ss := NewServerSession(sn, &http.Server{Handler: http.NotFoundHandler()})
+		ss.strictFrames = strict
+		go ss.Serve()
+
+		framer := NewFramer(cn)
+		if f, err := framer.ReadFrame(); err != nil {
+			t.Fatal(err.Error())
+		} else if _, ok := f.(*SettingsFrame); !ok {
+			t.Fatal("Expected SETTINGS first, got", f)
+		}
+		err := framer.WriteFrame(&ControlFrame{Kind: FRAME_NOOP})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !strict {
+			// the NOOP is ignored and the session keeps going
+			err = framer.WriteFrame(&PingFrame{ID: 1})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f.(type) {
+		case *PingFrame:
+			if strict {
+				t.Fatal("Strict session did not go away")
+			}
+		case *GoAwayFrame:
+			if !strict {
+				t.Fatal("Session went away on a NOOP frame")
+			}
+		default:
+			t.Fatal("Unexpected frame:", f)
+		}
+		cn.Close()
+	}
+}
+
+// returns the SPDY headers of a GET request for path
+func testRequestHeader(path string) http.Header {
+	header := make(http.Header)
+	header.Set(HEADER_METHOD, "GET")
+	header.Set(HEADER_PATH, path)
+	header.Set(HEADER_VERSION, "HTTP/1.1")
+	header.Set(HEADER_HOST, "localhost:4040")
+	header.Set(HEADER_SCHEME, "http")
+	return header
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		ServerTestHandler(w, r)
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.maxConcurrentStreams = 1
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	f, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	set, ok := f.(*SettingsFrame)
+	if !ok || len(set.Values) != 1 || set.Values[0].ID != SETTINGS_MAX_CONCURRENT_STREAMS || set.Values[0].Value != 1 {
+		t.Fatal("Unexpected SETTINGS:", f)
+	}
+
+	for _, id := range []uint32{1, 3} {
+		err = framer.WriteFrame(&SynStreamFrame{StreamID: id, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	f, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rst, ok := f.(*RstStreamFrame)
+	if !ok || rst.StreamID != 3 || rst.Status != RST_REFUSED_STREAM {
+		t.Fatal("Expected stream #3 to be refused, got", f)
+	}
+	f, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply, ok := f.(*SynReplyFrame); !ok || reply.StreamID != 1 {
+		t.Fatal("Expected a reply for stream #1, got", f)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	header := testRequestHeader("localhost:4040")
+	header.Set(HEADER_METHOD, "CONNECT")
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Header: header})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		framer.WriteFrame(&DataFrame{StreamID: 1, Data: []byte("ping")})
+		framer.WriteFrame(&DataFrame{StreamID: 1, Flags: FLAG_FIN})
+	}()
+
+	var data []byte
+	replied := false
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := f.(type) {
+		case *SynReplyFrame:
+			if f.Header.Get(HEADER_STATUS)[:3] != "200" {
+				t.Fatal("Unexpected reply:", f)
+			}
+			replied = true
+		case *DataFrame:
+			data = append(data, f.Data...)
+			if f.Flags&FLAG_FIN != 0 {
+				if !replied || string(data) != "ping" {
+					t.Fatal("Unexpected tunnel data:", string(data))
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestPushPreloads(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style, </nopush.js>; rel=preload; nopush")
+			w.Write([]byte("page"))
+		case "/style.css":
+			if r.Header.Get("User-Agent") != "test" {
+				t.Error("Unexpected headers of pushed request:", r.Header)
+			}
+			w.Write([]byte("css"))
+		default:
+			t.Error("Unexpected request for", r.URL.Path)
+		}
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.pushPreloads = true
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	header := testRequestHeader("/")
+	header.Set("User-Agent", "test")
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: header})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := make(map[uint32]string)
+	pushed, replied := false, false
+	for data[1] == "" || data[2] == "" {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := f.(type) {
+		case *SynStreamFrame:
+			if pushed || f.StreamID != 2 || f.AssociatedStreamID != 1 || f.Flags&FLAG_UNIDIRECTIONAL == 0 || f.Header.Get(HEADER_PATH) != "/style.css" {
+				t.Fatal("Unexpected push:", f)
+			}
+			pushed = true
+		case *HeadersFrame:
+			if !pushed || f.StreamID != 2 || f.Header.Get(HEADER_STATUS)[:3] != "200" {
+				t.Fatal("Unexpected HEADERS:", f)
+			}
+			replied = true
+		case *DataFrame:
+			if f.StreamID == 2 && !replied {
+				t.Fatal("Pushed data before the reply")
+			}
+			data[f.StreamID] += string(f.Data)
+		}
+	}
+	if data[1] != "page" || data[2] != "css" {
+		t.Fatal("Unexpected data:", data)
+	}
+}
+
+func TestPusher(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/style.css" {
+			if r.Method != "HEAD" || r.Header.Get("X-Pushed") != "yes" {
+				t.Error("Unexpected pushed request:", r.Method, r.Header)
+			}
+			return
+		}
+		pusher, ok := w.(http.Pusher)
+		if !ok {
+			t.Error("ResponseWriter is not an http.Pusher")
+			return
+		}
+		for _, target := range []string{"style.css", "//example.com/style.css", "https://example.com/style.css"} {
+			if pusher.Push(target, nil) == nil {
+				t.Error("Unexpected push of", target)
+			}
+		}
+		if pusher.Push("/style.css", &http.PushOptions{Method: "POST"}) == nil {
+			t.Error("Unexpected push with POST")
+		}
+		err := pusher.Push("/style.css", &http.PushOptions{Method: "HEAD", Header: http.Header{"X-Pushed": {"yes"}}})
+		if err != nil {
+			t.Error(err.Error())
+		}
+		w.Write([]byte("page"))
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pushed, finished := false, 0
+	for finished < 2 {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		switch f := f.(type) {
+		case *SynStreamFrame:
+			if f.StreamID != 2 || f.AssociatedStreamID != 1 || f.Header.Get(HEADER_PATH) != "/style.css" {
+				t.Fatal("Unexpected push:", f)
+			}
+			pushed = true
+		case *HeadersFrame:
+			if f.Flags&FLAG_FIN != 0 {
+				finished++
+			}
+		case *DataFrame:
+			if f.Flags&FLAG_FIN != 0 {
+				finished++
+			}
+		}
+	}
+	if !pushed {
+		t.Fatal("No push")
+	}
+}
+
+func TestPushReset(t *testing.T) {
+	for _, status := range []uint32{RST_CANCEL, RST_REFUSED_STREAM} {
+		cn, sn := net.Pipe()
+		stopped := make(chan error, 1)
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/big" {
+				// beyond the send window, until the push is reset
+				chunk := make([]byte, 16384)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						<-r.Context().Done()
+						stopped <- err
+						return
+					}
+				}
+			}
+			w.(http.Pusher).Push("/big", nil)
+			w.Write([]byte("page"))
+		}
+		ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+		go ss.Serve()
+
+		framer := NewFramer(cn)
+		err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		go func() {
+			for {
+				f, err := framer.ReadFrame()
+				if err != nil {
+					return
+				}
+				if push, ok := f.(*SynStreamFrame); ok {
+					framer.WriteFrame(&RstStreamFrame{StreamID: push.StreamID, Status: status})
+				}
+			}
+		}()
+		select {
+		case err := <-stopped:
+			if err == nil {
+				t.Fatal("Pushed write did not fail")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Push not stopped on RST_STREAM status", status)
+		}
+		cn.Close()
+	}
+}
+
+func TestPushLimits(t *testing.T) {
+	cn, sn := net.Pipe()
+	release := make(chan bool)
+	errs := make(chan error, 4)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			<-release
+		case "/":
+			pusher := w.(http.Pusher)
+			errs <- pusher.Push("/slow", nil)
+			// over the pushes open at once
+			errs <- pusher.Push("/a", nil)
+			close(release)
+			time.Sleep(100 * time.Millisecond)
+			errs <- pusher.Push("/b", nil)
+			// over the pushes of the request
+			errs <- pusher.Push("/c", nil)
+		}
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.maxConcurrentPushes = 1
+	ss.maxPushesPerRequest = 2
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	for i, expected := range []error{nil, ErrPushLimit, nil, ErrPushLimit} {
+		select {
+		case err := <-errs:
+			if err != expected {
+				t.Fatalf("Push %d: expected %v, got %v", i, expected, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Push timed out")
+		}
+	}
+}
+
+func TestPushConcurrentStreams(t *testing.T) {
+	cn, sn := net.Pipe()
+	release := make(chan bool)
+	errs := make(chan error, 2)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			<-release
+		case "/":
+			pusher := w.(http.Pusher)
+			//the request of the client does not count against its limit
+			errs <- pusher.Push("/slow", nil)
+			//the push open does
+			errs <- pusher.Push("/a", nil)
+		}
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.maxConcurrentStreams = 1
+	go ss.Serve()
+	defer cn.Close()
+	defer close(release)
+
+	framer := NewFramer(cn)
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	err := framer.WriteFrame(&SettingsFrame{Values: []SettingsValue{{ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: 1}}})
+	if err == nil {
+		err = framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, expected := range []error{nil, ErrPushLimit} {
+		select {
+		case err := <-errs:
+			if err != expected {
+				t.Fatalf("Push %d: expected %v, got %v", i, expected, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Push timed out")
+		}
+	}
+
+	//once the request is done, the next one is taken with the push open
+	for ended := false; !ended; {
+		select {
+		case f := <-frames:
+			if df, ok := f.(*DataFrame); ok && df.StreamID == 1 {
+				ended = df.Flags&FLAG_FIN != 0
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Request not ended")
+		}
+	}
+	for deadline := time.Now().Add(time.Second); ss.NumActiveStreams() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected active streams:", ss.NumActiveStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = framer.WriteFrame(&SynStreamFrame{StreamID: 3, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for {
+		select {
+		case f := <-frames:
+			switch f := f.(type) {
+			case *SynReplyFrame:
+				if f.StreamID == 3 {
+					return
+				}
+			case *RstStreamFrame:
+				if f.StreamID == 3 {
+					t.Fatal("Request refused with a push open:", f)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No reply to the request")
+		}
+	}
+}
+
+type testPushCache struct {
+	sessionPushCache
+	forgotten chan bool
+}
+
+func (c *testPushCache) Forget(s *Session) { close(c.forgotten) }
+
+func TestPushCache(t *testing.T) {
+	cn, sn := net.Pipe()
+	errs := make(chan error, 3)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			errs <- w.(http.Pusher).Push("/style.css", nil)
+		}
+	}
+	cache := &testPushCache{sessionPushCache{urls: make(map[string]bool)}, make(chan bool)}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.pushCache = cache
+	go ss.Serve()
+
+	framer := NewFramer(cn)
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	for i, expected := range []error{nil, ErrPushed} {
+		err := framer.WriteFrame(&SynStreamFrame{StreamID: uint32(2*i + 1), Flags: FLAG_FIN, Header: testRequestHeader("/")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case err := <-errs:
+			if err != expected {
+				t.Fatalf("Push %d: expected %v, got %v", i, expected, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Push timed out")
+		}
+	}
+	if !cache.urls["http://localhost:4040/style.css"] {
+		t.Fatal("Unexpected URLs pushed:", cache.urls)
+	}
+	cn.Close()
+	select {
+	case <-cache.forgotten:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Session not forgotten by the cache")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	cn, sn := net.Pipe()
+	flushed := make(chan bool)
+	proceed := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("one"))
+		w.(http.Flusher).Flush()
+		flushed <- true
+		<-proceed
+		w.Write([]byte("two"))
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var data []byte
+	for string(data) != "one" {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if df, ok := f.(*DataFrame); ok {
+			data = append(data, df.Data...)
+		}
+	}
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("Flush did not return")
+	}
+	close(proceed)
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if df, ok := f.(*DataFrame); ok {
+			data = append(data, df.Data...)
+			if df.Flags&FLAG_FIN != 0 {
+				break
+			}
+		}
+	}
+	if string(data) != "onetwo" {
+		t.Fatal("Unexpected data:", string(data))
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	cn, sn := net.Pipe()
+	errs := make(chan error, 2)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		var err error
+		switch r.URL.Path {
+		case "/read":
+			//the body never comes
+			rc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err = ioutil.ReadAll(r.Body)
+		case "/write":
+			//the window is never updated
+			rc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err = w.Write(make([]byte, 2*INITIAL_FLOW_CONTOL_WINDOW))
+		}
+		errs <- err
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	go func() {
+		framer.WriteFrame(&SynStreamFrame{StreamID: 1, Header: testRequestHeader("/read")})
+		framer.WriteFrame(&SynStreamFrame{StreamID: 3, Flags: FLAG_FIN, Header: testRequestHeader("/write")})
+	}()
+	reset := make(map[uint32]bool)
+	for len(reset) < 2 {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if rst, ok := f.(*RstStreamFrame); ok {
+			if rst.Status != RST_CANCEL {
+				t.Fatal("Unexpected reset:", rst)
+			}
+			reset[rst.StreamID] = true
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("Unexpected error past the deadline:", err)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	cn, sn := net.Pipe()
+	cancelled := make(chan bool, 2)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(2 * time.Second):
+			cancelled <- false
+		}
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	go io.Copy(ioutil.Discard, cn)
+
+	//the stream is reset by the client
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	err = framer.WriteFrame(&RstStreamFrame{StreamID: 1, Status: RST_CANCEL})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !<-cancelled {
+		t.Fatal("Context not cancelled on RST_STREAM")
+	}
+
+	//the session goes away
+	err = framer.WriteFrame(&SynStreamFrame{StreamID: 3, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ss.Context().Err() != nil {
+		t.Fatal("Session context done while serving")
+	}
+	cn.Close()
+	select {
+	case ok := <-cancelled:
+		if !ok {
+			t.Fatal("Context not cancelled on session close")
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Context not cancelled right away on session close")
+	}
+	if ss.Context().Err() == nil {
+		t.Fatal("Session context not done once closed")
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	cn, sn := net.Pipe()
+	hs := &http.Server{}
+	checked := make(chan bool, 1)
+	hs.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		str := ContextStream(r.Context())
+		if str == nil || str != w.(*Stream) || str.Context() != r.Context() {
+			t.Error("Unexpected stream of the request context:", str)
+		}
+		if str.ID() != 1 || str.Priority() != 2 || str.Session().RemoteAddr() == nil {
+			t.Errorf("Unexpected stream: %d %d", str.ID(), str.Priority())
+		}
+		if r.Context().Value(http.ServerContextKey) != hs || r.Context().Value(http.LocalAddrContextKey) != sn.LocalAddr() {
+			t.Error("Unexpected values of the request context")
+		}
+		checked <- true
+	})
+	ss := NewServerSession(sn, hs)
+	go ss.Serve()
+	go io.Copy(ioutil.Discard, cn)
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Priority: 2, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("Request not handled")
+	}
+	cn.Close()
+
+	//client streams have one too
+	cn, sn = net.Pipe()
+	defer sn.Close()
+	client := NewClientSession(cn)
+	go client.Serve()
+	str := client.NewClientStream()
+	if str == nil {
+		t.Fatal("ERROR in NewClientStream: cannot create stream")
+	}
+	if ContextStream(str.Context()) != str || str.Context().Err() != nil {
+		t.Fatal("Unexpected context of a client stream")
+	}
+	client.Close()
+	select {
+	case <-str.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("Context of a client stream not done on session close")
+	}
+}
+
+func TestStreamingBody(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(r.Body, buf)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		fmt.Fprintf(w, "got %s", buf)
+		w.(http.Flusher).Flush()
+		rest, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		fmt.Fprintf(w, ", then %s", rest)
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	header := testRequestHeader("/upload")
+	header.Set(HEADER_METHOD, "POST")
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Header: header})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = framer.WriteFrame(&DataFrame{StreamID: 1, Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the handler answers before the body is complete
+	var data []byte
+	for string(data) != "got hello" {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if df, ok := f.(*DataFrame); ok {
+			data = append(data, df.Data...)
+		}
+	}
+	go framer.WriteFrame(&DataFrame{StreamID: 1, Flags: FLAG_FIN, Data: []byte("bye")})
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if df, ok := f.(*DataFrame); ok {
+			data = append(data, df.Data...)
+			if df.Flags&FLAG_FIN != 0 {
+				break
+			}
+		}
+	}
+	if string(data) != "got hello, then bye" {
+		t.Fatal("Unexpected data:", string(data))
+	}
+}
+
+func TestStreamsDuringUpload(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			ioutil.ReadAll(r.Body)
+		}
+		fmt.Fprintf(w, "done with %s", r.URL.Path)
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	//the replies of the streams, once ended
+	ended := func(n int) {
+		for n > 0 {
+			select {
+			case f, ok := <-frames:
+				if !ok {
+					t.Fatal("Session closed")
+				}
+				if df, ok := f.(*DataFrame); ok && df.Flags&FLAG_FIN != 0 {
+					n--
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Streams not ended")
+			}
+		}
+	}
+
+	header := testRequestHeader("/upload")
+	header.Set(HEADER_METHOD, "POST")
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Header: header})
+	if err == nil {
+		err = framer.WriteFrame(&DataFrame{StreamID: 1, Data: []byte("hello")})
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//other requests are served while the upload goes on
+	for id := uint32(3); id <= 7; id += 2 {
+		err = framer.WriteFrame(&SynStreamFrame{StreamID: id, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	ended(3)
+	deadline := time.Now().Add(2 * time.Second)
+	for streams := ss.Streams(); len(streams) != 1 || streams[0].ID != 1; streams = ss.Streams() {
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected streams during the upload:", streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = framer.WriteFrame(&DataFrame{StreamID: 1, Flags: FLAG_FIN, Data: []byte(" world")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ended(1)
+	deadline = time.Now().Add(2 * time.Second)
+	for ss.NumActiveStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Streams left active:", ss.NumActiveStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInitialWindowSize(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	//the window is too small for the data of the handler
+	err := framer.WriteFrame(&SettingsFrame{Values: []SettingsValue{{ID: SETTINGS_INITIAL_WINDOW_SIZE, Value: 10}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var data []byte
+	timeout := time.After(300 * time.Millisecond)
+wait:
+	for {
+		select {
+		case f := <-frames:
+			if df, ok := f.(*DataFrame); ok {
+				data = append(data, df.Data...)
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+	if len(data) != 10 {
+		t.Fatal("Unexpected data within the flow control window:", len(data))
+	}
+
+	//the open stream gets the difference of a larger window
+	err = framer.WriteFrame(&SettingsFrame{Values: []SettingsValue{{ID: SETTINGS_INITIAL_WINDOW_SIZE, Value: 1000}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for {
+		select {
+		case f := <-frames:
+			if df, ok := f.(*DataFrame); ok {
+				data = append(data, df.Data...)
+				if df.Flags&FLAG_FIN != 0 {
+					if len(data) != 100 {
+						t.Fatal("Unexpected data length:", len(data))
+					}
+					return
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Data not sent after the window grew")
+		}
+	}
+}
+
+func TestClearSettings(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+	settings := []SettingsValue{{ID: SETTINGS_INITIAL_WINDOW_SIZE, Value: 10}, {ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: 1}}
+	err := framer.WriteFrame(&SettingsFrame{Values: settings})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var data []byte
+	for len(data) < 10 {
+		select {
+		case f := <-frames:
+			if df, ok := f.(*DataFrame); ok {
+				data = append(data, df.Data...)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Missing data within the flow control window")
+		}
+	}
+
+	//back to the default window, for the open stream too
+	err = framer.WriteFrame(&SettingsFrame{Flags: FLAG_SETTINGS_CLEAR_SETTINGS})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for done := false; !done; {
+		select {
+		case f := <-frames:
+			if df, ok := f.(*DataFrame); ok {
+				data = append(data, df.Data...)
+				done = df.Flags&FLAG_FIN != 0
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Data not sent after the settings were cleared")
+		}
+	}
+	if len(data) != 100 || ss.initialSendWindow() != INITIAL_FLOW_CONTOL_WINDOW || atomic.LoadUint32(&ss.peerMaxConcurrentStreams) != 0 {
+		t.Fatal("Settings not cleared:", len(data), ss.initialSendWindow(), atomic.LoadUint32(&ss.peerMaxConcurrentStreams))
+	}
+
+	//the values persisted by a client are cleared too
+	cn, sn = net.Pipe()
+	defer sn.Close()
+	store := &memorySettingsStore{values: map[string][]SettingsValue{"https://example.com:443": settings}}
+	client := NewClientSession(cn)
+	client.SetSettingsStore(store, "https://example.com:443")
+	go client.Serve()
+	defer client.Close()
+	//a framer of its own, the first one being still read
+	sframer := NewFramer(sn)
+	go func() {
+		for {
+			if _, err := sframer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	err = sframer.WriteFrame(&SettingsFrame{Flags: FLAG_SETTINGS_CLEAR_SETTINGS})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for deadline := time.Now().Add(time.Second); store.Load("https://example.com:443") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("Persisted settings not cleared:", store.Load("https://example.com:443"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	cn, sn := net.Pipe()
+	cancelled := make(chan string, 2)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		//the body is never read
+		<-r.Context().Done()
+		cancelled <- r.URL.Path
+	}
+	headers := make(map[uint32]http.Header)
+	var size int
+	for _, id := range []uint32{1, 3} {
+		headers[id] = testRequestHeader(fmt.Sprintf("/upload%d", id))
+		headers[id].Set(HEADER_METHOD, "POST")
+		size += headerSize(headers[id])
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	//the header blocks count too
+	ss.budget.max = 100 + int64(size)
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	frames := make(chan Frame, 10)
+	go func() {
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	for _, id := range []uint32{1, 3} {
+		err := framer.WriteFrame(&SynStreamFrame{StreamID: id, Header: headers[id]})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	//over the limit, the stream with the most data is reset
+	for _, df := range []*DataFrame{
+		{StreamID: 1, Data: make([]byte, 80)},
+		{StreamID: 3, Data: make([]byte, 30)},
+		{StreamID: 3, Data: make([]byte, 50)},
+	} {
+		err := framer.WriteFrame(df)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for {
+		select {
+		case f := <-frames:
+			if rst, ok := f.(*RstStreamFrame); ok {
+				if rst.StreamID != 1 {
+					t.Fatal("Unexpected stream reset:", rst.StreamID)
+				}
+				select {
+				case path := <-cancelled:
+					if path != "/upload1" {
+						t.Fatal("Unexpected handler cancelled:", path)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("Handler of the reset stream not cancelled")
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No stream reset")
+		}
+	}
+}
+
+func TestMaxBufferedHeaders(t *testing.T) {
+	cn, sn := net.Pipe()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	header := testRequestHeader("/")
+	ss.budget.max = int64(headerSize(header)) - 1
+	go ss.Serve()
+	defer cn.Close()
+
+	//a stream with a header block over the limit is refused
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: header})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := framer.ReadFrame()
+	if _, ok := f.(*SettingsFrame); ok {
+		f, err = framer.ReadFrame()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rst, ok := f.(*RstStreamFrame)
+	if !ok || rst.StreamID != 1 || rst.Status != RST_REFUSED_STREAM {
+		t.Fatal("Expected RST_STREAM #1 REFUSED_STREAM, got", f)
+	}
+	if n := ss.NumActiveStreams(); n != 0 {
+		t.Fatal("Unexpected active streams:", n)
+	}
+}
+
+func TestWriteBufferDelay(t *testing.T) {
+	cn, sn := net.Pipe()
+	flushed := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("x"))
+		}
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("y"))
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	ss.writeDelay = time.Hour
+	ss.writeBufferSize = COALESCE_DATA_BYTES
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var data []string
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		df, ok := f.(*DataFrame)
+		if !ok {
+			continue
+		}
+		if len(df.Data) > 0 {
+			data = append(data, string(df.Data))
+		}
+		if len(data) == 1 && df.Flags&FLAG_FIN == 0 {
+			//the flush sends the small writes right away, in one frame
+			close(flushed)
+		}
+		if df.Flags&FLAG_FIN != 0 {
+			break
+		}
+	}
+	if len(data) != 2 || data[0] != "xxxxxxxxxx" || data[1] != "y" {
+		t.Fatalf("Unexpected DATA frames: %q", data)
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	cn, sn := net.Pipe()
+	server := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerHandler)})
+	server.initialWindowSize = 1 << 20
+	go server.Serve()
+	client := NewClientSession(cn)
+	go client.Serve()
+	defer client.Close()
+
+	if !client.Ping(time.Second) {
+		t.Fatal("Unable to ping server from client")
+	}
+	if client.NewClientStream() == nil {
+		t.Fatal("ERROR in NewClientStream: cannot create stream")
+	}
+	//registered by the session loop
+	time.Sleep(50 * time.Millisecond)
+	stats := client.Stats()
+	if stats.ActiveStreams != 1 || stats.TotalStreams != 1 {
+		t.Fatalf("Unexpected streams: %+v", stats)
+	}
+	if stats.BytesSent == 0 || stats.BytesReceived == 0 || stats.LastPingRTT == 0 {
+		t.Fatalf("Unexpected counters: %+v", stats)
+	}
+	//as per the SETTINGS of the server
+	if stats.SendWindow != 1<<20 || stats.ReceiveWindow != INITIAL_FLOW_CONTOL_WINDOW {
+		t.Fatalf("Unexpected windows: %+v", stats)
+	}
+	if stats.Version != "spdy/3" {
+		t.Fatal("Unexpected version:", stats.Version)
+	}
+}
+
+func TestHeaderCompressionStats(t *testing.T) {
+	cn, sn := net.Pipe()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	go ss.Serve()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	for _, id := range []uint32{1, 3} {
+		err := framer.WriteFrame(&SynStreamFrame{StreamID: id, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if _, ok := f.(*SynReplyFrame); ok {
+				break
+			}
+		}
+	}
+	stats := ss.Stats()
+	// the second reply is mostly in the compression context already
+	if stats.HeaderBytes == 0 || stats.CompressedHeaderBytes == 0 || stats.HeaderCompressionRatio <= 0 || stats.HeaderCompressionRatio >= 1 {
+		t.Fatalf("Unexpected header counters: %+v", stats)
+	}
+	if metrics.Get("header_compression_ratio").String() == "0" {
+		t.Fatal("Unexpected metrics:", metrics.String())
+	}
+}
+
+func TestStreamIDExhausted(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	client := NewClientSession(cn)
+	client.nextStream = MAX_STREAM_ID - 2
+	go client.Serve()
+	defer client.Close()
+
+	if str := client.NewClientStream(); str == nil || str.id != MAX_STREAM_ID-2 {
+		t.Fatalf("Unexpected stream: %v", str)
+	}
+	if str := client.NewClientStream(); str == nil || str.id != MAX_STREAM_ID {
+		t.Fatalf("Unexpected stream: %v", str)
+	}
+	if str := client.NewClientStream(); str != nil {
+		t.Fatalf("Stream #%d opened after the last stream ID", str.id)
+	}
+}
+
+// a request body that records if it was closed
+type closeRecorder struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestCloseDuringBody(t *testing.T) {
+	cn, sn := net.Pipe()
+	started := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		ioutil.ReadAll(r.Body)
+	}
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	served := make(chan error)
+	go func() {
+		served <- ss.Serve()
+	}()
+	defer cn.Close()
+
+	framer := NewFramer(cn)
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	header := testRequestHeader("/upload")
+	header.Set(HEADER_METHOD, "POST")
+	err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Header: header})
+	if err == nil {
+		err = framer.WriteFrame(&DataFrame{StreamID: 1, Data: []byte("banana")})
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-started
+
+	//the session is closed with the body still coming
+	ss.CloseWithError(GOAWAY_OK)
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func TestRequestBodyClosed(t *testing.T) {
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	client := NewClientSession(cn)
+	go client.Serve()
+
+	//the session is gone before the request is sent
+	str := client.NewClientStream()
+	if str == nil {
+		t.Fatal("Stream not started")
+	}
+	client.Close()
+	body := &closeRecorder{Reader: strings.NewReader("banana")}
+	req, _ := http.NewRequest("POST", "http://localhost/upload", body)
+	err := str.Request(req, NewRecorder())
+	if err == nil {
+		t.Fatal("Request sent on a closed session")
+	}
+	if !body.closed.Load() {
+		t.Fatal("Body of the request not closed")
+	}
+}
+
+func TestPingInterval(t *testing.T) {
+	cn, sn := net.Pipe()
+	server := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerHandler)})
+	go server.Serve()
+	client := NewClientSession(cn)
+	client.pingInterval = 20 * time.Millisecond
+	go client.Serve()
+	defer client.Close()
+
+	//pinged while idle
+	time.Sleep(100 * time.Millisecond)
+	stats := client.Stats()
+	if stats.RTT == 0 || stats.LastPingRTT == 0 {
+		t.Fatalf("Unexpected RTT: %+v", stats)
+	}
+}
+
+func TestPingIntervalDeadPeer(t *testing.T) {
+	cn, sn := net.Pipe()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	ss.pingInterval = 20 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		ss.Serve()
+		done <- true
+	}()
+
+	//the peer reads the frames, never replying to the PINGs
+	framer := NewFramer(cn)
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Session not closed without PING replies")
+	}
+	cn.Close()
+}
+
+func TestSessionEvents(t *testing.T) {
+	events := make(chan string, 10)
+	cn, sn := net.Pipe()
+	ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	ss.SetEvents(&SessionEvents{
+		StreamOpened: func(str *Stream) { events <- fmt.Sprintf("opened %d", str.id) },
+		StreamClosed: func(str *Stream, err error) { events <- fmt.Sprintf("closed %d %v", str.id, err) },
+		GoAwayReceived: func(lastGood uint32, status uint32) {
+			events <- fmt.Sprintf("goaway %d %d", lastGood, status)
+		},
+		SettingsReceived: func(settings *SettingsFrame) { events <- fmt.Sprintf("settings %d", len(settings.Values)) },
+		SessionClosed:    func(err error) { events <- "session closed" },
+	})
+	go ss.Serve()
+
+	framer := NewFramer(cn)
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	frames := []Frame{
+		&SettingsFrame{Values: []SettingsValue{{ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: 10}}},
+		&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")},
+	}
+	for _, f := range frames {
+		if err := framer.WriteFrame(f); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expected := []string{"settings 1", "opened 1", "closed 1 <nil>", "goaway 1 0", "session closed"}
+	for i, e := range expected {
+		if i == 3 {
+			//after the stream is done
+			if err := framer.WriteFrame(&GoAwayFrame{LastGoodStreamID: 1, Status: GOAWAY_OK}); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if i == 4 {
+			cn.Close()
+		}
+		select {
+		case event := <-events:
+			if event != e {
+				t.Fatalf("Unexpected event %q, expected %q", event, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Missing event:", e)
+		}
+	}
+}
+
+func TestGoAwayReceived(t *testing.T) {
+	events := make(chan string, 10)
+	cn, sn := net.Pipe()
+	defer sn.Close()
+	client := NewClientSession(cn)
+	client.SetEvents(&SessionEvents{
+		StreamClosed: func(str *Stream, err error) {
+			var se *SessionError
+			events <- fmt.Sprintf("closed %d %v", str.id, errors.As(err, &se) && se.Retry)
+		},
+		GoAwayReceived: func(lastGood uint32, status uint32) {
+			events <- fmt.Sprintf("goaway %d %d", lastGood, status)
+		},
+	})
+	go client.Serve()
+	defer client.Close()
+
+	framer := NewFramer(sn)
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if client.NewClientStream() == nil {
+			t.Fatal("ERROR in NewClientStream: cannot create stream")
+		}
+	}
+	if err := framer.WriteFrame(&GoAwayFrame{LastGoodStreamID: 1, Status: GOAWAY_OK}); err != nil {
+		t.Fatal(err.Error())
+	}
+	//the streams to replay fail once the application knows of the GOAWAY
+	for _, e := range []string{"goaway 1 0", "closed 3 true"} {
+		select {
+		case event := <-events:
+			if event != e {
+				t.Fatalf("Unexpected event %q, expected %q", event, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Missing event:", e)
+		}
+	}
+	if client.NewClientStream() != nil {
+		t.Fatal("Unexpected stream after a GOAWAY")
+	}
+}
+
+func TestRawHeaders(t *testing.T) {
+	cn, sn := net.Pipe()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		str := w.(*Stream)
+		h := str.RequestHeader()
+		if h.Get(HEADER_VERSION) != "HTTP/1.1" || h.Get(":x-peer") != "robot" {
+			t.Errorf("Unexpected request header block: %v", h)
+		}
+		if str.ReplyHeader() != nil {
+			t.Error("Unexpected reply header block before the reply")
+		}
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("hello"))
+		h = str.ReplyHeader()
+		if h.Get(HEADER_STATUS) != "200 OK" || h.Get("Connection") != "" {
+			t.Errorf("Unexpected reply header block: %v", h)
+		}
+	}
+	server := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(handler)})
+	go server.Serve()
+	client := NewClientSession(cn)
+	go client.Serve()
+	defer client.Close()
+
+	str := client.NewClientStream()
+	if str == nil {
+		t.Fatal("ERROR in NewClientStream: cannot create stream")
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	req.Header.Set(":x-peer", "robot")
+	rec := httptest.NewRecorder()
+	if err := str.Request(req, rec); err != nil {
+		t.Fatal(err.Error())
+	}
+	if h := str.RequestHeader(); h.Get(HEADER_PATH) != "/banana" || h.Get(HEADER_HOST) != "localhost:80" {
+		t.Fatalf("Unexpected request header block sent: %v", h)
+	}
+	if h := str.ReplyHeader(); h.Get(HEADER_STATUS) != "200 OK" || h.Get(HEADER_VERSION) != "HTTP/1.1" {
+		t.Fatalf("Unexpected reply header block received: %v", h)
+	}
+	if rec.Header().Get(HEADER_STATUS) != "" || rec.Body.String() != "hello" {
+		t.Fatalf("Unexpected reply: %v %q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestSessionInterface(t *testing.T) {
+	cn, sn := net.Pipe()
+	server := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler)})
+	go server.Serve()
+	var client SessionInterface = NewClientSession(cn)
+	go client.Serve()
+	defer client.Close()
+
+	//requests go through the interfaces alone
+	str := client.NewRequestStream()
+	if str == nil {
+		t.Fatal("ERROR in NewRequestStream: cannot create stream")
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/banana", nil)
+	rec := httptest.NewRecorder()
+	if err := str.Request(req, rec); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "Hi there, I love banana!" {
+		t.Fatalf("Unexpected reply: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// a writer of log lines to a channel
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLogger(t *testing.T) {
+	for _, structured := range []bool{true, false} {
+		lines := make(chanWriter, 10)
+		cn, sn := net.Pipe()
+		ss := NewServerSession(sn, &http.Server{Handler: http.HandlerFunc(ServerTestHandler), MaxHeaderBytes: 10})
+		if structured {
+			ss.SetLogger(slog.New(slog.NewTextHandler(lines, nil)))
+		} else {
+			SetLog(lines)
+		}
+		go ss.Serve()
+
+		//the request headers are over the limit of the server
+		framer := NewFramer(cn)
+		err := framer.WriteFrame(&SynStreamFrame{StreamID: 1, Flags: FLAG_FIN, Header: testRequestHeader("/banana")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case line := <-lines:
+			for _, s := range []string{"WARN", "request header block too large", "session=pipe", "stream=1"} {
+				if !strings.Contains(line, s) {
+					t.Fatalf("%q missing in the log: %s", s, line)
+				}
+			}
+			if !structured && !strings.Contains(line, "stream.go:") {
+				t.Fatal("Source missing in the log:", line)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Nothing logged")
+		}
+		SetLog(ioutil.Discard)
+		cn.Close()
+	}
+}
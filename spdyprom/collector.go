@@ -0,0 +1,108 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Package spdyprom exposes the measures of the SPDY sessions as
+// Prometheus histograms.
+//
+// The Collector is both registered with Prometheus and set as the
+// Observer of the sessions:
+//
+//	c := spdyprom.NewCollector()
+//	prometheus.MustRegister(c)
+//	spdy.SetObserver(c)
+//
+// The counters of the sessions are published with expvar by the spdy
+// package itself.
+//
+// It is a module of its own, so that the spdy package does not depend on
+// the Prometheus client.
+package spdyprom
+
+import (
+	"time"
+
+	"github.com/amahi/spdy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector of histograms of the stream
+// durations, the header compression ratios, the window stalls and the
+// frame sizes of all the sessions. It is a spdy.Observer
+type Collector struct {
+	streamDuration prometheus.Histogram
+	headerRatio    prometheus.Histogram
+	windowStalls   prometheus.Histogram
+	frameSizes     *prometheus.HistogramVec
+}
+
+var _ spdy.Observer = (*Collector)(nil)
+
+// NewCollector returns a new Collector, to be registered and set as the
+// Observer of the sessions
+func NewCollector() *Collector {
+	return &Collector{
+		streamDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "spdy",
+			Name:      "stream_duration_seconds",
+			Help:      "Time from the start to the end of the streams.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		headerRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "spdy",
+			Name:      "header_compression_ratio",
+			Help:      "Compressed size over raw size of the header blocks sent.",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		windowStalls: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "spdy",
+			Name:      "window_stall_seconds",
+			Help:      "Time the streams had no flow control window to send.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		frameSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "spdy",
+			Name:      "frame_size_bytes",
+			Help:      "Size of the frames, header included, by direction and type.",
+			Buckets:   prometheus.ExponentialBuckets(8, 4, 8),
+		}, []string{"direction", "type"}),
+	}
+}
+
+// Describe sends the descriptions of the histograms
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.streamDuration.Describe(ch)
+	c.headerRatio.Describe(ch)
+	c.windowStalls.Describe(ch)
+	c.frameSizes.Describe(ch)
+}
+
+// Collect sends the current values of the histograms
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.streamDuration.Collect(ch)
+	c.headerRatio.Collect(ch)
+	c.windowStalls.Collect(ch)
+	c.frameSizes.Collect(ch)
+}
+
+func (c *Collector) StreamClosed(d time.Duration) {
+	c.streamDuration.Observe(d.Seconds())
+}
+
+func (c *Collector) HeaderCompressed(raw, compressed int) {
+	if raw > 0 {
+		c.headerRatio.Observe(float64(compressed) / float64(raw))
+	}
+}
+
+func (c *Collector) WindowStalled(d time.Duration) {
+	c.windowStalls.Observe(d.Seconds())
+}
+
+func (c *Collector) FrameSent(kind string, size int) {
+	c.frameSizes.WithLabelValues("sent", kind).Observe(float64(size))
+}
+
+func (c *Collector) FrameReceived(kind string, size int) {
+	c.frameSizes.WithLabelValues("received", kind).Observe(float64(size))
+}
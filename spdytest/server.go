@@ -0,0 +1,167 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Package spdytest runs SPDY servers for end-to-end tests, like
+// net/http/httptest does for HTTP, without certificates or ports:
+//
+//	ts := spdytest.NewServer(handler)
+//	defer ts.Close()
+//	res, err := ts.Client().Get(ts.URL + "/banana")
+//
+// The server of NewServer is in memory, reached over net.Pipe
+// connections, and the one of NewLoopbackServer listens on a TCP port of
+// the loopback interface. Both speak SPDY in the clear.
+package spdytest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amahi/spdy"
+)
+
+// time given to the streams of the sessions to finish on Close
+const CLOSE_TIMEOUT = 5 * time.Second
+
+// Server is a SPDY server for tests, with a Transport to reach it
+type Server struct {
+	// base URL of the server, as http://host:port with no trailing slash
+	URL      string
+	Listener net.Listener
+	// the server, which may be configured before Start
+	Config *spdy.Server
+	// the Transport of Client, which may be configured before the first
+	// request
+	Transport *spdy.Transport
+	client    *http.Client
+	served    chan error
+}
+
+// NewServer starts and returns a new in-memory Server. The caller should
+// call Close when done, to shut it down
+func NewServer(handler http.Handler) *Server {
+	ts := NewUnstartedServer(handler)
+	ts.Start()
+	return ts
+}
+
+// NewLoopbackServer starts and returns a new Server listening on a TCP
+// port of the loopback interface. The caller should call Close when done,
+// to shut it down
+func NewLoopbackServer(handler http.Handler) *Server {
+	ts := NewUnstartedServer(handler)
+	ts.StartLoopback()
+	return ts
+}
+
+// NewUnstartedServer returns a new Server that is not started, for its
+// Config or Transport to be changed before calling Start or StartLoopback
+func NewUnstartedServer(handler http.Handler) *Server {
+	return &Server{
+		Config:    &spdy.Server{Handler: handler},
+		Transport: &spdy.Transport{},
+	}
+}
+
+// Start starts the server in memory. All the requests of the Transport
+// go to it, whatever their host
+func (ts *Server) Start() {
+	ln := &pipeListener{conns: make(chan net.Conn), done: make(chan bool)}
+	ts.Transport.DialContext = ln.dial
+	ts.start(ln, "http://spdytest.pipe")
+}
+
+// StartLoopback starts the server on a TCP port of the loopback
+// interface
+func (ts *Server) StartLoopback() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ln, err = net.Listen("tcp6", "[::1]:0")
+		if err != nil {
+			panic("spdytest: failed to listen on a port: " + err.Error())
+		}
+	}
+	ts.start(ln, "http://"+ln.Addr().String())
+}
+
+func (ts *Server) start(ln net.Listener, url string) {
+	if ts.URL != "" {
+		panic("spdytest: server already started")
+	}
+	ts.Listener = ln
+	ts.URL = url
+	ts.served = make(chan error, 1)
+	go func() {
+		ts.served <- ts.Config.Serve(ln)
+	}()
+}
+
+// Client returns an http.Client making its requests with the Transport
+// of the server
+func (ts *Server) Client() *http.Client {
+	if ts.client == nil {
+		ts.client = &http.Client{Transport: ts.Transport}
+	}
+	return ts.client
+}
+
+// Close shuts down the server, waiting a while for the streams being
+// served to finish, and closes the sessions of the Transport
+func (ts *Server) Close() {
+	if ts.served == nil {
+		return
+	}
+	ts.Transport.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), CLOSE_TIMEOUT)
+	defer cancel()
+	ts.Config.Shutdown(ctx)
+	ts.Listener.Close()
+	<-ts.served
+	ts.served = nil
+}
+
+// a listener of in-memory connections, made by dial
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("spdytest: listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	cn, sn := net.Pipe()
+	select {
+	case l.conns <- sn:
+		return cn, nil
+	case <-l.done:
+		return nil, errors.New("spdytest: server closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// the address of in-memory connections
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "spdytest.pipe" }
@@ -0,0 +1,35 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+package spdytest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Hi there, I love %s!", r.URL.Path[1:])
+}
+
+func TestServers(t *testing.T) {
+	for _, start := range []func(http.Handler) *Server{NewServer, NewLoopbackServer} {
+		ts := start(http.HandlerFunc(handler))
+		res, err := ts.Client().Get(ts.URL + "/banana")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(body) != "Hi there, I love banana!" {
+			t.Fatalf("Unexpected body from %s: %q", ts.URL, body)
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// This file contains the state machine of the streams, moved along by
+// the frames sent, in the sender of the session, and the frames received,
+// in the session loop, and checking both against it
+
+package spdy
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+func (state StreamState) String() string {
+	switch state {
+	case STREAM_IDLE:
+		return "idle"
+	case STREAM_OPEN:
+		return "open"
+	case STREAM_HALF_CLOSED_LOCAL:
+		return "half-closed (local)"
+	case STREAM_HALF_CLOSED_REMOTE:
+		return "half-closed (remote)"
+	case STREAM_CLOSED:
+		return "closed"
+	}
+	return fmt.Sprintf("StreamState(%d)", int(state))
+}
+
+// the current state of the stream
+func (s *Stream) getState() StreamState {
+	return StreamState(atomic.LoadInt32(&s.state))
+}
+
+// move the stream to the next state as given by the transition, which
+// gets the current state
+func (s *Stream) transition(next func(StreamState) StreamState) {
+	for {
+		old := atomic.LoadInt32(&s.state)
+		if atomic.CompareAndSwapInt32(&s.state, old, int32(next(StreamState(old)))) {
+			return
+		}
+	}
+}
+
+// the SYN_STREAM of a client stream was sent
+func (s *Stream) opened(fin bool) {
+	s.transition(func(state StreamState) StreamState {
+		if state != STREAM_IDLE {
+			return state
+		}
+		if fin {
+			return STREAM_HALF_CLOSED_LOCAL
+		}
+		return STREAM_OPEN
+	})
+}
+
+// this end sent its FIN
+func (s *Stream) closeLocal() {
+	s.transition(func(state StreamState) StreamState {
+		switch state {
+		case STREAM_IDLE, STREAM_OPEN:
+			return STREAM_HALF_CLOSED_LOCAL
+		case STREAM_HALF_CLOSED_REMOTE:
+			return STREAM_CLOSED
+		}
+		return state
+	})
+}
+
+// the other end sent its FIN
+func (s *Stream) closeRemote() {
+	s.transition(func(state StreamState) StreamState {
+		switch state {
+		case STREAM_OPEN:
+			return STREAM_HALF_CLOSED_REMOTE
+		case STREAM_HALF_CLOSED_LOCAL:
+			return STREAM_CLOSED
+		}
+		return state
+	})
+}
+
+// a RST_STREAM was sent or received
+func (s *Stream) reset() {
+	atomic.StoreInt32(&s.state, int32(STREAM_CLOSED))
+}
+
+// can this end still send DATA and HEADERS?
+func (s *Stream) localOpen() bool {
+	state := s.getState()
+	return state == STREAM_OPEN || state == STREAM_HALF_CLOSED_REMOTE
+}
+
+// can the other end still send DATA and HEADERS?
+func (s *Stream) remoteOpen() bool {
+	state := s.getState()
+	return state == STREAM_OPEN || state == STREAM_HALF_CLOSED_LOCAL
+}
+
+// was the stream started by this end of the session?
+func (s *Session) isLocalStream(id streamID) bool {
+	return uint32(id)&1 == atomic.LoadUint32((*uint32)(&s.nextStream))&1
+}
+
+// checkSent checks a frame about to be sent against the state of its
+// stream, and moves the stream along. It returns false for the frames not
+// to be sent, like DATA after the FIN of this end or a reset
+func (s *Session) checkSent(f frame) bool {
+	id := frameStreamID(f)
+	if id == 0 {
+		return true
+	}
+	v, ok := s.counted.Load(id)
+	if !ok {
+		return true
+	}
+	str := v.(*Stream)
+	if fr, ok := f.(*dataFrame); ok {
+		f = *fr
+	}
+	switch fr := f.(type) {
+	case frameSynStream:
+		str.opened(fr.flags&FLAG_FIN != 0)
+		if fr.associated_stream != 0 && fr.flags&FLAG_UNIDIRECTIONAL != 0 {
+			// a push, with nothing to come from the other end
+			str.closeRemote()
+		}
+	case frameSynReply:
+		if fr.flags&FLAG_FIN != 0 {
+			str.closeLocal()
+		}
+	case dataFrame:
+		if !str.localOpen() {
+			str.logger().Warn("DATA not sent", "state", str.getState())
+			return false
+		}
+		if fr.flags&FLAG_FIN != 0 {
+			str.closeLocal()
+		}
+	case frameHeaders:
+		if !str.localOpen() {
+			str.logger().Warn("HEADERS not sent", "state", str.getState())
+			return false
+		}
+		if fr.flags&FLAG_FIN != 0 {
+			str.closeLocal()
+		}
+	case controlFrame:
+		if fr.kind == FRAME_RST_STREAM {
+			str.reset()
+		}
+	}
+	return true
+}
+
+// checkReceived checks a DATA (of kind 0), SYN_REPLY or HEADERS frame
+// received against the state of its stream, and moves the stream along.
+// Frames out of place reset the stream with the status the spec gives for
+// them, and false is returned for the frame to be dropped
+func (s *Session) checkReceived(str *Stream, kind ControlFrameKind, fin bool) bool {
+	var status uint32
+	var reason string
+	switch {
+	case !str.remoteOpen():
+		status, reason = RST_STREAM_ALREADY_CLOSED, "after the FIN of the other end"
+	case kind == FRAME_SYN_REPLY && !s.isLocalStream(str.id):
+		status, reason = RST_PROTOCOL_ERROR, "for a stream started by the other end"
+	case kind == FRAME_SYN_REPLY && str.replied:
+		status, reason = RST_STREAM_IN_USE, "received twice"
+	case kind != FRAME_SYN_REPLY && s.isLocalStream(str.id) && !str.replied:
+		status, reason = RST_PROTOCOL_ERROR, "before the SYN_REPLY"
+	}
+	if status != 0 {
+		name := "DATA"
+		switch kind {
+		case FRAME_SYN_REPLY:
+			name = "SYN_REPLY"
+		case FRAME_HEADERS:
+			name = "HEADERS"
+		}
+		str.logger().Warn("resetting stream, "+name+" "+reason, "state", str.getState())
+		s.resetStream(str, status, name+" "+reason)
+		return false
+	}
+	if kind == FRAME_SYN_REPLY {
+		str.replied = true
+	}
+	if fin {
+		str.closeRemote()
+	}
+	return true
+}
@@ -7,57 +7,104 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const INITIAL_FLOW_CONTOL_WINDOW int32 = 64 * 1024
-const NORTHBOUND_SLOTS = 5
+
+// ErrStreamUnprocessed matches, with errors.Is, the errors of requests that
+// the other end did not process, because it refused their stream or because
+// their stream was above the last good stream of a GOAWAY. They are safe to
+// retry.
+var ErrStreamUnprocessed = errors.New("spdy: stream not processed by the other end")
+
+// ErrSessionClosed matches, with errors.Is, the SessionError of requests
+// whose session was closed before their reply was received in full.
+var ErrSessionClosed = errors.New("spdy: session closed before the reply")
 
 // NewClientStream starts a new Stream (in the given Session), to be used as a client
 func (s *Session) NewClientStream() *Stream {
+	return s.newClientStream(nil, false)
+}
+
+// NewRequestStream starts a new client Stream, like NewClientStream, for
+// the users of SessionInterface. It returns nil if the stream cannot be
+// started
+func (s *Session) NewRequestStream() StreamInterface {
+	if str := s.NewClientStream(); str != nil {
+		return str
+	}
+	return nil
+}
+
+// newClientStream starts a new client Stream, with the hooks of trace to
+// run for its request, if any. The stream of a tunnel is hijacked from the
+// start, as it can be idle for any length of time
+func (s *Session) newClientStream(trace *ClientTrace, tunnel bool) *Stream {
 	// no stream creation after goaway has been recieved
-	if !s.goaway_recvd {
+	if !s.goaway_recvd.Load() {
+		id := s.nextStreamID()
+		if id > MAX_STREAM_ID {
+			s.logger().Warn("no stream IDs left for new streams")
+			return nil
+		}
 		str := &Stream{
-			id:                s.nextStreamID(),
+			id:                id,
 			session:           s,
 			priority:          4, // FIXME need to implement priorities
 			associated_stream: 0, // FIXME for pushes we need to implement it
 			control:           make(chan controlFrame),
 			data:              make(chan dataFrame),
 			response:          make(chan bool),
-			eos:               make(chan bool),
+			eos:               make(chan bool, 1), // the request may be gone
 			stop_server:       make(chan bool),
 			flow_req:          make(chan int32, 1),
 			flow_add:          make(chan int32, 1),
-			upstream_buffer:   make(chan upstream_data, NORTHBOUND_SLOTS),
+			flow_done:         make(chan struct{}),
+			upstream_buffer:   newDataQueue(),
+			rate:              newRateLimiter(s.streamRate),
+			recvWindow:        s.receiveWindowLimit(),
+			started:           time.Now(),
+			trace:             trace,
 		}
+		str.ctx, str.cancel = context.WithCancel(context.WithValue(s.ctx, streamKey{}, str))
+		str.hijacked.Store(tunnel)
 
 		go str.serve()
 
 		go str.northboundBufferSender()
 
-		go str.flowManager(INITIAL_FLOW_CONTOL_WINDOW, str.flow_add, str.flow_req)
-
 		// add the stream to the session
 
+		// known to the sender before its SYN_STREAM, for its state
+		s.counted.Store(str.id, str)
 		deadline := time.After(1500 * time.Millisecond)
 		select {
 		case s.new_stream <- str:
-			// done
+			// done, with the window as of the last SETTINGS once registered
+			go str.flowManager(s.initialSendWindow(), str.flow_add, str.flow_req)
 			return str
 		case <-deadline:
 			// somehow it was locked
 			debug.Printf("Stream #%d: cannot be created. Stream is hung. Resetting it.", str.id)
+			s.counted.Delete(str.id)
+			s.synDone(str.id)
 			s.Close()
 			return nil
 		}
@@ -69,7 +116,7 @@ func (s *Session) NewClientStream() *Stream {
 
 func (s *Session) newServerStream(frame controlFrame) (str *Stream, err error) {
 	// no stream creation after goaway has been recieved
-	if !s.goaway_recvd {
+	if !s.goaway_recvd.Load() {
 		str = &Stream{
 			id:                frame.streamID(),
 			session:           s,
@@ -82,11 +129,29 @@ func (s *Session) newServerStream(frame controlFrame) (str *Stream, err error) {
 			stop_server:       make(chan bool),
 			flow_req:          make(chan int32, 1),
 			flow_add:          make(chan int32, 1),
+			flow_done:         make(chan struct{}),
+			rate:              newRateLimiter(s.streamRate),
+			recvWindow:        s.receiveWindowLimit(),
+			state:             int32(STREAM_OPEN),
+			started:           time.Now(),
+		}
+		if frame.isFIN() {
+			str.state = int32(STREAM_HALF_CLOSED_REMOTE)
 		}
+		if s.ctx != nil {
+			str.ctx, str.cancel = context.WithCancel(context.WithValue(s.ctx, streamKey{}, str))
+		}
+		// registered right away, as this runs in the session loop, for
+		// the frames after the SYN_STREAM to find it
+		s.addStream(str)
+		// the SYN_STREAM, received before the stream was registered
+		str.countReceived(8 + len(frame.data))
+		// its header block, checked against the limit already
+		s.budget.add(str, headerSize(frame.headers))
 
 		go str.serve()
 
-		go str.flowManager(INITIAL_FLOW_CONTOL_WINDOW, str.flow_add, str.flow_req)
+		go str.flowManager(s.initialSendWindow(), str.flow_add, str.flow_req)
 
 		// send the SYN_STREAM control frame to get it started
 		str.control <- frame
@@ -97,6 +162,74 @@ func (s *Session) newServerStream(frame controlFrame) (str *Stream, err error) {
 
 }
 
+// Stats returns a snapshot of the counters of the Stream
+func (s *Stream) Stats() StreamStats {
+	return StreamStats{
+		BytesSent:      atomic.LoadInt64(&s.bytesSent),
+		BytesReceived:  atomic.LoadInt64(&s.bytesReceived),
+		FramesSent:     atomic.LoadInt64(&s.framesSent),
+		FramesReceived: atomic.LoadInt64(&s.framesReceived),
+		State:          s.getState(),
+	}
+}
+
+// RequestHeader returns the header block of the request of the stream,
+// pseudo-headers included, as received by a server stream or sent by a
+// client stream, or nil before then. It is not to be modified
+func (s *Stream) RequestHeader() http.Header {
+	return s.requestHeader
+}
+
+// ReplyHeader returns the header block of the reply of the stream,
+// pseudo-headers included, as sent by a server stream or received by a
+// client stream, or nil before then. It is not to be modified
+func (s *Stream) ReplyHeader() http.Header {
+	return s.replyHeader
+}
+
+// ID returns the ID of the stream
+func (s *Stream) ID() uint32 {
+	return uint32(s.id)
+}
+
+// Priority returns the priority of the stream, from 0, the highest, to 7
+func (s *Stream) Priority() uint8 {
+	return s.priority
+}
+
+// Session returns the Session of the stream
+func (s *Stream) Session() *Session {
+	return s.session
+}
+
+// Context returns the context of the stream, derived from the one of its
+// Session and done once the stream ends, is reset or its session closed.
+// For server streams, it is the context of their request. ContextStream
+// returns the stream of it
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// ContextStream returns the Stream of the context of a request served
+// over SPDY, or of the Context of a stream, if any, e.g. for an access log
+// to record its Stats once the handler is done
+func ContextStream(ctx context.Context) *Stream {
+	str, _ := ctx.Value(streamKey{}).(*Stream)
+	return str
+}
+
+// countReceived adds a frame received to the counters of the stream
+func (s *Stream) countReceived(size int) {
+	atomic.AddInt64(&s.bytesReceived, int64(size))
+	atomic.AddInt64(&s.framesReceived, 1)
+}
+
+// logger returns the logger for the messages of this stream, with the
+// fields of its session and its ID
+func (s *Stream) logger() *slog.Logger {
+	return s.session.logger().With("stream", s.id)
+}
+
 // String returns the Stream ID of the Stream
 func (s *Stream) String() string {
 	return fmt.Sprintf("%d", s.id)
@@ -121,20 +254,19 @@ func (s *Stream) prepareRequestHeader(request *http.Request) (err error) {
 	}
 
 	// normalize host:port
-	if !strings.Contains(url.Host, ":") {
-		switch url.Scheme {
-		case "http":
-			url.Host += ":80"
-		case "https":
-			url.Host += ":443"
-		}
+	url.Host = hostPort(url.Host, url.Scheme)
+	// the Host of the request, if set apart from the one of its URL, is
+	// the one asked for, as for virtual hosting
+	host := url.Host
+	if request.Host != "" && hostPort(request.Host, url.Scheme) != url.Host {
+		host = request.Host
 	}
 
 	// set all SPDY headers
 	request.Header.Set(HEADER_METHOD, request.Method)
 	request.Header.Set(HEADER_PATH, path)
 	request.Header.Set(HEADER_VERSION, request.Proto)
-	request.Header.Set(HEADER_HOST, url.Host)
+	request.Header.Set(HEADER_HOST, host)
 	request.Header.Set(HEADER_SCHEME, url.Scheme)
 
 	request.Header.Del("Connection")
@@ -146,80 +278,76 @@ func (s *Stream) prepareRequestHeader(request *http.Request) (err error) {
 	return nil
 }
 
-func (s *Stream) prepareRequestBody(request *http.Request) (body []*dataFrame, err error) {
-
-	body = make([]*dataFrame, 0, 1)
-	if request.Body == nil {
-		return body, nil
-	}
-
-	buf := make([]byte, 32*1024)
-	n, err := request.Body.Read(buf)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-	total := n
-	for n > 0 {
-		data := new(dataFrame)
-		data.data = make([]byte, n)
-		copy(data.data, buf[:n])
-		body = append(body, data)
-		n, err = request.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
+// hostPort returns a host with the default port of the scheme, if without
+// a port
+func hostPort(host, scheme string) string {
+	if !strings.Contains(host, ":") {
+		switch scheme {
+		case "http":
+			host += ":80"
+		case "https":
+			host += ":443"
 		}
-		total += n
-	}
-
-	// Half-close the stream.
-	if len(body) != 0 {
-		request.Header.Set("Content-Length", fmt.Sprint(total))
-		body[len(body)-1].flags = FLAG_FIN
 	}
-	request.Body.Close()
-
-	err = nil // in case it was EOF, which is not an error
-
-	return
+	return host
 }
 
 func (s *Stream) handleRequest(request *http.Request) (err error) {
 	err = s.prepareRequestHeader(request)
 	if err != nil {
+		closeBody(request)
 		return
 	}
 
-	flags := FLAG_NONE
-	if request.Body == nil {
-		flags = FLAG_FIN
-	}
-
-	body, err := s.prepareRequestBody(request)
-	if err != nil {
-		return
+	body := request.Body
+	if body == http.NoBody {
+		body.Close()
+		body = nil
 	}
-
-	if len(body) == 0 {
+	flags := FLAG_NONE
+	if body == nil {
 		flags = FLAG_FIN
+	} else if request.ContentLength > 0 {
+		request.Header.Set(HEADER_CONTENT_LENGTH, fmt.Sprint(request.ContentLength))
 	}
 
 	// send the SYN frame to start the stream
-	f := frameSynStream{session: s.session, stream: s.id, header: request.Header, flags: flags}
+	s.priority = requestPriority(request)
+	s.requestHeader = request.Header.Clone()
+	f := frameSynStream{session: s.session, stream: s.id, priority: s.priority, header: s.requestHeader, flags: flags}
 	debug.Println("Sending SYN_STREAM:", f)
-	s.session.out <- f
-
-	// send the DATA frames for the body
-	for _, frame := range body {
-		frame.stream = s.id
-		s.session.out <- frame
+	if !s.session.sendSynStream(f) {
+		if body != nil {
+			body.Close()
+		}
+		return s.session.sessionError("session closed before the request")
+	}
+	if s.trace != nil && s.trace.WroteHeaders != nil {
+		s.trace.WroteHeaders()
+	}
+	if body == nil {
+		// the request went out in full, with its FIN
+		s.wroteFIN.Store(true)
+		return nil
 	}
 
-	// need to return now but the data pieces will be picked up
-	// and the eos channel will be notified when done
+	// the body goes out as the flow control window allows, while the
+	// reply is awaited, as the server may reply before reading it all
+	go s.sendRequestBody(body)
 
 	return nil
 }
 
+// sendRequestBody sends the body of the request of a client stream, with
+// its FIN, and closes it. The stream is reset if the body cannot be read
+func (s *Stream) sendRequestBody(body io.ReadCloser) {
+	defer body.Close()
+	_, err := s.WriteFrom(body)
+	if err != nil && !s.closed.Load() && s.getState() != STREAM_CLOSED {
+		s.session.resetStream(s, RST_CANCEL, "cannot read the request body: "+err.Error())
+	}
+}
+
 // Request makes an http request down the client that gets a client Stream
 // started and returning the request in the ResponseWriter
 func (s *Stream) Request(request *http.Request, writer http.ResponseWriter) (err error) {
@@ -229,13 +357,27 @@ func (s *Stream) Request(request *http.Request, writer http.ResponseWriter) (err
 	err = s.handleRequest(request)
 	if err != nil {
 		debug.Println("ERROR in stream.serve/http.Request:", err)
+		s.finish_stream()
 		return
 	}
 
 	debug.Printf("Waiting for #%d to end", s.id)
 
-	// the response is finished sending
-	<-s.eos
+	// the response is finished sending, unless the request is cancelled
+	select {
+	case <-s.eos:
+	case <-request.Context().Done():
+		debug.Printf("Stream #%d: request cancelled", s.id)
+		s.sendRstStream(RST_CANCEL)
+		err = request.Context().Err()
+	}
+	if err == nil && !s.finished.Load() {
+		// the reply is cut short, which its reader is to know
+		err = s.closeError()
+		if err == nil {
+			err = &StreamError{StreamID: uint32(s.id), Reason: "closed before the end of the reply"}
+		}
+	}
 
 	s.finish_stream()
 
@@ -245,6 +387,10 @@ func (s *Stream) Request(request *http.Request, writer http.ResponseWriter) (err
 func (s *Stream) finish_stream() {
 
 	defer no_panics()
+	if s.closed.Load() {
+		// its loop is done already
+		return
+	}
 	deadline := time.After(500 * time.Millisecond)
 
 	select {
@@ -261,14 +407,8 @@ func (s *Stream) finish_stream() {
 func (s *Stream) initiate_stream(frame controlFrame) (err error) {
 	debug.Println("Stream server got SYN_STREAM")
 
-	s.id = frame.streamID()
-
 	data := bytes.NewBuffer(frame.data[4:])
 
-	// add the stream to the map of streams in the session
-	// note that above the message sending the ID is zero initially!
-	s.session.new_stream <- s
-
 	var associated_id uint32
 	err = binary.Read(data, binary.BigEndian, &associated_id)
 	if err != nil {
@@ -289,20 +429,27 @@ func (s *Stream) initiate_stream(frame controlFrame) (err error) {
 		return err
 	}
 
-	headers := make(http.Header)
-	// debug.Println("header data:", data.Bytes())
-	headers, err = s.session.headerReader.decode(data.Bytes())
+	headers, err := frame.headers, frame.headerErr
+	if err == nil {
+		// the host is the one of :host
+		headers.Del("Host")
+		err = checkRequestHeader(headers, s.associated_stream != 0)
+	}
+	if err == errHeaderTooLarge {
+		s.logger().Warn("request header block too large")
+		s.sendRstStream(RST_FRAME_TOO_LARGE)
+	}
+	if _, ok := err.(malformedHeaderError); ok {
+		s.logger().Warn("resetting stream with a malformed request", "err", err)
+		s.sendRstStream(RST_PROTOCOL_ERROR)
+	}
 	if err != nil {
 		return err
 	}
 
-	headers.Del("Connection")
-	headers.Del("Host")
-	headers.Del("Keep-Alive")
-	headers.Del("Proxy-Connection")
-	headers.Del("Transfer-Encoding")
-
 	s.headers = headers
+	// the handler gets its own copy, in the request
+	s.requestHeader = headers.Clone()
 
 	// build the frame just for printing it
 	ss := frameSynStream{
@@ -314,104 +461,89 @@ func (s *Stream) initiate_stream(frame controlFrame) (err error) {
 		flags:             frame.flags}
 
 	debug.Println("Processing SYN_STREAM", ss)
-	if frame.isFIN() {
-		// call the handler
 
-		req := &http.Request{
-			Method:     headers.Get(HEADER_METHOD),
-			Proto:      headers.Get(HEADER_VERSION),
-			Header:     headers,
-			RemoteAddr: s.session.conn.RemoteAddr().String(),
+	req := s.newRequest(headers)
+	if !frame.isFIN() {
+		// the handler gets started right away, with the data
+		// frames streamed to the body as they arrive
+		s.upstream_buffer = newDataQueue()
+		s.request_body = &streamBody{stream: s}
+		req.ContentLength = -1
+		if cl := headers.Get(HEADER_CONTENT_LENGTH); cl != "" {
+			req.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
 		}
-		req.URL, _ = url.ParseRequestURI(headers.Get(HEADER_PATH))
+		req.Body = s.request_body
+	}
 
-		// Clear the headers in the session now that the request has them
-		s.headers = make(http.Header)
+	// Clear the headers in the session now that the request has them
+	s.headers = make(http.Header)
 
-		go s.requestHandler(req)
+	// call the handler
+	s.request = req
+	go s.requestHandler(req)
 
-	} else {
-		var data []byte
+	return nil
+}
 
-		endflag := 0
-		for endflag == 0 {
-			deadline := time.After(3 * time.Second)
-			select {
-			case cf, ok := <-s.control:
-				if !ok {
-					return
-				}
-				switch cf.kind {
-				case FRAME_SYN_STREAM:
-					err = errors.New("Multiple Syn Streams sent to single Stream")
-					return
-				case FRAME_SYN_REPLY:
-					err = s.handleSynReply(cf)
-				case FRAME_RST_STREAM:
-					err = s.handleRstStream(cf)
-					return
-				case FRAME_WINDOW_UPDATE:
-					s.handleWindowUpdate(cf)
-				default:
-					panic("TODO: unhandled type of frame received in stream.serve()")
-				}
-			case df, ok := <-s.data:
-				//collecting data
-				if !ok {
-					debug.Println("Error collecting data frames", ok)
-					return
-				}
-				data = append(data, df.data...)
-				if df.isFIN() {
-					endflag = 1
-				}
-				break
+// newRequest makes the http request for the handler of a server stream
+// out of the headers of the stream
+func (s *Stream) newRequest(headers http.Header) *http.Request {
+	req := &http.Request{
+		Method:     headers.Get(HEADER_METHOD),
+		Proto:      headers.Get(HEADER_VERSION),
+		Header:     headers,
+		RemoteAddr: s.session.RemoteAddr().String(),
+		TLS:        s.session.TLSConnectionState(),
+	}
+	req.URL, _ = url.ParseRequestURI(headers.Get(HEADER_PATH))
+	if req.URL == nil && req.Method == "CONNECT" {
+		req.URL = &url.URL{Host: headers.Get(HEADER_HOST)}
+	}
+	req.Host = headers.Get(HEADER_HOST)
+	if s.ctx != nil {
+		req = req.WithContext(s.ctx)
+	}
+	return req
+}
 
-			case <-deadline:
-				//unsuccessfully waited for FIN
-				// no activity in a while. Assume that body is completely recieved. Bail
-				//panic("Waited long enough but no data frames recieved")
-				debug.Println("Waited long enough but no data frames recieved")
-				endflag = 2
-				break
+func (s *Stream) requestHandler(req *http.Request) {
+	// the session may be gone by the time the handler is done, and the
+	// reply of a handler that panics, like a proxy aborting it with
+	// http.ErrAbortHandler, is cut short with a reset
+	defer func() {
+		if v := recover(); v != nil {
+			defer no_panics()
+			if v != http.ErrAbortHandler {
+				s.logger().Warn("handler panic", "panic", v)
 			}
-		}
-		if endflag == 1 {
-			//http request if data frames collected sucessfully
-			// call the handler
-			contLen, _ := strconv.Atoi(headers.Get(HEADER_CONTENT_LENGTH))
-			req := &http.Request{
-				Method:        headers.Get(HEADER_METHOD),
-				Proto:         headers.Get(HEADER_VERSION),
-				Header:        headers,
-				RemoteAddr:    s.session.conn.RemoteAddr().String(),
-				ContentLength: int64(contLen),
-				Body:          &readCloser{bytes.NewReader(data)},
+			if !s.closed.Load() {
+				s.session.resetStream(s, RST_INTERNAL_ERROR, "handler aborted")
 			}
-			req.URL, _ = url.ParseRequestURI(headers.Get(HEADER_PATH))
-
-			// Clear the headers in the session now that the request has them
-			s.headers = make(http.Header)
-
-			go s.requestHandler(req)
 		}
-
+	}()
+	if onStream := s.session.onStream; onStream != nil && req.Method == STREAM_METHOD && s.request_body != nil {
+		conn, _, _ := s.Hijack()
+		onStream(conn, req.Header)
+		conn.Close()
+		return
 	}
-
-	return nil
-}
-func (s *Stream) requestHandler(req *http.Request) {
 	// call the handler - this writes the SYN_REPLY and all data frames
-	s.session.server.Handler.ServeHTTP(s, req)
+	handler := s.session.server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(s, req)
 
-	debug.Printf("Sending final DATA with FIN the handler for #%d", s.id)
+	if s.hijacked.Load() {
+		// the stream is finished when the connection is closed
+		return
+	}
 
-	// send an empty data frame with FIN set to end the deal
-	frame := dataFrame{stream: s.id, flags: FLAG_FIN}
-	s.session.out <- frame
+	// end the reply, unless the handler did with CloseWrite
+	s.CloseWrite()
 
 	// close shop for this stream's end
-	if !s.closed {
+	if !s.closed.Load() {
 		s.stop_server <- true
 	}
 }
@@ -423,31 +555,53 @@ func (s *Stream) serve() {
 	if err != nil {
 		debug.Println("ERROR in stream loop:", err)
 	}
-	s.closed = true
+	s.closed.Store(true)
+	s.session.budget.drop(s)
+	// a stream of this end may end before its SYN_STREAM
+	s.session.synDone(s.id)
+	if s.cancel != nil {
+		// let the handler know it can stop
+		s.cancel()
+	}
 
 	deadline := time.After(1500 * time.Millisecond)
 	select {
 	case s.session.end_stream <- s:
 		// done, all good!
+	case <-s.session.ctx.Done():
+		// the session is closed, with its streams removed already
 	case <-deadline:
 		// somehow it was locked
 		debug.Printf("Stream #%d: timed out and cannot be removed from the session", s.id)
 	}
 
 	if s.upstream_buffer != nil {
-		// this is not a server stream
-		close(s.upstream_buffer)
+		// a client stream or a server stream with a streamed body
+		s.upstream_buffer.close()
 	}
-	close(s.flow_add)
-	close(s.flow_req)
+	close(s.flow_done)
+	// after the flow, for writers waiting on it to let go
+	s.dropWrites()
 	debug.Printf("Stream #%d main loop done", s.id)
 }
 
 // stream server loop
 func (s *Stream) stream_loop() (err error) {
 
+	// a client stream is reset if its reply takes too long
+	var replyTimeout <-chan time.Time
+	if d := s.session.replyTimeout; d > 0 && s.session.isLocalStream(s.id) && s.associated_stream == 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		replyTimeout = timer.C
+	}
+
 	for {
 		deadline := time.After(10 * time.Second)
+		if s.hijacked.Load() {
+			// tunnels can be idle for any length of time
+			deadline = nil
+		}
 		select {
 		case cf, ok := <-s.control:
 			if !ok {
@@ -459,6 +613,9 @@ func (s *Stream) stream_loop() (err error) {
 				debug.Println("Goroutines:", runtime.NumGoroutine())
 			case FRAME_SYN_REPLY:
 				err = s.handleSynReply(cf)
+				replyTimeout = nil
+			case FRAME_HEADERS:
+				err = s.handleHeaders(cf)
 			case FRAME_RST_STREAM:
 				err = s.handleRstStream(cf)
 				return
@@ -475,6 +632,11 @@ func (s *Stream) stream_loop() (err error) {
 		case <-deadline:
 			// no activity in a while. bail
 			return
+		case <-replyTimeout:
+			s.logger().Warn("resetting stream without a reply", "timeout", s.session.replyTimeout)
+			s.setCloseErr(ErrResponseHeaderTimeout)
+			s.sendRstStream(RST_CANCEL)
+			return
 		case _, _ = <-s.stop_server:
 			return
 		}
@@ -485,60 +647,335 @@ func (s *Stream) stream_loop() (err error) {
 	}
 }
 
+// CloseWrite half-closes the stream, sending a FIN after the data written
+// so far, while the data of the other end can still be read, like the
+// request body by a handler or the read side of a tunnel. The reply of a
+// handler gets its trailers, if any, with the FIN. Writes after it fail
+func (s *Stream) CloseWrite() error {
+	if s.closed.Load() {
+		return s.writeError("CloseWrite of closed stream")
+	}
+	if s.wroteFIN.Load() {
+		return nil
+	}
+	server := !s.session.isLocalStream(s.id) || s.associated_stream != 0
+	if server && !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if err := s.flushWrites(); err != nil {
+		return err
+	}
+	if !s.wroteFIN.CompareAndSwap(false, true) {
+		// half-closed by another goroutine meanwhile
+		return nil
+	}
+
+	// the headers of a client stream are the ones of the reply
+	var trailers http.Header
+	if server {
+		trailers = s.trailers()
+	}
+	if len(trailers) > 0 {
+		debug.Printf("Sending trailers with FIN for #%d", s.id)
+		s.session.send(frameHeaders{session: s.session, stream: s.id, headers: trailers, flags: FLAG_FIN})
+	} else {
+		debug.Printf("Sending final DATA with FIN for #%d", s.id)
+
+		// send an empty data frame with FIN set to end the deal
+		s.session.send(dataFrame{stream: s.id, flags: FLAG_FIN})
+	}
+	return nil
+}
+
 // Header makes streams compatible with the net/http handlers interface
 func (s *Stream) Header() http.Header { return s.headers }
 
 // Write makes streams compatible with the net/http handlers interface
 func (s *Stream) Write(p []byte) (n int, err error) {
-	if s.closed {
-		err = errors.New(fmt.Sprintf("Stream #%d: write on closed stream!", s.id))
+	if s.closed.Load() {
+		err = s.writeError("write on closed stream")
 		return
 	}
 	if !s.wroteHeader {
 		s.WriteHeader(http.StatusOK)
 	}
-	lp := int32(len(p))
-	if lp == 0 {
+	if s.session.writeDelay > 0 {
+		return s.bufferWrite(p)
+	}
+	return s.writeData(p)
+}
+
+// bufferWrite holds small writes for up to the write delay of the session,
+// to send them together in one DATA frame
+func (s *Stream) bufferWrite(p []byte) (n int, err error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.werr != nil {
+		err, s.werr = s.werr, nil
 		return
 	}
-	flow := int32(0)
-	for lp > flow {
-		// if there is data to send and it's larger than the flow control window
-		// we need to stall until we have enough to go
-		window, ok := <-s.flow_req
-		debug.Printf("Stream #%d: got %d bytes of flow", s.id, window)
-		if !ok || s.closed {
-			debug.Printf("Stream #%d: flow closed!", s.id)
-			return 0, errors.New(fmt.Sprintf("Stream #%d closed while writing"))
+	if len(s.wbuf)+len(p) <= s.session.writeBufferSize {
+		s.wbuf = append(s.wbuf, p...)
+		if s.wtimer == nil {
+			s.wtimer = time.AfterFunc(s.session.writeDelay, s.flushHeld)
 		}
-		flow += window
+		return len(p), nil
+	}
+	err = s.flushWritesLocked()
+	if err != nil {
+		return
+	}
+	return s.writeData(p)
+}
+
+// flushWrites sends the small writes held, if any
+func (s *Stream) flushWrites() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.flushWritesLocked()
+}
+
+// flushHeld sends the small writes held once the write delay is over. No
+// writer waits for it, so its error is returned by the next write
+func (s *Stream) flushHeld() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.werr = s.flushWritesLocked()
+}
+
+func (s *Stream) flushWritesLocked() (err error) {
+	if s.wtimer != nil {
+		s.wtimer.Stop()
+		s.wtimer = nil
+	}
+	if s.werr != nil {
+		err, s.werr = s.werr, nil
+		return
+	}
+	if len(s.wbuf) > 0 {
+		_, err = s.writeData(s.wbuf)
+		s.wbuf = s.wbuf[:0]
 	}
+	return
+}
+
+// dropWrites gives up the small writes held, once the stream is closed
+func (s *Stream) dropWrites() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.wtimer != nil {
+		s.wtimer.Stop()
+		s.wtimer = nil
+	}
+	s.wbuf = nil
+}
+
+// writeData sends the data in DATA frames, within the flow control window.
+// The data goes out as the window allows, blocking while it is closed, so
+// the data of a slow reader is not buffered
+func (s *Stream) writeData(p []byte) (n int, err error) {
 	// this is just in case we end up trying to write while on network turbulence
 	defer no_panics()
+	if s.wroteFIN.Load() {
+		return 0, s.writeError("write after CloseWrite")
+	}
 	for len(p) > 0 {
-		frame := dataFrame{stream: s.id}
-		if len(p) < MAX_DATA_PAYLOAD {
-			frame.data = make([]byte, len(p))
-		} else {
-			frame.data = make([]byte, MAX_DATA_PAYLOAD)
+		var window int32
+		window, err = s.awaitWindow()
+		if err != nil {
+			return
+		}
+		debug.Printf("Stream #%d: got %d bytes of flow", s.id, window)
+		// the buffer is given back by the frame sender, once written
+		frame := dataFrame{stream: s.id, pooled: true}
+		frame.data = getDataBuffer()
+		if int(window) < len(frame.data) {
+			frame.data = frame.data[:window]
 		}
-		copy(frame.data, p)
+		frame.data = frame.data[:copy(frame.data, p)]
 		p = p[len(frame.data):]
-		s.session.out <- frame
+
+		// put the rest back in the flow control window
+		s.giveFlow(window - int32(len(frame.data)))
+		debug.Printf("Stream #%d: FCW updated -%d: %d -> %d", s.id, len(frame.data), window, window-int32(len(frame.data)))
+
+		s.throttle(len(frame.data))
+		if s.getState() == STREAM_CLOSED {
+			// reset while waiting, like a push cancelled by the client
+			putDataBuffer(frame.data)
+			return n, s.writeError("reset while writing")
+		}
+		if !s.session.send(frame) {
+			putDataBuffer(frame.data)
+			return n, s.writeError("session closed while writing")
+		}
 		n += len(frame.data)
 	}
+	return
+}
+
+// awaitWindow waits for the send window of the stream, up to the write
+// deadline, if any
+func (s *Stream) awaitWindow() (window int32, err error) {
+	expired := s.writeDeadline.wait()
+	select {
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	select {
+	case w := <-s.flow_req:
+		if s.closed.Load() {
+			debug.Printf("Stream #%d: flow closed!", s.id)
+			return 0, s.writeError("closed while writing")
+		}
+		return w, nil
+	case <-s.flow_done:
+		debug.Printf("Stream #%d: flow closed!", s.id)
+		return 0, s.writeError("closed while writing")
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
 
-	// put the rest back in the flow control window
-	s.flow_add <- flow - int32(n)
-	debug.Printf("Stream #%d: FCW updated -%d: %d -> %d", s.id, int32(n), flow, flow-int32(n))
+// stalled reports the time the stream had no send window
+func (s *Stream) stalled(d time.Duration) {
+	if o := observed(); o != nil {
+		o.WindowStalled(d)
+	}
+	if s.trace != nil && s.trace.WindowStalled != nil {
+		s.trace.WindowStalled(d)
+	}
+}
 
-	return
+// throttle waits for n bytes of DATA to be within the rate limits of the
+// stream and of its session, or for the stream to end
+func (s *Stream) throttle(n int) {
+	var done <-chan struct{}
+	if s.ctx != nil {
+		done = s.ctx.Done()
+	}
+	s.rate.wait(n, done)
+	s.session.rate.wait(n, done)
+}
+
+// ReadFrom makes streams compatible with io.ReaderFrom, so that io.Copy
+// into a stream, like from an *os.File, reads straight into the buffers
+// of the DATA frames, each no larger than the flow control window
+func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
+	if s.closed.Load() {
+		err = s.writeError("write on closed stream")
+		return
+	}
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	err = s.flushWrites()
+	if err != nil {
+		return
+	}
+	return s.pump(r)
+}
+
+// WriteFrom sends all the data of r on the stream and half-closes it, like
+// the body of an upload or of a reply. The data goes out in DATA frames as
+// large as the data buffers, as the flow control window of the stream and
+// its rate limits allow, so readers of any size are sent without being
+// held in memory. Client streams send no reply header
+func (s *Stream) WriteFrom(r io.Reader) (n int64, err error) {
+	if s.closed.Load() {
+		err = s.writeError("write on closed stream")
+		return
+	}
+	if s.wroteFIN.Load() {
+		err = s.writeError("write after CloseWrite")
+		return
+	}
+	server := !s.session.isLocalStream(s.id) || s.associated_stream != 0
+	if server && !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	err = s.flushWrites()
+	if err != nil {
+		return
+	}
+	n, err = s.pump(r)
+	if err != nil {
+		return
+	}
+	return n, s.CloseWrite()
+}
+
+// pump sends the data of r in DATA frames until EOF, reading straight into
+// the buffers of the frames, each no larger than the flow control window
+func (s *Stream) pump(r io.Reader) (n int64, err error) {
+	// this is just in case we end up trying to write while on network turbulence
+	defer no_panics()
+	for {
+		var window int32
+		window, err = s.awaitWindow()
+		if err != nil {
+			return
+		}
+		buf := getDataBuffer()
+		if int(window) < len(buf) {
+			buf = buf[:window]
+		}
+		nr, rerr := r.Read(buf)
+		// put the rest back in the flow control window
+		s.giveFlow(window - int32(nr))
+		if nr > 0 {
+			s.throttle(nr)
+			if s.getState() == STREAM_CLOSED {
+				// reset while waiting, like an upload refused by the server
+				putDataBuffer(buf)
+				return n, s.writeError("reset while writing")
+			}
+			// the buffer is given back by the frame sender, once written
+			if !s.session.send(dataFrame{stream: s.id, data: buf[:nr], pooled: true}) {
+				putDataBuffer(buf)
+				return n, s.writeError("session closed while writing")
+			}
+			n += int64(nr)
+		} else {
+			putDataBuffer(buf)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// Flush makes streams compatible with the net/http Flusher interface. It
+// returns once the data written so far has been sent over the connection
+func (s *Stream) Flush() {
+	if s.closed.Load() {
+		return
+	}
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	s.flushWrites()
+	// the session may be closed under us
+	defer no_panics()
+	m := flushMarker{done: make(chan bool)}
+	if !s.session.send(m) {
+		return
+	}
+	select {
+	case <-m.done:
+	case <-time.After(s.session.writeTimeout):
+		debug.Printf("Stream #%d: timed out flushing", s.id)
+	}
 }
 
 // WriteHeader makes streams compatible with the net/http handlers interface
 func (s *Stream) WriteHeader(code int) {
 	if s.wroteHeader {
-		log.Println("ERROR: Multiple calls to ResponseWriter.WriteHeader.")
+		s.logger().Error("multiple calls to ResponseWriter.WriteHeader")
 		return
 	}
 
@@ -552,22 +989,90 @@ func (s *Stream) WriteHeader(code int) {
 	if s.headers.Get("Date") == "" {
 		s.headers.Set("Date", time.Now().UTC().Format(http.TimeFormat))
 	}
+	// the trailers are sent at the end
+	headers := s.headers.Clone()
+	for name := range s.trailers() {
+		headers.Del(name)
+	}
+	for name := range headers {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			delete(headers, name)
+		}
+	}
+	for _, name := range connectionHeaders {
+		headers.Del(name)
+	}
+	headers.Del("Host")
+	s.replyHeader = headers
+	if s.associated_stream != 0 {
+		// the reply of a pushed stream goes in a HEADERS frame
+		debug.Printf("Sending HEADERS of pushed stream #%d", s.id)
+		s.session.send(frameHeaders{session: s.session, stream: s.id, headers: headers})
+		s.wroteHeader = true
+		return
+	}
 	// Write the frame
-	sr := frameSynReply{session: s.session, stream: s.id, headers: s.headers}
+	sr := frameSynReply{session: s.session, stream: s.id, headers: headers}
 	debug.Println("Sending SYN_REPLY", sr)
-	s.session.out <- sr
+	s.session.send(sr)
 	s.wroteHeader = true
+	if s.session.pushPreloads {
+		s.pushPreloads()
+	}
+}
+
+// trailers returns the trailers of the response of the handler: the
+// headers declared in the "Trailer" header, and the ones set with
+// the http.TrailerPrefix
+func (s *Stream) trailers() http.Header {
+	trailers := make(http.Header)
+	for _, declared := range s.headers["Trailer"] {
+		for _, name := range strings.Split(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := s.headers[name]; ok {
+				trailers[name] = values
+			}
+		}
+	}
+	for name, values := range s.headers {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(name[len(http.TrailerPrefix):])] = values
+		}
+	}
+	return trailers
 }
 
 // takes a SYN_REPLY control frame
 func (s *Stream) handleSynReply(frame controlFrame) (err error) {
 
 	debug.Println("Stream server got SYN_REPLY")
+	if s.trace != nil && s.trace.GotFirstResponseByte != nil {
+		s.trace.GotFirstResponseByte()
+	}
 
-	s.headers, err = s.session.headerReader.decode(frame.data[4:])
+	s.headers, err = frame.headers, frame.headerErr
+	if err == nil {
+		s.headers.Del("Host")
+		err = checkReplyHeader(s.headers)
+	}
+	if err == errHeaderTooLarge {
+		s.logger().Warn("reply header block too large")
+		s.sendRstStream(RST_FRAME_TOO_LARGE)
+	}
+	if _, ok := err.(malformedHeaderError); ok {
+		s.logger().Warn("resetting stream with a malformed reply", "err", err)
+		s.setCloseErr(&StreamError{StreamID: uint32(s.id), Status: RST_PROTOCOL_ERROR, Reason: err.Error()})
+		s.sendRstStream(RST_PROTOCOL_ERROR)
+	}
 	if err != nil {
 		return
 	}
+	s.replyHeader = s.headers
+	if s.response_writer == nil {
+		// the stream was not started with a Request, nobody to reply to
+		debug.Printf("Stream #%d: SYN_REPLY without a request ignored", s.id)
+		return
+	}
 	h := s.response_writer.Header()
 	for name, values := range s.headers {
 		if name[0] == ':' { // skip SPDY headers
@@ -575,13 +1080,13 @@ func (s *Stream) handleSynReply(frame controlFrame) (err error) {
 		}
 		for _, value := range values {
 			debug.Printf("Header: %s -> %s\n", name, value)
-			h.Set(name, value)
+			h.Add(name, value)
 		}
 	}
 	status := s.headers.Get(HEADER_STATUS)
 	code, err := strconv.Atoi(status[0:3])
 	if err != nil {
-		log.Println("ERROR: handleSynReply: got an unparseable status:", status)
+		s.logger().Error("unparseable status in SYN_REPLY", "status", status)
 	}
 	debug.Printf("Header status code: %d\n", code)
 
@@ -592,22 +1097,75 @@ func (s *Stream) handleSynReply(frame controlFrame) (err error) {
 
 	if frame.isFIN() {
 		debug.Println("Stream FIN found in SYN_REPLY frame")
+		s.finished.Store(true)
 		s.eos <- true
 	}
 
 	return nil
 }
 
-// send stream cancellation
-func (s *Stream) sendRstStream() {
-	data := new(bytes.Buffer)
-	binary.Write(data, binary.BigEndian, s.id)
-	// FIXME this needs some cleaning
-	var code uint32 = 5 // CANCEL
-	binary.Write(data, binary.BigEndian, code)
+// takes a HEADERS control frame, with the trailers of the other end
+func (s *Stream) handleHeaders(frame controlFrame) (err error) {
+
+	debug.Println("Stream server got HEADERS")
+
+	headers, err := frame.headers, frame.headerErr
+	if err == errHeaderTooLarge {
+		s.logger().Warn("trailer header block too large")
+		s.sendRstStream(RST_FRAME_TOO_LARGE)
+	}
+	if _, ok := err.(malformedHeaderError); ok {
+		s.logger().Warn("resetting stream with malformed trailers", "err", err)
+		s.setCloseErr(&StreamError{StreamID: uint32(s.id), Status: RST_PROTOCOL_ERROR, Reason: err.Error()})
+		s.sendRstStream(RST_PROTOCOL_ERROR)
+	}
+	if err != nil {
+		return
+	}
+	if s.response_writer != nil {
+		// trailers of a response, as net/http handlers set them
+		h := s.response_writer.Header()
+		for name, values := range headers {
+			for _, value := range values {
+				h.Add(http.TrailerPrefix+http.CanonicalHeaderKey(name), value)
+			}
+		}
+	}
+
+	if frame.isFIN() && s.upstream_buffer != nil {
+		// in line with the data, for the end of stream to come after it
+		err = s.handleDataFrame(dataFrame{stream: s.id, flags: FLAG_FIN})
+	}
+
+	return
+}
+
+// send stream reset with the given status code
+func (s *Stream) sendRstStream(code uint32) {
+	// the session may be closed by now
+	defer no_panics()
+	s.session.send(rstStreamFor(s.id, code))
+}
 
-	rst_stream := controlFrame{kind: FRAME_RST_STREAM, data: data.Bytes()}
-	s.session.out <- rst_stream
+// sendWindowUpdate gives back the given consumed bytes to the flow control
+// windows of the stream and the session. The session may be closed by now,
+// with the rest of the data still to be delivered, which is fine
+func (s *Stream) sendWindowUpdate(size int) {
+	s.session.budget.release(s, size)
+	defer no_panics()
+	// the window of the session is always updated, as the bytes of the
+	// streams that end are not given back otherwise
+	s.session.send(windowUpdateFor(0, size))
+	if threshold := s.session.windowUpdateThreshold(); threshold > 0 {
+		pending := atomic.AddInt64(&s.pendingUpdate, int64(size))
+		if pending < threshold {
+			return
+		}
+		atomic.AddInt64(&s.pendingUpdate, -pending)
+		size = int(pending)
+	}
+	atomic.AddInt32(&s.recvWindow, int32(size))
+	s.session.send(windowUpdateFor(s.id, size))
 }
 
 // takes a DATA frame and adds it to the running body of the stream
@@ -615,24 +1173,86 @@ func (s *Stream) handleDataFrame(frame dataFrame) (err error) {
 
 	debug.Println("Stream server got DATA")
 
-	if len(s.upstream_buffer) >= NORTHBOUND_SLOTS {
-		msg := fmt.Sprintf("upstream buffering hit the limit of %d buffers", NORTHBOUND_SLOTS)
-		log.Println(msg)
-		err = errors.New(msg)
+	if s.upstream_buffer == nil {
+		s.logger().Error("DATA for a stream without a body")
+		return errors.New(fmt.Sprintf("Stream #%d: DATA for a stream without a body", s.id))
+	}
+	if len(frame.data) == 0 && !frame.isFIN() {
+		// nothing for the reader, and not to be queued, as it takes
+		// nothing from the receive window
+		if frame.pooled {
+			putDataBuffer(frame.data)
+		}
 		return
 	}
 
 	debug.Printf("Stream #%d adding +%d to upstream data queue. FIN? %v", s.id, len(frame.data), frame.isFIN())
-	s.upstream_buffer <- upstream_data{frame.data, frame.isFIN()}
-	debug.Printf("Stream #%d data queue size: %d", s.id, len(s.upstream_buffer))
+	s.upstream_buffer.put(upstream_data{frame.data, frame.isFIN(), frame.pooled})
 
 	return
 }
 
+func newDataQueue() *dataQueue {
+	return &dataQueue{ready: make(chan struct{}, 1)}
+}
+
+// put queues the data of a DATA frame, without blocking
+func (q *dataQueue) put(f upstream_data) {
+	q.mu.Lock()
+	q.frames = append(q.frames, f)
+	q.mu.Unlock()
+	q.poke()
+}
+
+// close ends the queue, once the frames queued are taken
+func (q *dataQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.poke()
+}
+
+// poke wakes up the reader of the queue, if waiting
+func (q *dataQueue) poke() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the next data queued, waiting for it until the queue is
+// closed, with io.EOF, or the expired channel is, if any, with
+// os.ErrDeadlineExceeded. There is a single reader
+func (q *dataQueue) take(expired <-chan struct{}) (f upstream_data, err error) {
+	for {
+		q.mu.Lock()
+		if len(q.frames) > 0 {
+			f = q.frames[0]
+			q.frames[0] = upstream_data{}
+			q.frames = q.frames[1:]
+			q.mu.Unlock()
+			return f, nil
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return f, io.EOF
+		}
+		select {
+		case <-q.ready:
+		case <-expired:
+			return f, os.ErrDeadlineExceeded
+		}
+	}
+}
+
 func (s *Stream) northboundBufferSender() {
 	defer no_panics()
-	for f := range s.upstream_buffer {
-		var err error
+	for {
+		f, err := s.upstream_buffer.take(nil)
+		if err != nil {
+			break
+		}
 		data := f.data
 		size := len(data)
 		for l := size; l > 0; l = len(data) {
@@ -644,9 +1264,9 @@ func (s *Stream) northboundBufferSender() {
 			}
 			if err != nil {
 				if !isBrokenPipe(err) {
-					log.Printf("ERROR found writing northbound stream #%d:, %#v", s.id, err)
+					s.logger().Error("cannot write the data of the stream", "err", err)
 				}
-				s.sendRstStream()
+				s.sendRstStream(RST_CANCEL)
 				s.eos <- true
 				return
 			}
@@ -656,22 +1276,224 @@ func (s *Stream) northboundBufferSender() {
 			}
 			data = data[written:]
 		}
-		// all good with this write
+		// all good with this write, the writer does not keep the data
+		if f.pooled {
+			putDataBuffer(f.data)
+		}
 		if size > 0 {
 			debug.Printf("Stream #%d: %d bytes successfully written upstream", s.id, size)
-			wupdate := windowUpdateFor(s.id, size)
-			s.session.out <- wupdate
-			s.session.out <- windowUpdateFor(0, size) // update session window
+			s.sendWindowUpdate(size)
 		}
-		if err == nil && f.final {
+		if f.final {
 			debug.Printf("Stream #%d: last upstream data done!", s.id)
+			s.finished.Store(true)
 			s.eos <- true
-			break
+			return
 		}
 	}
+	// the stream ended without the last data, do not leave the request hanging
+	select {
+	case s.eos <- true:
+	case <-time.After(500 * time.Millisecond):
+	}
 	debug.Printf("Stream #%d: northboundBufferSender done!", s.id)
 }
 
+// Hijack lets the handler of a stream take it over as a bidirectional
+// byte pipe, as needed for CONNECT tunnels. A 200 reply is sent first
+// if the handler has not sent one. The stream is finished when the
+// returned connection is closed.
+func (s *Stream) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if s.hijacked.Load() {
+		return nil, nil, errors.New(fmt.Sprintf("Stream #%d: already hijacked", s.id))
+	}
+	if s.closed.Load() {
+		return nil, nil, s.writeError("hijack of closed stream")
+	}
+	if s.request_body == nil {
+		return nil, nil, errors.New(fmt.Sprintf("Stream #%d: cannot hijack a stream without a streamed body", s.id))
+	}
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	s.hijacked.Store(true)
+	c := &streamConn{stream: s, body: s.request_body}
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	return c, rw, nil
+}
+
+// NetConn takes over the stream of a handler as a net.Conn, like Hijack
+// does but without buffering, to layer other protocols on it, like TLS,
+// SSH or database ones. Its addresses are the ones of the connection of
+// the session, and its deadlines are the ones of the stream
+func (s *Stream) NetConn() (net.Conn, error) {
+	conn, _, err := s.Hijack()
+	return conn, err
+}
+
+// Read reads the data frames of the stream as they arrive, updating
+// the flow control window of the other end as they are consumed
+func (b *streamBody) Read(p []byte) (n int, err error) {
+	if len(b.buf) == 0 {
+		if b.final {
+			return 0, io.EOF
+		}
+		expired := b.stream.readDeadline.wait()
+		select {
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		f, err := b.stream.upstream_buffer.take(expired)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.buf = f.data
+		b.final = f.final
+		if f.pooled {
+			b.pooled = f.data
+		}
+		if len(f.data) > 0 {
+			b.stream.sendWindowUpdate(len(f.data))
+		}
+		if len(b.buf) == 0 && b.final {
+			return 0, io.EOF
+		}
+	}
+	n = copy(p, b.buf)
+	b.buf = b.buf[n:]
+	if len(b.buf) == 0 && b.pooled != nil {
+		putDataBuffer(b.pooled)
+		b.pooled = nil
+	}
+	return
+}
+
+// Close does nothing, the rest of the body is discarded when the stream ends
+func (b *streamBody) Close() error { return nil }
+
+func (c *streamConn) Read(p []byte) (int, error)  { return c.body.Read(p) }
+func (c *streamConn) Write(p []byte) (int, error) { return c.stream.writeData(p) }
+
+// CloseWrite half-closes the stream, with the data of the other end still
+// to be read until it half-closes too
+func (c *streamConn) CloseWrite() error { return c.stream.CloseWrite() }
+
+// Close half-closes the stream, if not done already, and finishes it
+func (c *streamConn) Close() error {
+	s := c.stream
+	if s.closed.Load() {
+		return nil
+	}
+	s.CloseWrite()
+	s.finish_stream()
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.stream.session.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.stream.session.RemoteAddr() }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.stream.SetReadDeadline(t)
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.stream.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.stream.SetWriteDeadline(t) }
+
+// SetReadDeadline sets the deadline of the reads of the stream, of the
+// body of the request of a handler or of the read side of a tunnel, also
+// for http.ResponseController. Once it is past, the stream is reset with
+// RST_CANCEL and its reads fail with os.ErrDeadlineExceeded. A zero time
+// means no deadline
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	if s.closed.Load() {
+		return s.writeError("deadline of closed stream")
+	}
+	s.readDeadline.set(t, s.deadlineExceeded)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the writes of the stream, with
+// the same effect as SetReadDeadline once it is past
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	if s.closed.Load() {
+		return s.writeError("deadline of closed stream")
+	}
+	s.writeDeadline.set(t, s.deadlineExceeded)
+	return nil
+}
+
+// deadlineExceeded resets the stream with RST_CANCEL once one of its
+// deadlines is past, failing the reads of the reply of a client stream
+// with os.ErrDeadlineExceeded too
+func (s *Stream) deadlineExceeded() {
+	if s.closed.Load() || s.getState() == STREAM_CLOSED {
+		return
+	}
+	s.logger().Warn("resetting stream past its deadline")
+	s.setCloseErr(&StreamError{StreamID: uint32(s.id), Status: RST_CANCEL, Reason: "deadline exceeded"})
+	s.sendRstStream(RST_CANCEL)
+	if rs, ok := s.response_writer.(*responseStreamer); ok {
+		rs.body.CloseWithError(os.ErrDeadlineExceeded)
+	}
+}
+
+// set arms the deadline for t, calling expire once it is past. A zero
+// time disarms it
+func (d *streamDeadline) set(t time.Time, expire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	// a deadline past is done with, a new one starts over
+	if d.expired == nil || isClosed(d.expired) {
+		d.expired = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	expired := d.expired
+	fire := func() {
+		d.mu.Lock()
+		if !isClosed(expired) {
+			close(expired)
+		}
+		d.mu.Unlock()
+		expire()
+	}
+	if dur := time.Until(t); dur > 0 {
+		d.timer = time.AfterFunc(dur, fire)
+	} else {
+		go fire()
+	}
+}
+
+// wait returns the channel closed once the deadline is past
+func (d *streamDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
+
+// is the channel closed?
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
 // Close does nothing and is here only to allow the data of a request to become
 // the body of a response
 func (r *readCloser) Close() error { return nil }
@@ -689,6 +1511,10 @@ func (s *Stream) handleRstStream(frame controlFrame) (err error) {
 		return err
 	}
 	debug.Printf("Stream #%d cancelled with status code %d", id, status)
+	if s.trace != nil && s.trace.StreamReset != nil {
+		s.trace.StreamReset(status)
+	}
+	s.setCloseErr(&StreamError{StreamID: uint32(id), Status: status, Remote: true, Retry: status == RST_REFUSED_STREAM})
 
 	return nil
 }
@@ -698,7 +1524,7 @@ func (s *Stream) handleWindowUpdate(frame controlFrame) {
 
 	debug.Println("Stream server got WINDOW_UPDATE")
 
-	if s.closed {
+	if s.closed.Load() {
 		return
 	}
 
@@ -708,10 +1534,25 @@ func (s *Stream) handleWindowUpdate(frame controlFrame) {
 	size &= 0x7fffffff
 
 	// add the window size update from the flow control window
-	s.flow_add <- int32(size)
+	s.giveFlow(int32(size))
 	debug.Printf("Stream #%d window size +%d", s.id, int32(size))
 }
 
+// addFlow changes the flow control window by a delta from a SETTINGS frame,
+// which makes it negative if the new initial window size is small enough
+func (s *Stream) addFlow(delta int32) {
+	s.giveFlow(delta)
+}
+
+// giveFlow hands a change of the flow control window to the flow manager,
+// unless the stream is done by now
+func (s *Stream) giveFlow(delta int32) {
+	select {
+	case s.flow_add <- delta:
+	case <-s.flow_done:
+	}
+}
+
 // flowManager is a coroutine to manage the flow control window in an atomic manner
 // so that there are no race conditions and it's easier to expand later w/ SETTINGS
 func (s *Stream) flowManager(initial int32, in <-chan int32, out chan<- int32) {
@@ -719,27 +1560,48 @@ func (s *Stream) flowManager(initial int32, in <-chan int32, out chan<- int32) {
 	// no panics; it could be that we get clipped trying to send when out is closed
 	defer no_panics()
 	sfcw := initial
+	atomic.StoreInt32(&s.sendWindow, sfcw)
+	defer atomic.StoreInt32(&s.sendWindow, 0)
+	// the window is lent to a writer, which gives back what it does not use
+	lent := false
 	for {
 		if sfcw > 0 {
 			debug.Printf("Stream #%d window size %d", s.id, sfcw)
 			select {
-			case v, ok := <-in:
-				if s.closed || !ok {
+			case v := <-in:
+				if s.closed.Load() {
 					return
 				}
 				sfcw += v
+				lent = false
+				atomic.StoreInt32(&s.sendWindow, sfcw)
 			case out <- sfcw:
 				sfcw = 0
+				lent = true
+			case <-s.flow_done:
+				return
 			}
 		} else {
 			debug.Printf("Stream #%d window size %d", s.id, sfcw)
-			v, ok := <-in
-			if s.closed || !ok {
+			start := time.Now()
+			var v int32
+			select {
+			case v = <-in:
+			case <-s.flow_done:
 				return
 			}
+			if s.closed.Load() {
+				return
+			}
+			if !lent {
+				// the window was used up until a WINDOW_UPDATE
+				s.stalled(time.Since(start))
+			}
 			sfcw += v
+			lent = false
+			atomic.StoreInt32(&s.sendWindow, sfcw)
 		}
-		if s.closed {
+		if s.closed.Load() {
 			return
 		}
 	}
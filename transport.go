@@ -0,0 +1,538 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// Transport related functions
+
+package spdy
+
+import (
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrResponseHeaderTimeout is returned for requests whose reply did not
+// arrive within the ResponseHeaderTimeout of the Transport.
+var ErrResponseHeaderTimeout error = &timeoutError{"spdy: timeout awaiting response headers"}
+
+// WithClientTrace returns a new context, based on ctx, with the hooks of
+// trace to run for the requests made with it
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace of a context, if any
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// RoundTrip makes the request over a SPDY session to its host and
+// returns the response as soon as the reply arrives, with the body
+// streamed as the data frames arrive. Requests are retried on a new
+// stream as per the RetryPolicy, with their body from GetBody: by default
+// the ones over the last good stream of a GOAWAY, not processed by the
+// server, are replayed on a new session.
+// The response carries its Request, Set-Cookie and Location headers as
+// sent, so an http.Client using the Transport follows redirects (also
+// replaying bodies with GetBody) and keeps cookies in its Jar.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempts := 1; ; attempts++ {
+		res, err := t.roundTrip(req)
+		if err == nil || !t.retry(req, attempts, err) {
+			return res, err
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		debug.Printf("Retrying request for %s: %s", req.URL, err)
+	}
+}
+
+// retry decides if a failed request is to be made again
+func (t *Transport) retry(req *http.Request, attempts int, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if t.RetryPolicy != nil {
+		return t.RetryPolicy(req, attempts, err)
+	}
+	if attempts > DEFAULT_MAX_RETRIES {
+		return false
+	}
+	return errors.Is(err, ErrStreamUnprocessed) || (errors.Is(err, ErrSessionClosed) && isIdempotent(req))
+}
+
+// isIdempotent tells if a request can be made more than once
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// roundTrip makes a single attempt of a request
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		closeBody(req)
+		return nil, errors.New("spdy: nil Request.URL")
+	}
+	str, err := t.stream(req.Context(), req.URL)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	// the request is not to be modified
+	ctx, cancel := context.WithCancel(req.Context())
+	outreq := req.Clone(ctx)
+	if outreq.Proto == "" {
+		outreq.Proto = "HTTP/1.1"
+	}
+
+	rs := newResponseStreamer(req)
+	done := make(chan error, 1)
+	go func() {
+		err := str.Request(outreq, rs)
+		rs.finish(err)
+		cancel()
+		done <- err
+	}()
+
+	// the stream is reset by its session if the reply takes longer than
+	// the ResponseHeaderTimeout, failing with ErrResponseHeaderTimeout
+	select {
+	case <-rs.ready:
+		return rs.res, nil
+	case err = <-done:
+	}
+	select {
+	case <-rs.ready:
+		return rs.res, nil
+	default:
+	}
+	if err == nil {
+		err = &StreamError{StreamID: uint32(str.id), Reason: "closed without a reply"}
+	}
+	return nil, err
+}
+
+// stream starts a stream to the host of the url, on a pooled session
+// with room for it, or on a new session
+func (t *Transport) stream(ctx context.Context, u *url.URL) (*Stream, error) {
+	key := u.Scheme + "://" + canonicalAddr(u)
+	for {
+		t.mu.Lock()
+		if ss := t.reserveSession(key); ss != nil {
+			t.mu.Unlock()
+			if str := t.pooledStream(ctx, ss); str != nil {
+				return str, nil
+			}
+			// the session is closed or out of stream IDs by now, and
+			// not reserved again
+			continue
+		}
+		call, ok := t.dialing[key]
+		if !ok {
+			break
+		}
+		t.mu.Unlock()
+		// another request is dialing the host, for its session to be
+		// shared, unless the dial fails
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil && !errors.Is(call.err, context.Canceled) && !errors.Is(call.err, context.DeadlineExceeded) {
+			return nil, call.err
+		}
+	}
+
+	// the host is dialed without the lock, not to hold up the requests to
+	// the other hosts
+	call := &dialCall{done: make(chan bool)}
+	if t.dialing == nil {
+		t.dialing = make(map[string]*dialCall)
+	}
+	t.dialing[key] = call
+	t.mu.Unlock()
+	ss, err := t.dial(ctx, u)
+	t.mu.Lock()
+	delete(t.dialing, key)
+	if err == nil {
+		if t.sessions == nil {
+			t.sessions = make(map[string][]*Session)
+		}
+		t.sessions[key] = append(t.sessions[key], ss)
+		atomic.StoreInt64(&ss.idleSince, time.Now().UnixNano())
+		// served before other requests find it in the pool
+		go func() {
+			ss.Serve()
+			t.removeSession(ss)
+		}()
+		if t.MaxIdleTime > 0 {
+			go t.keepAlive(ss)
+		}
+	}
+	t.mu.Unlock()
+	call.err = err
+	close(call.done)
+	if err != nil {
+		return nil, err
+	}
+
+	str := ss.newClientStream(ContextClientTrace(ctx), false)
+	if str == nil {
+		return nil, errors.New(fmt.Sprintf("spdy: cannot create a stream to %s", u.Host))
+	}
+	if trace := ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(GotConnInfo{Session: ss})
+	}
+	return str, nil
+}
+
+// reserveSession reserves a stream on a pooled session to the host of the
+// key with room for it, if any. It is to be called with the lock held
+func (t *Transport) reserveSession(key string) *Session {
+	for _, ss := range t.sessions[key] {
+		if ss.closed.Load() || ss.goaway_recvd.Load() || !ss.hasStreamIDs() || !ss.canOpenStream() {
+			continue
+		}
+		atomic.AddInt32(&ss.reservedStreams, 1)
+		return ss
+	}
+	return nil
+}
+
+// pooledStream starts the stream reserved on a pooled session, without the
+// lock held, as the session may take a while to register it
+func (t *Transport) pooledStream(ctx context.Context, ss *Session) *Stream {
+	defer atomic.AddInt32(&ss.reservedStreams, -1)
+	str := ss.newClientStream(ContextClientTrace(ctx), false)
+	if str == nil {
+		return nil
+	}
+	atomic.StoreInt64(&ss.idleSince, time.Now().UnixNano())
+	if trace := ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(GotConnInfo{Session: ss, Reused: true})
+	}
+	return str
+}
+
+// dial makes a new session to the host of the url
+func (t *Transport) dial(ctx context.Context, u *url.URL) (*Session, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("spdy: unsupported protocol scheme %q", u.Scheme))
+	}
+	addr := canonicalAddr(u)
+	dial := t.DialContext
+	if dial == nil {
+		dial = t.dialer().DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	err = t.SocketOptions.apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn, err = t.handshakeTLS(ctx, conn, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ss := NewClientSession(conn)
+	ss.initialWindowSize = t.InitialWindowSize
+	if t.MaxFrameBytes > 0 {
+		ss.SetMaxFrameBytes(t.MaxFrameBytes)
+	}
+	ss.slogger = t.Logger
+	ss.pingInterval = t.PingInterval
+	ss.SetReplyTimeout(t.ResponseHeaderTimeout)
+	ss.rate = newRateLimiter(t.SessionRateLimit)
+	ss.streamRate = t.StreamRateLimit
+	if level := compressionLevel(t.HeaderCompressionLevel, t.NoHeaderCompression); level != zlib.BestCompression {
+		ss.setHeaderCompression(level)
+	}
+	if t.HeaderDictionary != nil {
+		ss.SetHeaderDictionary(t.HeaderDictionary)
+	}
+	if t.FrameCapture != nil {
+		ss.SetFrameCapture(t.FrameCapture(ss))
+	}
+	if t.Events != nil {
+		ss.SetEvents(t.Events(ss))
+	}
+	store := t.SettingsStore
+	if store == nil {
+		t.settingsOnce.Do(func() {
+			t.settings = &memorySettingsStore{values: make(map[string][]SettingsValue)}
+		})
+		store = t.settings
+	}
+	ss.SetSettingsStore(store, u.Scheme+"://"+addr)
+	return ss, nil
+}
+
+// Load returns the values persisted for the origin
+func (m *memorySettingsStore) Load(origin string) []SettingsValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[origin]
+}
+
+// Store persists the values for the origin
+func (m *memorySettingsStore) Store(origin string, values []SettingsValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(values) == 0 {
+		delete(m.values, origin)
+		return
+	}
+	m.values[origin] = values
+}
+
+// dialer returns the dialer for the connections of the sessions when
+// there is no DialContext. For hosts with IPv6 and IPv4 addresses, it
+// tries an IPv6 address first, starting to try the IPv4 ones in parallel
+// if there is no connection after the fallback delay, and uses the first
+// connection made
+func (t *Transport) dialer() *net.Dialer {
+	delay := t.FallbackDelay
+	if delay == 0 {
+		delay = DEFAULT_FALLBACK_DELAY
+	}
+	return &net.Dialer{FallbackDelay: delay}
+}
+
+// tlsConfig returns the TLS configuration for the host of the url
+func (t *Transport) tlsConfig(u *url.URL) *tls.Config {
+	if config, ok := t.HostTLSClientConfigs[canonicalAddr(u)]; ok {
+		return config
+	}
+	if config, ok := t.HostTLSClientConfigs[u.Hostname()]; ok {
+		return config
+	}
+	return t.TLSClientConfig
+}
+
+// handshakeTLS runs TLS over the connection to the host of the url,
+// making sure SPDY is negotiated, unless known to be spoken already
+func (t *Transport) handshakeTLS(ctx context.Context, conn net.Conn, u *url.URL) (net.Conn, error) {
+	host := u.Hostname()
+	config := &tls.Config{}
+	if c := t.tlsConfig(u); c != nil {
+		config = c.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if !t.PriorKnowledge {
+		config.NextProtos = []string{"spdy/3.1", "spdy/3"}
+	}
+	tc := tls.Client(conn, config)
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if t.PriorKnowledge {
+		return tc, nil
+	}
+	proto := tc.ConnectionState().NegotiatedProtocol
+	if !strings.HasPrefix(proto, "spdy/3") {
+		tc.Close()
+		return nil, errors.New(fmt.Sprintf("spdy: %s did not negotiate SPDY, got %q", host, proto))
+	}
+	return tc, nil
+}
+
+// keepAlive pings a pooled session while it has no streams, and closes
+// it once it has been idle for longer than MaxIdleTime, or if the other
+// end does not reply to the ping
+func (t *Transport) keepAlive(ss *Session) {
+	ticker := time.NewTicker(t.MaxIdleTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if ss.NumActiveStreams() > 0 {
+			continue
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&ss.idleSince)))
+		if idle < t.MaxIdleTime && ss.Ping(IDLE_PING_TIMEOUT) {
+			continue
+		}
+		if t.closeIdleSession(ss) {
+			debug.Printf("Closed a session idle for %s", idle)
+			return
+		}
+	}
+}
+
+// CloseIdleConnections closes the pooled sessions that have no streams.
+// It is called by the CloseIdleConnections of an http.Client.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	var list []*Session
+	for _, sessions := range t.sessions {
+		list = append(list, sessions...)
+	}
+	t.mu.Unlock()
+	for _, ss := range list {
+		t.closeIdleSession(ss)
+	}
+}
+
+// closeIdleSession closes a session and takes it out of the pool, unless
+// it got streams in the meantime, or is about to
+func (t *Transport) closeIdleSession(ss *Session) bool {
+	t.mu.Lock()
+	if ss.NumActiveStreams() > 0 || atomic.LoadInt32(&ss.reservedStreams) > 0 {
+		t.mu.Unlock()
+		return false
+	}
+	t.forgetSession(ss)
+	t.mu.Unlock()
+	ss.goAway(GOAWAY_OK)
+	ss.Close()
+	return true
+}
+
+// removeSession forgets about a session, once it is done
+func (t *Transport) removeSession(ss *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forgetSession(ss)
+}
+
+// forgetSession takes a session out of the pool, with the lock held
+func (t *Transport) forgetSession(ss *Session) {
+	for key, list := range t.sessions {
+		for i, s := range list {
+			if s == ss {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(t.sessions, key)
+		} else {
+			t.sessions[key] = list
+		}
+	}
+}
+
+// canonicalAddr returns the host:port of the url, with the default
+// port of the scheme if it has none
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// closeBody closes the body of a request that is not going to be sent
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func newResponseStreamer(req *http.Request) *responseStreamer {
+	pr, pw := io.Pipe()
+	return &responseStreamer{
+		header: make(http.Header),
+		res: &http.Response{
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Body:       pr,
+			Request:    req,
+		},
+		body:  pw,
+		ready: make(chan bool),
+	}
+}
+
+// Header returns the headers of the reply, as they are received
+func (rs *responseStreamer) Header() http.Header {
+	return rs.header
+}
+
+// WriteHeader makes the response ready, with the headers received so far
+func (rs *responseStreamer) WriteHeader(code int) {
+	if rs.wroteHeader {
+		return
+	}
+	rs.wroteHeader = true
+	rs.res.StatusCode = code
+	rs.res.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+	rs.res.Header = rs.header.Clone()
+	rs.res.ContentLength = -1
+	if cl := rs.header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			rs.res.ContentLength = n
+		}
+	}
+	// filled in at the end of the body
+	rs.res.Trailer = make(http.Header)
+	close(rs.ready)
+}
+
+// Write hands the data over to the reader of the body of the response
+func (rs *responseStreamer) Write(p []byte) (int, error) {
+	if !rs.wroteHeader {
+		rs.WriteHeader(http.StatusOK)
+	}
+	return rs.body.Write(p)
+}
+
+// finish ends the body of the response, after setting its trailers
+func (rs *responseStreamer) finish(err error) {
+	if !rs.wroteHeader {
+		rs.body.CloseWithError(err)
+		return
+	}
+	for name, values := range rs.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			rs.res.Trailer[name[len(http.TrailerPrefix):]] = values
+		}
+	}
+	rs.body.CloseWithError(err)
+}
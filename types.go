@@ -7,78 +7,441 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
+	logging "log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type streamID uint32
 
-// Kinds of control frames
-type controlFrameKind uint16
+// ControlFrameKind is the type of a control frame, one of the FRAME_*
+// constants
+type ControlFrameKind uint16
 
 const (
 	FRAME_SYN_STREAM    = 0x0001
 	FRAME_SYN_REPLY     = 0x0002
 	FRAME_RST_STREAM    = 0x0003
 	FRAME_SETTINGS      = 0x0004
+	FRAME_NOOP          = 0x0005 // SPDY/2 only, ignored
 	FRAME_PING          = 0x0006
 	FRAME_GOAWAY        = 0x0007
 	FRAME_HEADERS       = 0x0008
 	FRAME_WINDOW_UPDATE = 0x0009
 )
 
-// Frame flags
-type frameFlags uint8
+// IDs of SETTINGS values
+const (
+	SETTINGS_UPLOAD_BANDWIDTH               = 1
+	SETTINGS_DOWNLOAD_BANDWIDTH             = 2
+	SETTINGS_ROUND_TRIP_TIME                = 3
+	SETTINGS_MAX_CONCURRENT_STREAMS         = 4
+	SETTINGS_CURRENT_CWND                   = 5
+	SETTINGS_DOWNLOAD_RETRANS_RATE          = 6
+	SETTINGS_INITIAL_WINDOW_SIZE            = 7
+	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE = 8
+)
+
+// Flags of SETTINGS values
+const (
+	FLAG_SETTINGS_PERSIST_VALUE = 0x1 // for the client to persist
+	FLAG_SETTINGS_PERSISTED     = 0x2 // as persisted by the client
+)
+
+// FrameFlags are the flags of a frame, the FLAG_* constants
+type FrameFlags uint8
+
+const (
+	FLAG_NONE           = FrameFlags(0x00)
+	FLAG_FIN            = FrameFlags(0x01)
+	FLAG_UNIDIRECTIONAL = FrameFlags(0x02)
+	// of SETTINGS frames, for the client to clear the values it persisted
+	FLAG_SETTINGS_CLEAR_SETTINGS = FrameFlags(0x01)
+)
+
+// Status codes for RST_STREAM frames
+const (
+	RST_PROTOCOL_ERROR        = 1
+	RST_INVALID_STREAM        = 2
+	RST_REFUSED_STREAM        = 3
+	RST_UNSUPPORTED_VERSION   = 4
+	RST_CANCEL                = 5
+	RST_INTERNAL_ERROR        = 6
+	RST_FLOW_CONTROL_ERROR    = 7
+	RST_STREAM_IN_USE         = 8
+	RST_STREAM_ALREADY_CLOSED = 9
+	RST_FRAME_TOO_LARGE       = 11
+)
 
+// Status codes for GOAWAY frames
 const (
-	FLAG_NONE = frameFlags(0x00)
-	FLAG_FIN  = frameFlags(0x01)
+	GOAWAY_OK             = 0
+	GOAWAY_PROTOCOL_ERROR = 1
+	GOAWAY_INTERNAL_ERROR = 2
 )
 
 type dataFrame struct {
 	stream streamID
-	flags  frameFlags
+	flags  FrameFlags
 	data   []byte
+	pooled bool // the data is a buffer of the pool, to be given back
 }
 
 type controlFrame struct {
-	kind  controlFrameKind
-	flags frameFlags
+	kind  ControlFrameKind
+	flags FrameFlags
 	data  []byte
+	// the header block of a SYN_STREAM, SYN_REPLY or HEADERS frame,
+	// decoded by the session, as the blocks share a compression context
+	// and must be decoded in the order received, not by their streams
+	headers   http.Header
+	headerErr error
+}
+
+// largeHeaderFrame is a SYN_STREAM, SYN_REPLY or HEADERS frame over the
+// frame size limit, with its payload left unread on the connection. The
+// session reads its header block from r, in order with the other blocks,
+// to keep the compression context in sync, and resets its stream alone.
+// The receiver of the session waits on done for the connection
+type largeHeaderFrame struct {
+	controlFrame
+	length int
+	r      io.Reader
+	done   chan bool
 }
 
 type frame interface {
 	Write(io.Writer) (n int64, err error)
-	Flags() frameFlags
+	Flags() FrameFlags
 	String() string
 	Data() []byte
 }
 
+// Frame is a SPDY frame as read and written by a Framer. Marshal returns
+// the frame in wire format and Parse reads it back from the wire format.
+// Header blocks are kept compressed in the HeaderBlock of the frames that
+// have one, and the Framer takes care of (de)compressing the Header.
+type Frame interface {
+	String() string
+	Marshal() ([]byte, error)
+	Parse(data []byte) error
+	wire(f *Framer) (frame, error)
+}
+
+// DataFrame is a DATA frame
+type DataFrame struct {
+	StreamID uint32
+	Flags    FrameFlags
+	Data     []byte
+}
+
+// SynStreamFrame is a SYN_STREAM frame
+type SynStreamFrame struct {
+	StreamID           uint32
+	AssociatedStreamID uint32
+	Priority           uint8
+	Slot               uint8
+	Flags              FrameFlags
+	Header             http.Header
+	HeaderBlock        []byte
+}
+
+// SynReplyFrame is a SYN_REPLY frame
+type SynReplyFrame struct {
+	StreamID    uint32
+	Flags       FrameFlags
+	Header      http.Header
+	HeaderBlock []byte
+}
+
+// RstStreamFrame is a RST_STREAM frame, with one of the RST_* status codes
+type RstStreamFrame struct {
+	StreamID uint32
+	Status   uint32
+}
+
+// SettingsFrame is a SETTINGS frame
+type SettingsFrame struct {
+	Flags  FrameFlags
+	Values []SettingsValue
+}
+
+// SettingsValue is an ID/value pair of a SETTINGS frame
+type SettingsValue struct {
+	Flags uint8
+	ID    uint32 // 24 bits
+	Value uint32
+}
+
+// PingFrame is a PING frame
+type PingFrame struct {
+	ID uint32
+}
+
+// GoAwayFrame is a GOAWAY frame, with one of the GOAWAY_* status codes
+type GoAwayFrame struct {
+	LastGoodStreamID uint32
+	Status           uint32
+}
+
+// HeadersFrame is a HEADERS frame
+type HeadersFrame struct {
+	StreamID    uint32
+	Flags       FrameFlags
+	Header      http.Header
+	HeaderBlock []byte
+}
+
+// WindowUpdateFrame is a WINDOW_UPDATE frame
+type WindowUpdateFrame struct {
+	StreamID        uint32
+	DeltaWindowSize uint32
+}
+
+// ControlFrame is any other control frame, with its raw payload
+type ControlFrame struct {
+	Kind  ControlFrameKind
+	Flags FrameFlags
+	Data  []byte
+}
+
+// Framer reads and writes SPDY frames on a connection, keeping the
+// header compression contexts for each direction
+type Framer struct {
+	rw            io.ReadWriter
+	headerWriter  *headerWriter
+	headerReader  *headerReader
+	maxFrameBytes int
+}
+
 type Session struct {
-	conn         net.Conn     // the underlying connection
-	out          chan frame   // channel to send a frame
-	in           chan frame   // channel to receive a frame
-	new_stream   chan *Stream // channel to register new streams
-	end_stream   chan *Stream // channel to unregister streams
+	conn         net.Conn            // the underlying connection
+	out          chan frame          // channel to send a frame
+	in           chan frame          // channel to receive a frame
+	new_stream   chan *Stream        // channel to register new streams
+	end_stream   chan *Stream        // channel to unregister streams
+	list_streams chan chan []*Stream // channel to get the streams
 	streams      map[streamID]*Stream
+	// the streams by ID too, for the frame sender to count the frames
+	counted      sync.Map
 	server       *http.Server // http server for this session
+	tag          interface{}  // of the application, as per the SessionConfig
 	nextStream   streamID     // the next stream ID
-	closed       bool         // is this session closed?
-	goaway_recvd bool         // recieved goaway
+	closed       atomic.Bool  // is this session closed?
+	goaway_recvd atomic.Bool  // recieved goaway
 	headerWriter *headerWriter
 	headerReader *headerReader
-	settings     *settings
+	settings     *SettingsFrame
 	nextPing     uint32 // the next ping ID
 	// channel to send our self-initiated pings
 	// Ping() listens for an outstanding ping
 	pinger chan uint32
+	// closed when the frame sender is done
+	sender_exit chan bool
+	// closed by Close, for the writers of frames to stop
+	done chan bool
+	// largest frame payload accepted from the other end
+	maxFrameBytes int
+	// the last stream ID initiated by the other end, for GOAWAY
+	lastGoodStream streamID
+	// the last stream ID of a SYN_STREAM of the other end, refused or not
+	lastPeerStream streamID
+	// go away on NOOP and unknown control frames, rather than ignoring them
+	strictFrames bool
+	writeTimeout time.Duration   // to write each frame
+	replyTimeout time.Duration   // for client streams to get their SYN_REPLY, if set
+	idleTimeout  time.Duration   // to go away without streams, if set
+	errorLog     *logging.Logger // for errors of this session, if set
+	slogger      *slog.Logger    // for the messages of this session, if set
+	capture      *frameCapture   // of the frames of this session, if set
+	events       *SessionEvents  // callbacks of the application, if set
+	// number of streams in the streams map, for other goroutines, and of
+	// the ones opened by the other end among them
+	activeStreams int32
+	peerStreams   int32
+	// atomic, number of streams a Transport is about to start on the
+	// session, counted against the limit of the other end
+	reservedStreams int32
+	// the streams of this end given an ID and not done with their
+	// SYN_STREAM yet, which go out in the order of their IDs, and the
+	// channel closed once one of them is done
+	synMu      sync.Mutex
+	synPending map[streamID]bool
+	synTurn    chan struct{}
+	// set once this end sent a GOAWAY
+	going_away int32
+	// the *SessionError of the first GOAWAY sent or received
+	goaway atomic.Value
+	// called on changes of state of the session, if set
+	connState func(*Session, SessionState)
+	// streams from the other end are refused above this, if set
+	maxConcurrentStreams uint32
+	// receive window advertised to the other end, if set
+	initialWindowSize uint32
+	// atomic, streams limit advertised by the other end, 0 if none
+	peerMaxConcurrentStreams uint32
+	// atomic, initial send window of the streams advertised by the other
+	// end, 0 if none
+	peerInitialWindowSize uint32
+	// the DATA received and not consumed yet, with its limit, if any
+	budget bufferBudget
+	// small writes of handlers are held for this long, if set, or until
+	// there are writeBufferSize bytes, to be sent together
+	writeDelay      time.Duration
+	writeBufferSize int
+	// the limits of the DATA sent by the session, and by each stream,
+	// if any
+	rate       *rateLimiter
+	streamRate int64
+	// called with the streams of OpenStream on server sessions, if set
+	onStream func(conn net.Conn, header http.Header)
+	// push the resources in the Link: rel=preload headers of the replies
+	pushPreloads bool
+	// limits of the pushed streams open at once, and of the pushes along
+	// with each request
+	maxConcurrentPushes int32
+	maxPushesPerRequest int32
+	// atomic, number of pushed streams open
+	activePushes int32
+	// the resources pushed, not to push them again
+	pushCache PushCache
+	// where the SETTINGS of the server to persist are kept, for its
+	// origin, and the ones of it as of the session loop
+	settingsStore SettingsStore
+	origin        string
+	persisted     []SettingsValue
+	// cancelled when the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// atomic, time in unix nanoseconds since the session has had no
+	// streams, or when it was last given a stream by a Transport
+	idleSince int64
+	// atomic, the last SessionState
+	state int32
+	// atomic, counters for Stats
+	totalStreams  int64
+	bytesSent     int64
+	bytesReceived int64
+	lastPingRTT   int64
+	// atomic, the moving average of the PING round trip times, and when
+	// the last frame was received, in unix nanoseconds
+	rtt          int64
+	lastReceived int64
+	// the session is pinged when nothing is received for this long,
+	// if set, and closed if there is no reply within it
+	pingInterval time.Duration
+}
+
+// StreamStats is a snapshot of the counters of a Stream, as returned by
+// its Stats method. The bytes are of whole frames, headers included
+type StreamStats struct {
+	BytesSent      int64
+	BytesReceived  int64
+	FramesSent     int64
+	FramesReceived int64
+	State          StreamState
+}
+
+// StreamInfo describes a stream of a Session, as returned by its Streams
+// method
+type StreamInfo struct {
+	ID       uint32
+	Priority uint8 // 0 is the highest
+	StreamStats
+}
+
+// the key of the Stream in the context of the request of a server stream
+type streamKey struct{}
+
+// SessionStats is a snapshot of the counters of a Session, as returned
+// by its Stats method
+type SessionStats struct {
+	// streams open now, and since the session started
+	ActiveStreams int
+	TotalStreams  int64
+	// bytes of the frames sent and received, headers included
+	BytesSent     int64
+	BytesReceived int64
+	// the windows the streams start with, to send, as per the SETTINGS of
+	// the other end, and to receive, as advertised to the other end. There
+	// is no flow control of the session as a whole
+	SendWindow    int32
+	ReceiveWindow int32
+	// round trip time of the last PING answered, and its exponentially
+	// weighted moving average, zero if none
+	LastPingRTT time.Duration
+	RTT         time.Duration
+	// the protocol negotiated with ALPN over TLS, "spdy/3" otherwise
+	Version string
+	// bytes of the header blocks sent, before and after compression, and
+	// the ratio of the latter over the former, 0 if none were sent
+	HeaderBytes            int64
+	CompressedHeaderBytes  int64
+	HeaderCompressionRatio float64
+}
+
+// a token bucket limiting the bytes per second of DATA sent. It holds up
+// to a frame worth of bytes, so that the rate is kept from the start
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // negative while frames wait for their turn
+	last   time.Time
 }
 
+// the bytes buffered by a session: the DATA received and not consumed yet
+// by the handlers or readers of its streams and the header blocks received,
+// by stream, and the frames queued to be sent
+type bufferBudget struct {
+	mu      sync.Mutex
+	max     int64 // no accounting if zero
+	total   int64
+	streams map[*Stream]int64
+	sending int64         // of the frames queued
+	room    chan struct{} // closed once frames queued are sent, if waited on
+}
+
+// the sessions being served, with the time they started, for DebugHandler
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*Session]time.Time
+}
+
+// SessionState is the state of a server Session, as reported
+// to the ConnState hook of a Server
+type SessionState int
+
+const (
+	SESSION_NEW    SessionState = iota // created, not serving yet
+	SESSION_ACTIVE                     // with active streams
+	SESSION_IDLE                       // without active streams
+	SESSION_CLOSED                     // closed, done serving
+)
+
+// StreamState is the state of a Stream, as per the frames sent and
+// received for it
+type StreamState int32
+
+const (
+	STREAM_IDLE               StreamState = iota // a client stream before its SYN_STREAM is sent
+	STREAM_OPEN                                  // both ends may send
+	STREAM_HALF_CLOSED_LOCAL                     // this end sent its FIN
+	STREAM_HALF_CLOSED_REMOTE                    // the other end sent its FIN
+	STREAM_CLOSED                                // both FINs sent, or reset
+)
+
 type settings struct {
-	flags frameFlags
+	flags FrameFlags
 	count uint32
 	svp   []settingsValuePairs
 }
@@ -96,8 +459,13 @@ type Stream struct {
 	associated_stream streamID
 	headers           http.Header
 	response_writer   http.ResponseWriter
-	closed            bool
+	closed            atomic.Bool // the stream loop is done
 	wroteHeader       bool
+	wroteFIN          atomic.Bool // this end half-closed the stream
+	hijacked          atomic.Bool // set by the handler, read by the stream loop
+	finished          atomic.Bool // a client stream got its reply in full
+	errMu             sync.Mutex  // for closeErr
+	closeErr          error       // why the stream was closed early, if known
 	// IMPORTANT, these channels must not block (for long)
 	control         chan controlFrame // control frames arrive here
 	data            chan dataFrame    // data frames arrive here
@@ -106,12 +474,171 @@ type Stream struct {
 	stop_server     chan bool         // when stream is closed, to stop the server
 	flow_req        chan int32        // control flow requests
 	flow_add        chan int32        // control flow additions
-	upstream_buffer chan upstream_data
+	flow_done       chan struct{}     // closed once the stream is done, for the flow
+	upstream_buffer *dataQueue        // the DATA received, for the reader of the stream
+	request_body    *streamBody       // the streamed body of a server stream, if any
+	// small writes held to be sent together, as per the write delay
+	// of the session
+	wmu     sync.Mutex
+	wbuf    []byte
+	wtimer  *time.Timer
+	werr    error        // of the last flush of wbuf by wtimer, if it failed
+	rate    *rateLimiter // the limit of the DATA sent, if any
+	started time.Time
+	trace   *ClientTrace // the hooks of the request, if any
+	// atomic, the send window as of the flow manager, and the receive
+	// window as of the DATA received and the WINDOW_UPDATEs sent
+	sendWindow int32
+	recvWindow int32
+	// atomic, counters for Stats
+	bytesSent      int64
+	bytesReceived  int64
+	framesSent     int64
+	framesReceived int64
+	// atomic, bytes consumed not given back yet with a WINDOW_UPDATE
+	pendingUpdate int64
+	// atomic, a StreamState, moved along by the frames sent and received
+	state int32
+	// a SYN_REPLY was received, used by the session loop only
+	replied bool
+	// the context of the request of a server stream, cancelled when
+	// the stream ends or the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// as set with SetReadDeadline and SetWriteDeadline
+	readDeadline  streamDeadline
+	writeDeadline streamDeadline
+	// the request of a server stream, for the ones pushed along with it
+	request *http.Request
+	// atomic, number of streams pushed along with the request
+	pushes int32
+	// the header blocks of the request and of the reply, as sent or
+	// received, pseudo-headers included
+	requestHeader http.Header
+	replyHeader   http.Header
+}
+
+// PushCache keeps track of the resources pushed on sessions, so each is
+// pushed only once per session, as the client has it already after that.
+// It is called from the handlers of the session, concurrently
+type PushCache interface {
+	// Pushed records the URL as pushed on the session, and reports if it
+	// had been pushed on it already
+	Pushed(s *Session, url string) bool
+	// Forget is called once the session is closed
+	Forget(s *Session)
+}
+
+// sessionPushCache is the PushCache of a single session
+type sessionPushCache struct {
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+// SettingsStore keeps the SETTINGS values servers ask their clients to
+// persist, by origin, for the sessions to the same origin to start with
+// them. It is called from the sessions, concurrently
+type SettingsStore interface {
+	// Load returns the values persisted for the origin, if any
+	Load(origin string) []SettingsValue
+	// Store persists the values for the origin, replacing the ones it had,
+	// or clears them if there are none
+	Store(origin string, values []SettingsValue)
+}
+
+// memorySettingsStore is the SettingsStore of a Transport without one
+type memorySettingsStore struct {
+	mu     sync.Mutex
+	values map[string][]SettingsValue
+}
+
+// a session being dialed by a Transport, for the requests to the same
+// host to wait for it rather than dial their own
+type dialCall struct {
+	done chan bool // closed once the dial is done
+	err  error
+}
+
+// SessionInterface is the API of a Session, for applications to mock the
+// sessions they use in their own tests. *Session implements it. Streams
+// for requests are made with NewRequestStream
+type SessionInterface interface {
+	Serve() error
+	NewRequestStream() StreamInterface
+	Close()
+	CloseWithError(status uint32) error
+	Context() context.Context
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	TLSConnectionState() *tls.ConnectionState
+	Tag() interface{}
+	SetMaxFrameBytes(n int)
+	NumActiveStreams() int
+	Streams() []StreamInfo
+	Ping(d time.Duration) bool
+	Stats() SessionStats
+	Connect(ctx context.Context, authority string) (net.Conn, error)
+	OpenStream(ctx context.Context, header http.Header) (net.Conn, error)
+	NewStreamProxy(r *http.Request, w http.ResponseWriter) error
+	SetLogger(l *slog.Logger)
+	SetEvents(e *SessionEvents)
+	SetSettingsStore(store SettingsStore, origin string)
+	SetFrameCapture(c *FrameCapture)
+	SetHeaderDictionary(dict []byte)
+}
+
+// StreamInterface is the API of a Stream, both as the ResponseWriter of
+// a handler and for making requests, for applications to mock the streams
+// they use in their own tests. *Stream implements it
+type StreamInterface interface {
+	http.ResponseWriter
+	http.Flusher
+	http.Hijacker
+	http.Pusher
+	io.ReaderFrom
+	CloseWrite() error
+	WriteFrom(r io.Reader) (int64, error)
+	NetConn() (net.Conn, error)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Request(request *http.Request, writer http.ResponseWriter) error
+	ID() uint32
+	Priority() uint8
+	Context() context.Context
+	Stats() StreamStats
+	RequestHeader() http.Header
+	ReplyHeader() http.Header
+	String() string
+}
+
+var (
+	_ SessionInterface = (*Session)(nil)
+	_ StreamInterface  = (*Stream)(nil)
+)
+
+// streamDeadline is a deadline of the reads or the writes of a stream.
+// Its channel is closed once the deadline is past
+type streamDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
 }
 
 type upstream_data struct {
-	data  []byte
-	final bool
+	data   []byte
+	final  bool
+	pooled bool // the data is a buffer of the pool, to be given back
+}
+
+// dataQueue holds the DATA received for a stream until its reader takes
+// it. It is bounded in bytes by the receive window of the stream, as the
+// other end cannot send more before the data is consumed and given back
+// with a WINDOW_UPDATE, in frames as small as it likes
+type dataQueue struct {
+	mu     sync.Mutex
+	frames []upstream_data
+	closed bool
+	ready  chan struct{} // poked once there are frames, or it is closed
 }
 
 type frameSynStream struct {
@@ -120,19 +647,90 @@ type frameSynStream struct {
 	priority          uint8
 	associated_stream streamID
 	header            http.Header
-	flags             frameFlags
+	flags             FrameFlags
 }
 
 type frameSynReply struct {
 	session *Session
 	stream  streamID
 	headers http.Header
-	flags   frameFlags
+	flags   FrameFlags
+}
+
+type frameHeaders struct {
+	session *Session
+	stream  streamID
+	headers http.Header
+	flags   FrameFlags
+}
+
+// a marker in the outgoing frames of a session, not sent over the
+// wire, that is done once all the frames before it have been written
+type flushMarker struct {
+	done chan bool
 }
 
 // maximum number of bytes in a frame
 const MAX_DATA_PAYLOAD = 1<<24 - 1
 
+// default maximum number of bytes in the payload of a frame read, well
+// over the DATA frames and header blocks of browsers and servers, which
+// may declare up to MAX_DATA_PAYLOAD
+const DEFAULT_MAX_FRAME_BYTES = 1 << 20
+
+// default maximum number of concurrent streams on server sessions
+const DEFAULT_MAX_CONCURRENT_STREAMS = 100
+
+// default maximum number of pushed streams open at once on server sessions
+const DEFAULT_MAX_CONCURRENT_PUSHES = 10
+
+// default maximum number of streams pushed along with a request
+const DEFAULT_MAX_PUSHES_PER_REQUEST = 20
+
+// default time to write a frame to the network
+const DEFAULT_WRITE_TIMEOUT = 5 * time.Second
+
+// the most frames queued in a session that are written at once
+const MAX_WRITE_BATCH = 32
+
+// DATA payloads up to this many bytes are copied next to their frame
+// head when writing a batch of frames, the larger ones are not
+const COALESCE_DATA_BYTES = 1024
+
+// default maximum number of bytes in a decompressed header block
+const DEFAULT_MAX_HEADER_BYTES = 1 << 20
+
+// default maximum number of bytes of a WebSocket message read
+const DEFAULT_MAX_WEBSOCKET_MESSAGE = 1 << 24
+
+// Kinds of WebSocket frames, as per RFC 6455
+const (
+	WS_CONTINUATION = 0
+	WS_TEXT         = 1
+	WS_BINARY       = 2
+	WS_CLOSE        = 8
+	WS_PING         = 9
+	WS_PONG         = 10
+)
+
+// default number of retries of a request by a Transport
+const DEFAULT_MAX_RETRIES = 2
+
+// default delay to race an IPv4 connection with an IPv6 one, the
+// connection attempt delay recommended by RFC 8305
+const DEFAULT_FALLBACK_DELAY = 250 * time.Millisecond
+
+// time to wait for the reply to the pings of idle Transport sessions
+const IDLE_PING_TIMEOUT = 5 * time.Second
+
+// below this smoothed round trip time, the WINDOW_UPDATE frames of each
+// stream are sent for a quarter of the window at a time, rather than for
+// every read, as waiting for them costs little
+const BATCH_WINDOW_UPDATE_RTT = 10 * time.Millisecond
+
+// the largest stream ID, after which a session cannot start streams
+const MAX_STREAM_ID = 0x7fffffff
+
 const (
 	HEADER_STATUS         string = ":status"
 	HEADER_VERSION        string = ":version"
@@ -143,10 +741,30 @@ const (
 	HEADER_CONTENT_LENGTH string = "Content-Length"
 )
 
+// the :method of the streams opened with Session.OpenStream, which are
+// not HTTP requests
+const STREAM_METHOD = "STREAM"
+
 type readCloser struct {
 	io.Reader
 }
 
+// the body of a request, read from the data frames of the stream
+// as they arrive
+type streamBody struct {
+	stream *Stream
+	buf    []byte
+	final  bool
+	pooled []byte // the buffer of the pool holding buf, if any
+}
+
+// a hijacked server stream or a client CONNECT stream, used as a
+// bidirectional byte pipe
+type streamConn struct {
+	stream *Stream
+	body   io.Reader // the data from the other end
+}
+
 // ResponseRecorder is an implementation of http.ResponseWriter that
 // is used to get a response.
 type ResponseRecorder struct {
@@ -156,23 +774,447 @@ type ResponseRecorder struct {
 	wroteHeader bool
 }
 
-//spdy client
+// spdy client
 type Client struct {
 	cn net.Conn
 	ss *Session
 }
 
-//spdy server
+// ClientConfig holds the settings of the session of a Client, as given
+// to NewClientConnConfig. Zero values keep the defaults.
+type ClientConfig struct {
+	// maximum payload size of a frame received, in bytes.
+	// If zero, DEFAULT_MAX_FRAME_BYTES is used
+	MaxFrameBytes int
+	// maximum time to wait for the reply of a request, after which it
+	// fails with ErrResponseHeaderTimeout and its stream is reset, as with
+	// the ResponseHeaderTimeout of a Transport. If zero, there is no limit
+	ResponseHeaderTimeout time.Duration
+}
+
+// Transport is an http.RoundTripper making requests over SPDY sessions,
+// to be used as the Transport of an http.Client. Requests for "http"
+// URLs use plaintext SPDY, and the ones for "https" URLs use SPDY over
+// TLS. Sessions are pooled by scheme and host:port, with the requests
+// to a host multiplexed over one session until it hits the streams limit
+// of the server, when another session is opened.
+type Transport struct {
+	// the TLS configuration for "https" requests. If nil, the default
+	// configuration is used
+	TLSClientConfig *tls.Config
+	// if set, SPDY is known to be spoken by the hosts, so it is not
+	// negotiated with ALPN on the TLS connections of "https" requests, as
+	// for a ServeConn at the other end. It is never negotiated for "http"
+	// requests
+	PriorKnowledge bool
+	// the TLS configurations for "https" requests to particular hosts,
+	// by host:port or by host name, to be used instead of TLSClientConfig,
+	// e.g. for the root CAs or the client certificates of a host
+	HostTLSClientConfigs map[string]*tls.Config
+	// if set, used to make the connections of the sessions, for both
+	// "http" and "https" requests. If nil, net.Dialer is used, racing
+	// the IPv6 and IPv4 addresses of hosts with both, as per RFC 8305
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// how long to wait for the IPv6 connection to a host before racing
+	// it with an IPv4 one, when DialContext is nil. If zero,
+	// DEFAULT_FALLBACK_DELAY is used. If negative, there is no racing
+	FallbackDelay time.Duration
+	// options of the TCP connections made, by DialContext or not, set
+	// before the sessions start. If nil, the defaults of Go are kept
+	SocketOptions *SocketOptions
+	// decides if a request that failed is to be retried on a new stream,
+	// given the attempts made so far. If nil, requests are retried up to
+	// DEFAULT_MAX_RETRIES times when the server did not process them, or
+	// when they are idempotent and their session was lost before the reply
+	RetryPolicy func(req *http.Request, attempts int, err error) bool
+	// maximum time to wait for the reply of a request, from the sending
+	// of its SYN_STREAM. If zero, there is no limit
+	ResponseHeaderTimeout time.Duration
+	// if set, pooled sessions without streams are pinged to check they
+	// are alive, and closed once they have been idle for this long
+	MaxIdleTime time.Duration
+	// if set, header blocks are sent uncompressed, as stored zlib blocks,
+	// against CRIME-style attacks. Compressed headers are still accepted
+	NoHeaderCompression bool
+	// zlib compression level of the header blocks sent, from
+	// zlib.HuffmanOnly to zlib.BestCompression, to trade compression for
+	// CPU time. If zero, zlib.BestCompression is used
+	HeaderCompressionLevel int
+	// if set, the zlib dictionary of the header blocks sent and received,
+	// rather than the one of SPDY/3, for the other end to use as well
+	HeaderDictionary []byte
+	// maximum bytes per second of DATA sent by each session, and by each
+	// stream of a session. If zero, there is no limit other than flow
+	// control
+	SessionRateLimit int64
+	StreamRateLimit  int64
+	// if set, gets the messages of the sessions, with the address of the
+	// other end as the "session" field, and the ID of the stream, if any,
+	// as the "stream" field. If nil, they go to the log of the package
+	Logger *slog.Logger
+	// if set, called for every new session, returning where to record its
+	// frames, if anywhere
+	FrameCapture func(*Session) *FrameCapture
+	// if set, called for every new session, returning the callbacks for
+	// its events, if any
+	Events func(*Session) *SessionEvents
+	// if set, sessions are pinged when nothing is received for this long,
+	// keeping the RTT of their Stats, and closed when the other end does
+	// not reply within it
+	PingInterval time.Duration
+	// initial flow control window of the streams of the server, in bytes,
+	// advertised in the SETTINGS of the sessions. If zero, the default
+	// of 64KB is used
+	InitialWindowSize uint32
+	// maximum payload size of a frame received, in bytes.
+	// If zero, DEFAULT_MAX_FRAME_BYTES is used
+	MaxFrameBytes int
+	// if set, keeps the SETTINGS values the servers ask to persist, by
+	// origin, e.g. on disk to outlive the Transport. If nil, the
+	// Transport keeps them in memory
+	SettingsStore SettingsStore
+	mu            sync.Mutex
+	sessions      map[string][]*Session // sessions by scheme and host:port
+	dialing       map[string]*dialCall  // dials in progress, by the same key
+	settings      *memorySettingsStore  // when there is no SettingsStore
+	settingsOnce  sync.Once
+}
+
+// ForwardProxy is an http.Handler for a Server to be a SPDY proxy, like
+// the data-reduction proxies of Chrome: the requests of the streams are
+// forwarded to the origin servers given by their absolute URIs, or by
+// their :scheme and :host, and CONNECT requests are tunneled to the
+// authority given
+type ForwardProxy struct {
+	// used to forward the requests. If nil, http.DefaultTransport is used
+	Transport http.RoundTripper
+	// used to make the connections of the tunnels. If nil, net.Dialer is
+	// used
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// WebSocket is a WebSocket connection over a SPDY stream, as per
+// draft-tamplin-spdy-websocket: the handshake is done with the headers of
+// the stream, and the frames of RFC 6455 are carried by its DATA frames,
+// without masking
+type WebSocket struct {
+	// the subprotocol agreed in the handshake, if any
+	Subprotocol string
+	// maximum number of bytes of a message read. If zero,
+	// DEFAULT_MAX_WEBSOCKET_MESSAGE is used
+	MaxMessageSize int
+	conn           net.Conn // the stream
+	r              *bufio.Reader
+	wmu            sync.Mutex // for writing whole frames
+	closeSent      bool
+}
+
+// FrameCapture is where a session records all the frames it sends and
+// receives, to diagnose interoperability problems after the fact. Any of
+// the writers may be nil.
+type FrameCapture struct {
+	// gets each frame as a record of the time, in big endian unix
+	// nanoseconds (8 bytes), the direction, 0 for received and 1 for sent
+	// (1 byte), and the frame as on the wire, to be read with a
+	// CaptureReader
+	Binary io.Writer
+	// gets each frame decoded as text, after its time and direction
+	Text io.Writer
+}
+
+// the bytes before each frame in a binary capture
+const CAPTURE_HEAD_SIZE = 9
+
+// the capture of the frames of a session
+type frameCapture struct {
+	mu      sync.Mutex
+	config  FrameCapture
+	framers [2]*Framer // decode the text, for received and sent frames
+	failed  bool
+}
+
+// CapturedFrame is a frame read from a binary capture
+type CapturedFrame struct {
+	Time time.Time
+	Sent bool   // sent by the session, or received otherwise
+	Wire []byte // the frame as on the wire
+	Frame
+}
+
+// CaptureReader reads the frames of a binary capture, decoding their
+// headers as the session that captured them did
+type CaptureReader struct {
+	r       io.Reader
+	framers [2]*Framer // for received and sent frames
+}
+
+// Recorder writes the frames of each session to a binary capture file of
+// its own, in a directory, for the session to be replayed later. Its
+// Capture method is to be set as the FrameCapture of a Server or a
+// Transport
+type Recorder struct {
+	Dir string
+	mu  sync.Mutex
+	seq int // of the files, in the names
+}
+
+// the file of a session of a Recorder, dropping what comes after the
+// session is done
+type recordFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	closed bool
+}
+
+// Replayer feeds the frames received by a recorded server session to a
+// new server session, in order, to reproduce what happened to it
+type Replayer struct {
+	// serves the requests replayed. If nil, they get a 404
+	Handler http.Handler
+	// if set, the frames are fed with the delays they had in the capture
+	Timing bool
+	// how long to wait for the streams of the session to be done after
+	// the last frame. If zero, DEFAULT_REPLAY_TIMEOUT is used
+	Timeout time.Duration
+	// if set, where the new session records its frames, to compare them
+	// with the capture
+	Capture *FrameCapture
+}
+
+// default time for the streams of a replayed session to be done
+const DEFAULT_REPLAY_TIMEOUT = 5 * time.Second
+
+// the ID of the PING sent after the frames replayed, which is answered
+// once the session has processed them
+const REPLAY_PING_ID = 0x7fffffff
+
+// ClientTrace is a set of hooks run at the stages of a request made
+// over SPDY, like the ones of net/http/httptrace, to see where its time
+// goes. It is attached to the context of a request with WithClientTrace,
+// for the requests made with a Transport or with NewStreamProxy. Any of
+// the hooks may be nil.
+type ClientTrace struct {
+	// called once the request has a stream, on a new session or on one
+	// from the pool of a Transport
+	GotConn func(GotConnInfo)
+	// called once the SYN_STREAM with the headers is handed to the session
+	WroteHeaders func()
+	// called when the SYN_REPLY arrives
+	GotFirstResponseByte func()
+	// called when the other end resets the stream, with the status of the
+	// RST_STREAM
+	StreamReset func(status uint32)
+	// called when the stream could send again after waiting for the other
+	// end to open its flow control window, with the time waited
+	WindowStalled func(d time.Duration)
+}
+
+// SessionEvents is a set of callbacks run on the events of a session, for
+// applications to keep their own bookkeeping without polling. They run on
+// the loop of the session, so they must not block nor wait on the session.
+// Any of them may be nil.
+type SessionEvents struct {
+	// called when a stream is registered in the session
+	StreamOpened func(str *Stream)
+	// called when a stream leaves the session, with the error it ended
+	// with, nil if it completed
+	StreamClosed func(str *Stream, err error)
+	// called when the other end sends a GOAWAY, with its last good stream
+	// ID and status. New streams are refused by then, and the streams over
+	// the last good one, not processed, fail right after it with a
+	// SessionError to Retry
+	GoAwayReceived func(lastGood uint32, status uint32)
+	// called when the other end sends its SETTINGS
+	SettingsReceived func(settings *SettingsFrame)
+	// called once the session is done, with the error it failed with, nil
+	// if it ended cleanly
+	SessionClosed func(err error)
+}
+
+// GotConnInfo is the argument of the GotConn hook of a ClientTrace
+type GotConnInfo struct {
+	Session *Session
+	// whether the session was pooled, rather than made for the request
+	Reused bool
+}
+
+// the key of the ClientTrace in the context of a request
+type clientTraceKey struct{}
+
+// an error for operations that timed out, as a net.Error
+type timeoutError struct {
+	msg string
+}
+
+// a ResponseWriter turning the reply of a client stream into an
+// http.Response as it arrives, with the data streamed to its body
+type responseStreamer struct {
+	header      http.Header
+	res         *http.Response
+	body        *io.PipeWriter
+	ready       chan bool // closed once the reply has arrived
+	wroteHeader bool
+}
+
+// spdy server
 type Server struct {
 	Handler   http.Handler
 	Addr      string
 	TLSConfig *tls.Config
+	// if set, called with the streams opened with Session.OpenStream, as
+	// bidirectional byte pipes, instead of the Handler. The stream is
+	// finished when it returns. The header has the ones of the stream
+	OnStream func(conn net.Conn, header http.Header)
+	// if set, the resources in the Link headers with rel=preload of the
+	// replies are pushed along with them, served by the Handler, unless
+	// marked nopush
+	PushPreloads bool
+	// maximum number of pushed streams open at once per session. Pushes
+	// over it fail with ErrPushLimit. If zero, DEFAULT_MAX_CONCURRENT_PUSHES
+	// is used
+	MaxConcurrentPushes int
+	// maximum number of streams pushed along with a request. Pushes over
+	// it fail with ErrPushLimit. If zero, DEFAULT_MAX_PUSHES_PER_REQUEST is
+	// used
+	MaxPushesPerRequest int
+	// if set, keeps track of the resources pushed on the sessions, to
+	// push each only once per session, or as it sees fit, like once per
+	// client across its sessions. If nil, each session keeps track of its
+	// own
+	PushCache PushCache
+	// maximum size of a decompressed header block, in bytes.
+	// If zero, DEFAULT_MAX_HEADER_BYTES is used
+	MaxHeaderBytes int
+	// maximum payload size of a frame received, in bytes.
+	// If zero, DEFAULT_MAX_FRAME_BYTES is used
+	MaxFrameBytes int
+	// if set, sessions go away with a PROTOCOL_ERROR when a NOOP or an
+	// unknown control frame is received. By default they are ignored
+	StrictFrames bool
+	// if set, called when a session changes state
+	ConnState func(*Session, SessionState)
+	// maximum number of concurrent streams per session. Streams over the
+	// limit are refused. If zero, DEFAULT_MAX_CONCURRENT_STREAMS is used
+	MaxConcurrentStreams uint32
+	// initial flow control window of the streams of the clients, in bytes,
+	// advertised in the SETTINGS of the sessions. If zero, the default
+	// of 64KB is used
+	InitialWindowSize uint32
+	// if set, header blocks are sent uncompressed, as stored zlib blocks,
+	// against CRIME-style attacks. Compressed headers are still accepted
+	NoHeaderCompression bool
+	// zlib compression level of the header blocks sent, from
+	// zlib.HuffmanOnly to zlib.BestCompression, to trade compression for
+	// CPU time. If zero, zlib.BestCompression is used
+	HeaderCompressionLevel int
+	// if set, the zlib dictionary of the header blocks sent and received,
+	// rather than the one of SPDY/3, for the other end to use as well
+	HeaderDictionary []byte
+	// if set, small writes of the handlers are held for up to this long,
+	// e.g. a millisecond, to be sent in one DATA frame rather than one
+	// frame each. Flush sends them right away
+	WriteBufferDelay time.Duration
+	// the most bytes of small writes held as per WriteBufferDelay. If zero,
+	// COALESCE_DATA_BYTES is used
+	WriteBufferSize int
+	// maximum bytes per second of DATA sent by each session, and by each
+	// stream of a session. If zero, there is no limit other than flow
+	// control
+	SessionRateLimit int64
+	StreamRateLimit  int64
+	// maximum number of bytes buffered per session: the DATA received and
+	// not yet consumed by the handlers, the header blocks received, and the
+	// frames queued to be sent. Over it, the streams with the most bytes
+	// received are reset, new streams are refused, and the DATA to be sent
+	// waits for the frames queued before it. If zero, there is no limit
+	// other than flow control
+	MaxBufferedBytes int64
+	// options of the TCP connections accepted, set before the sessions
+	// start. If nil, the defaults of Go are kept
+	SocketOptions *SocketOptions
+	// if set, gets the messages of the sessions, with the address of the
+	// other end as the "session" field, and the ID of the stream, if any,
+	// as the "stream" field. If nil, they go to the log of the package
+	Logger *slog.Logger
+	// if set, called for every new session, returning where to record its
+	// frames, if anywhere
+	FrameCapture func(*Session) *FrameCapture
+	// if set, called for every new session, returning the callbacks for
+	// its events, if any
+	Events func(*Session) *SessionEvents
+	// if set, sessions are pinged when nothing is received for this long,
+	// keeping the RTT of their Stats, and closed when the other end does
+	// not reply within it
+	PingInterval time.Duration
+	// if set, called for every new connection, with its TLS state if it
+	// is a TLS connection, once the handshake is done and before the
+	// session starts, e.g. to enforce policies on client certificates or
+	// addresses. It can reject the connection by returning an error, or
+	// return settings for the session, overriding the ones of the server,
+	// and a Tag for it
+	OnNewSession func(c net.Conn, state *tls.ConnectionState) (*SessionConfig, error)
+	// maximum number of sessions served at once per client, by the IP of
+	// their remote address. With Serve and ListenAndServeTLSSpdyOnly, the
+	// connections over it are closed before their TLS handshake, if any.
+	// With ListenAndServeTLS, net/http completes the handshake first, and
+	// only the connections that negotiate SPDY are counted and closed. If
+	// zero, there is no limit
+	MaxSessionsPerIP int
+	// if set, returns the client of a connection for MaxSessionsPerIP,
+	// rather than its IP, like the one in the PROXY protocol header of a
+	// connection through a proxy. Connections without one are not limited
+	ClientKey func(c net.Conn) string
+	clients   map[string]int // sessions being served, by client
 	ln        net.Listener
+	hs        *http.Server      // for TLS servers with protocol negotiation
+	mu        sync.Mutex        // for ln, hs, sessions and clients
+	sessions  map[*Session]bool // sessions being served
+	closed    int32             // atomic, set by Close and Shutdown
 	//channel on which the server passes any new spdy 'Session' structs that get created during its lifetime
 	ss_chan chan *Session
 }
 
-//spdy conn
+// SocketOptions holds the options of the TCP connections of sessions.
+// Sessions multiplex many streams on one connection, so their latency
+// suffers with Nagle's algorithm, which Go disables by default.
+type SocketOptions struct {
+	// if set, Nagle's algorithm is enabled (TCP_NODELAY is cleared)
+	Nagle bool
+	// period of the TCP keep-alives. If zero, the one of the listener
+	// or dialer is kept. If negative, keep-alives are disabled
+	KeepAlive time.Duration
+	// sizes of the receive (SO_RCVBUF) and send (SO_SNDBUF) buffers of
+	// the socket. If zero, the ones of the system are kept
+	ReadBuffer  int
+	WriteBuffer int
+	// if set, called last with the connection, to set any other option,
+	// e.g. through its SyscallConn
+	Control func(c *net.TCPConn) error
+}
+
+// SessionConfig holds the settings of a single server session,
+// as returned by the OnNewSession hook of a Server. Zero values
+// keep the settings of the server.
+type SessionConfig struct {
+	Handler              http.Handler
+	MaxConcurrentStreams uint32
+	// the flow control window for the streams of the other end,
+	// advertised in the SETTINGS of the session
+	InitialWindowSize uint32
+	// a value of the application for the session, like the identity of
+	// the client or its tenant, for the handlers through Session.Tag
+	Tag interface{}
+}
+
+// the SPDY sessions of an http.Server set up with ConfigureServer, for
+// its Shutdown to send them a GOAWAY and close them once drained
+type nextProtoSessions struct {
+	mu           sync.Mutex
+	sessions     map[*Session]bool
+	shuttingDown bool
+}
+
+// spdy conn
 type conn struct {
 	srv *Server
 	ss  *Session
@@ -0,0 +1,229 @@
+// Copyright 2013-14, Amahi. All rights reserved.
+// Use of this source code is governed by the
+// license that can be found in the LICENSE file.
+
+// WebSocket over SPDY streams
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"unicode/utf8"
+)
+
+// UpgradeWebSocket is for the handler of a server stream to take it over
+// as a WebSocket, replying to the handshake with a 101. A subprotocol
+// chosen by the handler is to be set in the Sec-WebSocket-Protocol
+// header of the ResponseWriter before. Requests that are not a handshake
+// get a 400, and an error is returned
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	var err error
+	switch {
+	case r.Method != "GET":
+		err = errors.New("spdy: WebSocket handshake with method " + r.Method)
+	case r.Header.Get("Sec-Websocket-Version") != "13":
+		err = errors.New("spdy: unsupported WebSocket version " + r.Header.Get("Sec-Websocket-Version"))
+	case ContextStream(r.Context()) == nil:
+		err = errors.New("spdy: WebSocket handshake not over a SPDY stream")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return newWebSocket(conn, w.Header().Get("Sec-Websocket-Protocol")), nil
+}
+
+// DialWebSocket opens a WebSocket to the given "ws" or "wss" URL over a
+// new stream of a client session, with the given headers, if any, for
+// the handshake, like the subprotocols in Sec-WebSocket-Protocol. The
+// context is for the handshake only
+func (s *Session) DialWebSocket(ctx context.Context, rawurl string, header http.Header) (*WebSocket, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return nil, errors.New("spdy: not a WebSocket URL: " + rawurl)
+	}
+	h := make(http.Header)
+	for name, values := range header {
+		h[http.CanonicalHeaderKey(name)] = values
+	}
+	h.Set(HEADER_METHOD, "GET")
+	h.Set(HEADER_PATH, u.RequestURI())
+	h.Set(HEADER_VERSION, "HTTP/1.1")
+	h.Set(HEADER_HOST, u.Host)
+	h.Set(HEADER_SCHEME, u.Scheme)
+	h.Set("Sec-Websocket-Version", "13")
+	conn, res, err := s.openTunnel(ctx, h, http.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+	return newWebSocket(conn, res.Header.Get("Sec-Websocket-Protocol")), nil
+}
+
+func newWebSocket(conn net.Conn, subprotocol string) *WebSocket {
+	return &WebSocket{Subprotocol: subprotocol, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// ReadMessage reads the next text or binary message, put together from
+// its fragments. Pings are answered while reading, and io.EOF is returned
+// once the other end closes the WebSocket
+func (ws *WebSocket) ReadMessage() (kind int, data []byte, err error) {
+	max := ws.MaxMessageSize
+	if max == 0 {
+		max = DEFAULT_MAX_WEBSOCKET_MESSAGE
+	}
+	for {
+		fin, op, payload, err := ws.readFrame(max - len(data))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case WS_PING:
+			ws.writeFrame(WS_PONG, payload)
+			continue
+		case WS_PONG:
+			continue
+		case WS_CLOSE:
+			ws.closeFrame(payload)
+			return 0, nil, io.EOF
+		case WS_CONTINUATION:
+			if kind == 0 {
+				return 0, nil, errors.New("spdy: WebSocket continuation without a message")
+			}
+		case WS_TEXT, WS_BINARY:
+			if kind != 0 {
+				return 0, nil, errors.New("spdy: WebSocket message within a fragmented one")
+			}
+			kind = op
+		default:
+			return 0, nil, errors.New(fmt.Sprintf("spdy: unknown WebSocket frame kind %d", op))
+		}
+		data = append(data, payload...)
+		if fin {
+			if kind == WS_TEXT && !utf8.Valid(data) {
+				return 0, nil, errors.New("spdy: WebSocket text message is not UTF-8")
+			}
+			return kind, data, nil
+		}
+	}
+}
+
+// readFrame reads a frame with a payload of up to max bytes, unmasking it
+// if masked by the other end
+func (ws *WebSocket) readFrame(max int) (fin bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = int(head[0] & 0x0f)
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(ws.r, b[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(ws.r, b[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= WS_CLOSE && (!fin || length > 125) {
+		err = errors.New("spdy: WebSocket control frame fragmented or too large")
+		return
+	}
+	if op < WS_CLOSE && length > uint64(max) {
+		err = errors.New("spdy: WebSocket message too large")
+		return
+	}
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// closeFrame answers the close frame of the other end with the same
+// status code, unless this end sent one already
+func (ws *WebSocket) closeFrame(payload []byte) {
+	if len(payload) > 2 {
+		payload = payload[:2]
+	}
+	ws.writeFrame(WS_CLOSE, payload)
+	ws.conn.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+// WriteMessage sends a whole message of the given kind, WS_TEXT or
+// WS_BINARY, or a WS_PING
+func (ws *WebSocket) WriteMessage(kind int, data []byte) error {
+	switch kind {
+	case WS_TEXT, WS_BINARY, WS_PING:
+	default:
+		return errors.New(fmt.Sprintf("spdy: cannot write a WebSocket message of kind %d", kind))
+	}
+	return ws.writeFrame(kind, data)
+}
+
+// writeFrame sends a final, unmasked frame
+func (ws *WebSocket) writeFrame(op int, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return errors.New("spdy: WebSocket already closed")
+	}
+	if op == WS_CLOSE {
+		ws.closeSent = true
+	}
+	buf := make([]byte, 2, 10+len(payload))
+	buf[0] = 0x80 | byte(op)
+	switch {
+	case len(payload) < 126:
+		buf[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+	_, err := ws.conn.Write(append(buf, payload...))
+	return err
+}
+
+// Close sends a close frame with the normal closure status, if none was
+// sent, and finishes the stream
+func (ws *WebSocket) Close() error {
+	ws.writeFrame(WS_CLOSE, []byte{0x03, 0xe8})
+	return ws.conn.Close()
+}